@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// Extended attributes holding POSIX ACLs, as read and written by getfacl and setfacl
+const (
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
+// Tags of the entries of an ACL in the Linux xattr format
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclXattrVersion = 2
+	aclUndefinedID  = 0xffffffff
+)
+
+// aclTags maps the tags of the Data Lake ACL format, the qualifier telling the owner from named entries
+var aclTags = map[string][2]uint16{
+	"user":  {aclUserObj, aclUser},
+	"group": {aclGroupObj, aclGroup},
+	"mask":  {aclMask, aclMask},
+	"other": {aclOther, aclOther},
+}
+
+// aclEntry is an entry of the ACL of a path with a hierarchical namespace
+type aclEntry struct {
+	defaults  bool   // entry of the default ACL of a directory
+	tag       string // user, group, mask or other
+	qualifier string // user or group of named entries, empty otherwise
+	perm      uint16 // r, w and x as 4, 2 and 1
+}
+
+// xattrTag returns the tag of the entry in the xattr format
+func (e aclEntry) xattrTag() uint16 {
+	tags := aclTags[e.tag]
+	if e.qualifier == "" {
+		return tags[0]
+	}
+	return tags[1]
+}
+
+// mapped tells whether the entry can be shown to Linux, named entries must be numeric ids
+// rather than Azure AD object ids
+func (e aclEntry) mapped() bool {
+	if e.qualifier == "" {
+		return true
+	}
+	_, err := strconv.ParseUint(e.qualifier, 10, 32)
+	return err == nil
+}
+
+// parseACL parses an ACL of the Data Lake service, such as user::rwx,group::r-x,other::---,default:user::rwx
+func parseACL(acl string) ([]aclEntry, error) {
+	var entries []aclEntry
+	for _, spec := range strings.Split(acl, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		var e aclEntry
+		if strings.HasPrefix(spec, "default:") {
+			e.defaults, spec = true, strings.TrimPrefix(spec, "default:")
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid ACL entry %q", spec)
+		}
+		if _, known := aclTags[parts[0]]; !known {
+			return nil, fmt.Errorf("invalid ACL entry %q", spec)
+		}
+		perm, ok := parsePerm(parts[2])
+		if !ok {
+			return nil, fmt.Errorf("invalid permissions in ACL entry %q", spec)
+		}
+		e.tag, e.qualifier, e.perm = parts[0], parts[1], perm
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parsePerm parses permissions such as r-x
+func parsePerm(s string) (uint16, bool) {
+	if len(s) != 3 {
+		return 0, false
+	}
+	var perm uint16
+	for i := 0; i < 3; i++ {
+		switch s[i] {
+		case "rwx"[i]:
+			perm |= 4 >> uint(i)
+		case '-':
+		default:
+			return 0, false
+		}
+	}
+	return perm, true
+}
+
+// formatACL formats entries in the ACL format of the Data Lake service
+func formatACL(entries []aclEntry) string {
+	specs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		perm := []byte("---")
+		for i := 0; i < 3; i++ {
+			if e.perm&(4>>uint(i)) != 0 {
+				perm[i] = "rwx"[i]
+			}
+		}
+		spec := e.tag + ":" + e.qualifier + ":" + string(perm)
+		if e.defaults {
+			spec = "default:" + spec
+		}
+		specs = append(specs, spec)
+	}
+	return strings.Join(specs, ",")
+}
+
+// aclScope returns the entries of the access or the default ACL
+func aclScope(entries []aclEntry, defaults bool) []aclEntry {
+	var scope []aclEntry
+	for _, e := range entries {
+		if e.defaults == defaults {
+			scope = append(scope, e)
+		}
+	}
+	return scope
+}
+
+// encodeACLXattr encodes the entries of one ACL in the Linux xattr format, ordered as the kernel
+// requires. Entries of users or groups which are not numeric ids are left out.
+func encodeACLXattr(entries []aclEntry) []byte {
+	var mapped []aclEntry
+	for _, e := range entries {
+		if e.mapped() {
+			mapped = append(mapped, e)
+		}
+	}
+	sort.SliceStable(mapped, func(i, j int) bool {
+		if ti, tj := mapped[i].xattrTag(), mapped[j].xattrTag(); ti != tj {
+			return ti < tj
+		}
+		idi, _ := strconv.ParseUint(mapped[i].qualifier, 10, 32)
+		idj, _ := strconv.ParseUint(mapped[j].qualifier, 10, 32)
+		return idi < idj
+	})
+	b := make([]byte, 4, 4+8*len(mapped))
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for _, e := range mapped {
+		id := uint64(aclUndefinedID)
+		if e.qualifier != "" {
+			id, _ = strconv.ParseUint(e.qualifier, 10, 32)
+		}
+		var entry [8]byte
+		binary.LittleEndian.PutUint16(entry[0:], e.xattrTag())
+		binary.LittleEndian.PutUint16(entry[2:], e.perm)
+		binary.LittleEndian.PutUint32(entry[4:], uint32(id))
+		b = append(b, entry[:]...)
+	}
+	return b
+}
+
+// decodeACLXattr decodes an ACL in the Linux xattr format as entries of the access or the default ACL
+func decodeACLXattr(b []byte, defaults bool) ([]aclEntry, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 || binary.LittleEndian.Uint32(b) != aclXattrVersion {
+		return nil, fmt.Errorf("invalid ACL of %d bytes", len(b))
+	}
+	var entries []aclEntry
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		tag, perm, id := binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:]), binary.LittleEndian.Uint32(b[4:])
+		e := aclEntry{defaults: defaults, perm: perm & 7}
+		switch tag {
+		case aclUserObj, aclUser:
+			e.tag = "user"
+		case aclGroupObj, aclGroup:
+			e.tag = "group"
+		case aclMask:
+			e.tag = "mask"
+		case aclOther:
+			e.tag = "other"
+		default:
+			return nil, fmt.Errorf("invalid ACL entry tag %#x", tag)
+		}
+		if tag == aclUser || tag == aclGroup {
+			e.qualifier = strconv.FormatUint(uint64(id), 10)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// replaceACL replaces the access or the default ACL among entries. Named entries of the replaced ACL
+// which Linux cannot show are kept, unless the ACL is removed.
+func replaceACL(entries []aclEntry, defaults bool, replacement []aclEntry) []aclEntry {
+	var result []aclEntry
+	for _, e := range entries {
+		if e.defaults != defaults || (len(replacement) > 0 && !e.mapped()) {
+			result = append(result, e)
+		}
+	}
+	return append(result, replacement...)
+}
+
+// aclMode returns the permission bits of a file with the access ACL entries, the group bits being
+// those of the mask when there is one
+func aclMode(entries []aclEntry) (mode os.FileMode, ok bool) {
+	var user, group, mask, other *aclEntry
+	for i, e := range entries {
+		if e.defaults || e.qualifier != "" {
+			continue
+		}
+		switch e.tag {
+		case "user":
+			user = &entries[i]
+		case "group":
+			group = &entries[i]
+		case "mask":
+			mask = &entries[i]
+		case "other":
+			other = &entries[i]
+		}
+	}
+	if user == nil || group == nil || other == nil {
+		return 0, false
+	}
+	if mask != nil {
+		group = mask
+	}
+	return os.FileMode(user.perm)<<6 | os.FileMode(group.perm)<<3 | os.FileMode(other.perm), true
+}
+
+// checkAccess tells whether the caller of req may access a path with the attributes attr and the access
+// ACL entries, following the POSIX ACL algorithm. Only the primary group of the caller is known.
+func checkAccess(attr fuse.Attr, entries []aclEntry, req *fuse.AccessRequest) bool {
+	want := uint16(req.Mask & 7)
+	if want == 0 {
+		return true
+	}
+	if req.Uid == 0 {
+		// Root may execute a file only when someone may, the group bits standing for the mask
+		return want&1 == 0 || attr.Mode.IsDir() || attr.Mode&0o111 != 0
+	}
+	entries = aclScope(entries, false)
+	if len(entries) == 0 {
+		// The permission bits are the whole ACL
+		perm := uint16(attr.Mode.Perm())
+		entries = []aclEntry{
+			{tag: "user", perm: perm >> 6 & 7},
+			{tag: "group", perm: perm >> 3 & 7},
+			{tag: "other", perm: perm & 7},
+		}
+	}
+	uid, gid := strconv.FormatUint(uint64(req.Uid), 10), strconv.FormatUint(uint64(req.Gid), 10)
+	mask := uint16(7)
+	for _, e := range entries {
+		if e.tag == "mask" {
+			mask = e.perm
+		}
+	}
+	for _, e := range entries {
+		if e.tag == "user" && e.qualifier == "" && req.Uid == attr.Uid {
+			return e.perm&want == want
+		}
+	}
+	for _, e := range entries {
+		if e.tag == "user" && e.qualifier == uid {
+			return e.perm&mask&want == want
+		}
+	}
+	groupMatched := false
+	for _, e := range entries {
+		if e.tag == "group" && ((e.qualifier == "" && req.Gid == attr.Gid) || e.qualifier == gid) {
+			if e.perm&mask&want == want {
+				return true
+			}
+			groupMatched = true
+		}
+	}
+	if groupMatched {
+		return false
+	}
+	for _, e := range entries {
+		if e.tag == "other" {
+			return e.perm&want == want
+		}
+	}
+	return false
+}
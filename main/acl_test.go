@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+const testACL = "user::rwx,user:1001:r-x,user:5e1f0c2a-8c8e-4b2b-9d0e-3c7f6a1b2d4e:rwx,group::r-x,mask::r-x,other::---," +
+	"default:user::rwx,default:group::r-x,default:other::---"
+
+func TestACLXattrRoundTrip(t *testing.T) {
+	entries, err := parseACL(testACL)
+	if err != nil {
+		t.Fatalf("parseACL: %v", err)
+	}
+	if got := formatACL(entries); got != testACL {
+		t.Errorf("formatACL returned %q", got)
+	}
+
+	// The entry of an Azure AD object id cannot be shown to Linux
+	b := encodeACLXattr(aclScope(entries, false))
+	if len(b) != 4+5*8 {
+		t.Fatalf("encoded access ACL has %d bytes", len(b))
+	}
+	decoded, err := decodeACLXattr(b, false)
+	if err != nil {
+		t.Fatalf("decodeACLXattr: %v", err)
+	}
+	if got, want := formatACL(decoded), "user::rwx,user:1001:r-x,group::r-x,mask::r-x,other::---"; got != want {
+		t.Errorf("decoded access ACL is %q, want %q", got, want)
+	}
+	for _, invalid := range [][]byte{nil, {1, 0, 0, 0}, b[:7]} {
+		if _, err := decodeACLXattr(invalid, false); err == nil {
+			t.Errorf("decodeACLXattr(%v) succeeded", invalid)
+		}
+	}
+	if _, err := parseACL("user::rwz"); err == nil {
+		t.Errorf("parseACL accepted invalid permissions")
+	}
+}
+
+func TestReplaceACL(t *testing.T) {
+	entries, _ := parseACL(testACL)
+	replacement, _ := parseACL("user::rw-,group::r--,other::r--")
+	got := formatACL(replaceACL(entries, false, replacement))
+	want := "user:5e1f0c2a-8c8e-4b2b-9d0e-3c7f6a1b2d4e:rwx,default:user::rwx,default:group::r-x,default:other::---," +
+		"user::rw-,group::r--,other::r--"
+	if got != want {
+		t.Errorf("replaced access ACL is %q, want %q", got, want)
+	}
+	if got, want := formatACL(replaceACL(entries, true, nil)), "user::rwx,user:1001:r-x,user:5e1f0c2a-8c8e-4b2b-9d0e-3c7f6a1b2d4e:rwx,group::r-x,mask::r-x,other::---"; got != want {
+		t.Errorf("ACL without default is %q, want %q", got, want)
+	}
+	if mode, ok := aclMode(entries); !ok || mode != 0o750 {
+		t.Errorf("aclMode returned %v, %v", mode, ok)
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	entries, _ := parseACL("user::rw-,user:1001:rwx,group::rw-,group:2002:r--,mask::r-x,other::--x")
+	attr := fuse.Attr{Mode: 0o654, Uid: 1000, Gid: 2000}
+	for _, tc := range []struct {
+		uid, gid, mask uint32
+		entries        []aclEntry
+		allowed        bool
+	}{
+		{1000, 2000, 6, entries, true},  // owner
+		{1000, 2000, 1, entries, false}, // owner without x
+		{1001, 3000, 5, entries, true},  // named user, within the mask
+		{1001, 3000, 2, entries, false}, // named user, masked
+		{1002, 2000, 4, entries, true},  // owning group, within the mask
+		{1002, 2000, 2, entries, false}, // owning group, masked
+		{1002, 2002, 1, entries, false}, // a matching group denies other entries
+		{1002, 3000, 1, entries, true},  // other
+		{0, 0, 7, entries, true},        // root
+		{1002, 2000, 5, nil, true},      // permission bits of the owning group
+		{1002, 3000, 4, nil, true},      // permission bits of others
+		{1002, 3000, 2, nil, false},
+	} {
+		req := &fuse.AccessRequest{Header: fuse.Header{Uid: tc.uid, Gid: tc.gid}, Mask: tc.mask}
+		if got := checkAccess(attr, tc.entries, req); got != tc.allowed {
+			t.Errorf("access %o by %d:%d with ACL %q is %v, want %v", tc.mask, tc.uid, tc.gid, formatACL(tc.entries), got, tc.allowed)
+		}
+	}
+
+	// Root executes only files with an execute bit, and searches any directory
+	root := &fuse.AccessRequest{Mask: 1}
+	if checkAccess(fuse.Attr{Mode: 0o644}, nil, root) {
+		t.Errorf("root may execute a file without execute bits")
+	}
+	if !checkAccess(fuse.Attr{Mode: os.ModeDir | 0o600}, nil, root) {
+		t.Errorf("root may not search a directory without execute bits")
+	}
+	if !checkAccess(fuse.Attr{Mode: 0o000}, nil, &fuse.AccessRequest{Mask: 6}) {
+		t.Errorf("root may not read and write a file without permissions")
+	}
+}
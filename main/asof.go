@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// xattrVersionID is the version of the blob of a file mounted with AsOf
+const xattrVersionID = xattrAzure + "version_id"
+
+// asOfStorage is the read-only Storage of the blobs written at or before a time, with the latest
+// version of each written by then. It is not exactly the container at that time: blobs deleted before
+// it are shown as well as those deleted later, the service keeps no time for the deletion of a version.
+type asOfStorage struct {
+	store VersionedStorage
+	asOf  time.Time
+
+	sync.Mutex
+	versions map[string]string // version of the blobs already listed or looked up
+}
+
+var _ Storage = (*asOfStorage)(nil)
+
+// newAsOfStorage returns the Storage of the blobs of store as they were at asOf
+func newAsOfStorage(store VersionedStorage, asOf time.Time) *asOfStorage {
+	return &asOfStorage{store: store, asOf: asOf, versions: make(map[string]string)}
+}
+
+// versionTime returns the time the version of the blob was written. Blobs written before versioning
+// was enabled have no version, their last modification time is used.
+func versionTime(blob BlobAttr) time.Time {
+	if blob.VersionID != "" {
+		if t, err := time.Parse(time.RFC3339Nano, blob.VersionID); err == nil {
+			return t
+		}
+	}
+	return blob.LastModified
+}
+
+// latest returns the latest version of each blob written at or before the time of the storage, in the
+// order of the names, and remembers them
+func (s *asOfStorage) latest(versions []BlobAttr) []BlobAttr {
+	var blobItems []BlobAttr
+	var latest []time.Time
+	index := make(map[string]int)
+	for _, blob := range versions {
+		t := versionTime(blob)
+		if t.After(s.asOf) {
+			continue
+		}
+		if i, seen := index[blob.Name]; seen {
+			if t.After(latest[i]) {
+				blobItems[i], latest[i] = blob, t
+			}
+			continue
+		}
+		index[blob.Name] = len(blobItems)
+		blobItems = append(blobItems, blob)
+		latest = append(latest, t)
+	}
+	s.Lock()
+	for _, blob := range blobItems {
+		s.versions[blob.Name] = blob.VersionID
+	}
+	s.Unlock()
+	return blobItems
+}
+
+// version returns the version of the blob at the time of the storage, listing its versions unless
+// the blob was already listed
+func (s *asOfStorage) version(ctx context.Context, name string) (string, error) {
+	s.Lock()
+	versionID, exists := s.versions[name]
+	s.Unlock()
+	if exists {
+		return versionID, nil
+	}
+	versions, _, err := s.store.ListVersions(ctx, name, false)
+	if err != nil {
+		return "", err
+	}
+	for _, blob := range s.latest(versions) {
+		if blob.Name == name {
+			return blob.VersionID, nil
+		}
+	}
+	return "", ErrBlobNotFound
+}
+
+// List returns the blobs directly under prefix as they were at the time of the storage. Prefixes are
+// returned when any version of a blob below them exists, even one written later.
+func (s *asOfStorage) List(ctx context.Context, prefix string) ([]BlobAttr, []string, error) {
+	versions, prefixes, err := s.store.ListVersions(ctx, prefix, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.latest(versions), prefixes, nil
+}
+
+// ListRecursive returns every blob under prefix as it was at the time of the storage
+func (s *asOfStorage) ListRecursive(ctx context.Context, prefix string) ([]BlobAttr, error) {
+	versions, _, err := s.store.ListVersions(ctx, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.latest(versions), nil
+}
+
+// GetRange fills b with the content of the version of the blob starting at offset
+func (s *asOfStorage) GetRange(ctx context.Context, name string, offset int64, b []byte) error {
+	versionID, err := s.version(ctx, name)
+	if err != nil {
+		return err
+	}
+	if versionID == "" {
+		return s.store.GetRange(ctx, name, offset, b)
+	}
+	return s.store.GetVersionRange(ctx, name, versionID, offset, b)
+}
+
+// GetProperties returns the properties and metadata of the version of the blob
+func (s *asOfStorage) GetProperties(ctx context.Context, name string) (BlobAttr, error) {
+	versionID, err := s.version(ctx, name)
+	if err != nil {
+		return BlobAttr{}, err
+	}
+	if versionID == "" {
+		return s.store.GetProperties(ctx, name)
+	}
+	return s.store.GetVersionProperties(ctx, name, versionID)
+}
+
+// Put fails, versions are read-only
+func (s *asOfStorage) Put(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	return errReadOnly
+}
+
+// StageBlock fails, versions are read-only
+func (s *asOfStorage) StageBlock(ctx context.Context, name string, blockID string, data []byte) error {
+	return errReadOnly
+}
+
+// CommitBlocks fails, versions are read-only
+func (s *asOfStorage) CommitBlocks(ctx context.Context, name string, blockIDs []string, metadata map[string]string) error {
+	return errReadOnly
+}
+
+// Delete fails, versions are read-only
+func (s *asOfStorage) Delete(ctx context.Context, name string) error {
+	return errReadOnly
+}
+
+// Copy fails, versions are read-only
+func (s *asOfStorage) Copy(ctx context.Context, src string, dst string) error {
+	return errReadOnly
+}
+
+// SetMetadata fails, versions are read-only
+func (s *asOfStorage) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	return errReadOnly
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAsOfStorage(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.versioning = true
+	fake.addBlob("data/train.csv", []byte("v1"), nil)
+	fake.addBlob("data/old.csv", []byte("old"), nil)
+	asOf := time.Now().UTC()
+	time.Sleep(time.Millisecond)
+	fake.addBlob("data/train.csv", []byte("v2"), nil)
+	fake.addBlob("data/new.csv", []byte("new"), nil)
+	if err := NewBlobStorage(fake.ContainerURL()).Delete(ctx, "data/old.csv"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	filesys := NewFS(newAsOfStorage(NewBlobStorage(fake.ContainerURL()), asOf))
+	filesys.readOnly = true
+	n, err := filesys.root.Lookup(ctx, "data")
+	if err != nil {
+		t.Fatalf("Lookup data: %v", err)
+	}
+	data := n.(*Dir)
+	names := readDirNames(t, data)
+	_, hasTrain := names["train.csv"]
+	_, hasOld := names["old.csv"]
+	if len(names) != 2 || !hasTrain || !hasOld {
+		t.Errorf("data lists %v, want train.csv and old.csv", names)
+	}
+	for name, want := range map[string]string{"train.csv": "v1", "old.csv": "old"} {
+		n, err := data.Lookup(ctx, name)
+		if err != nil {
+			t.Fatalf("Lookup %s: %v", name, err)
+		}
+		f := n.(*File)
+		openFile(t, f)
+		if got := readFile(t, f, 0, 8); got != want {
+			t.Errorf("%s reads %q, want %q", name, got, want)
+		}
+		releaseFile(t, f)
+		if versionID, err := getXattr(f, xattrVersionID); err != nil || versionID == "" {
+			t.Errorf("%s of %s is %q, %v", xattrVersionID, name, versionID, err)
+		}
+	}
+
+	// Blobs looked up without listing their directory are resolved on their own
+	filesys = NewFS(newAsOfStorage(NewBlobStorage(fake.ContainerURL()), asOf))
+	filesys.readOnly = true
+	n, err = filesys.root.Lookup(ctx, "data")
+	if err != nil {
+		t.Fatalf("Lookup data: %v", err)
+	}
+	data = n.(*Dir)
+	if _, err := data.Lookup(ctx, "new.csv"); err == nil {
+		t.Errorf("new.csv written after %s was found", asOf)
+	}
+	n, err = data.Lookup(ctx, "train.csv")
+	if err != nil {
+		t.Fatalf("Lookup train.csv: %v", err)
+	}
+	f := n.(*File)
+	openFile(t, f)
+	if got := readFile(t, f, 0, 8); got != "v1" {
+		t.Errorf("train.csv reads %q, want v1", got)
+	}
+	releaseFile(t, f)
+}
+
+func TestAsOfLatestVersion(t *testing.T) {
+	asOf := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	s := newAsOfStorage(nil, asOf)
+	blobItems := s.latest([]BlobAttr{
+		{Name: "a", VersionID: "2020-01-01T00:00:00.0000000Z"},
+		{Name: "a", VersionID: "2020-05-31T23:59:59.9999999Z"},
+		{Name: "a", VersionID: "2020-06-01T00:00:00.0000001Z"},
+		{Name: "b", VersionID: "2020-07-01T00:00:00.0000000Z"},
+		{Name: "c", LastModified: asOf.Add(-time.Hour)},
+		{Name: "d", LastModified: asOf.Add(time.Hour)},
+	})
+	if len(blobItems) != 2 || blobItems[0].VersionID != "2020-05-31T23:59:59.9999999Z" || blobItems[1].Name != "c" {
+		t.Errorf("latest versions are %+v", blobItems)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Supported values of AuthType
+const (
+	authTypeKey       = "key"
+	authTypeSAS       = "sas"
+	authTypeSPN       = "spn"
+	authTypeMSI       = "msi"
+	authTypeTokenFile = "tokenfile"
+)
+
+// authType returns the normalized AuthType, inferring it from the given secrets when not set
+func authType() string {
+	switch {
+	case AuthType != "":
+		return strings.ToLower(AuthType)
+	case SasToken != "":
+		return authTypeSAS
+	default:
+		return authTypeKey
+	}
+}
+
+// newCredential returns the credential used to authorize requests to the storage account.
+// With a SAS token the requests are sent anonymously and the token travels in the URL.
+func newCredential() (azblob.Credential, error) {
+	mode := authType()
+	if mode != authTypeKey && AccountKey != "" {
+		return nil, fmt.Errorf("--accountKey cannot be used with authentication type %s", mode)
+	}
+	if mode != authTypeSAS && SasToken != "" {
+		return nil, fmt.Errorf("--sasToken cannot be used with authentication type %s", mode)
+	}
+
+	switch mode {
+	case authTypeKey:
+		if AccountKey == "" {
+			return nil, errors.New("Key authentication requires --accountKeyFile, " + envAccountKey + " or --accountKey")
+		}
+		return azblob.NewSharedKeyCredential(AccountName, AccountKey)
+	case authTypeSAS:
+		if SasToken == "" {
+			return nil, errors.New("SAS authentication requires --sasTokenFile, " + envSasToken + " or --sasToken")
+		}
+		return azblob.NewAnonymousCredential(), nil
+	case authTypeSPN:
+		fetch, err := servicePrincipalToken(AADEndpoint, TenantID, ClientID, ClientSecret, ClientCertPath)
+		if err != nil {
+			return nil, err
+		}
+		return newTokenCredential(fetch)
+	case authTypeMSI:
+		return newTokenCredential(managedIdentityToken(IMDSEndpoint, ClientID))
+	case authTypeTokenFile:
+		if TokenFile == "" {
+			return nil, errors.New("token file authentication requires --tokenFile")
+		}
+		return newTokenCredential(tokenFileToken(TokenFile))
+	default:
+		return nil, fmt.Errorf("unknown authentication type %q, expected Key, SAS, SPN, MSI or TokenFile", AuthType)
+	}
+}
+
+// parseSASToken parses a container or account SAS token, with or without the leading '?'
+func parseSASToken(token string) (azblob.SASQueryParameters, error) {
+	token = strings.TrimPrefix(strings.TrimSpace(token), "?")
+	values, err := url.ParseQuery(token)
+	if err != nil {
+		return azblob.SASQueryParameters{}, fmt.Errorf("invalid SAS token: %v", err)
+	}
+	if values.Get("sig") == "" {
+		return azblob.SASQueryParameters{}, errors.New("invalid SAS token: missing signature (sig)")
+	}
+	return azblob.NewBlobURLParts(url.URL{RawQuery: token}).SAS, nil
+}
+
+// validateSAS checks that sas can be used to mount a container at time now.
+// It returns readOnly as true when the token does not allow writes.
+func validateSAS(sas azblob.SASQueryParameters, now time.Time) (readOnly bool, err error) {
+	if expiry := sas.ExpiryTime(); !expiry.IsZero() && !now.Before(expiry) {
+		return false, fmt.Errorf("SAS token expired at %s", expiry.Format(time.RFC3339))
+	}
+	if start := sas.StartTime(); !start.IsZero() && now.Before(start) {
+		return false, fmt.Errorf("SAS token is not valid before %s", start.Format(time.RFC3339))
+	}
+
+	if sas.Services() != "" {
+		// Account SAS
+		if !strings.Contains(sas.Services(), "b") {
+			return false, fmt.Errorf("account SAS token does not grant access to the blob service (ss=%s)", sas.Services())
+		}
+		if !strings.Contains(sas.ResourceTypes(), "c") || !strings.Contains(sas.ResourceTypes(), "o") {
+			return false, fmt.Errorf("account SAS token must grant container and object resource types (srt=%s)", sas.ResourceTypes())
+		}
+	} else if sas.Resource() != "c" {
+		return false, fmt.Errorf("SAS token for resource %q cannot be used to mount a container, use a container or account SAS", sas.Resource())
+	}
+
+	perms := sas.Permissions()
+	if perms == "" && sas.Identifier() != "" {
+		// Permissions come from a stored access policy which cannot be read with the token itself
+		log.Printf("SAS token uses stored access policy %s, permissions are not validated", sas.Identifier())
+		return false, nil
+	}
+	if !strings.Contains(perms, "r") || !strings.Contains(perms, "l") {
+		return false, fmt.Errorf("SAS token must grant read and list permissions (sp=%s)", perms)
+	}
+	if !strings.Contains(perms, "w") {
+		return true, nil
+	}
+	if !strings.Contains(perms, "d") {
+		log.Printf("SAS token does not grant delete permission (sp=%s), removing files will fail", perms)
+	}
+	return false, nil
+}
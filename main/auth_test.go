@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSAS builds a SAS token string from query parameters
+func testSAS(params map[string]string) string {
+	values := url.Values{"sig": {"c2lnbmF0dXJl"}, "sv": {"2019-12-12"}}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	return "?" + values.Encode()
+}
+
+func TestValidateSAS(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		params   map[string]string
+		readOnly bool
+		errText  string
+	}{
+		{"container read write", map[string]string{"sr": "c", "sp": "racwdl", "se": "2020-06-02T00:00:00Z"}, false, ""},
+		{"container read only", map[string]string{"sr": "c", "sp": "rl", "se": "2020-06-02T00:00:00Z"}, true, ""},
+		{"account", map[string]string{"ss": "bf", "srt": "sco", "sp": "rwdlacup"}, false, ""},
+		{"stored policy", map[string]string{"sr": "c", "si": "policy"}, false, ""},
+		{"expired", map[string]string{"sr": "c", "sp": "rl", "se": "2020-06-01T11:00:00Z"}, false, "expired"},
+		{"not yet valid", map[string]string{"sr": "c", "sp": "rl", "st": "2020-06-01T13:00:00Z"}, false, "not valid before"},
+		{"blob sas", map[string]string{"sr": "b", "sp": "r"}, false, "cannot be used"},
+		{"no list", map[string]string{"sr": "c", "sp": "r"}, false, "read and list"},
+		{"account without blob", map[string]string{"ss": "q", "srt": "sco", "sp": "rl"}, false, "blob service"},
+		{"account without objects", map[string]string{"ss": "b", "srt": "s", "sp": "rl"}, false, "resource types"},
+	} {
+		sas, err := parseSASToken(testSAS(tc.params))
+		if err != nil {
+			t.Fatalf("%s: parseSASToken: %v", tc.name, err)
+		}
+		readOnly, err := validateSAS(sas, now)
+		switch {
+		case tc.errText == "" && err != nil:
+			t.Errorf("%s: validateSAS: %v", tc.name, err)
+		case tc.errText != "" && (err == nil || !strings.Contains(err.Error(), tc.errText)):
+			t.Errorf("%s: validateSAS returned %v, want error containing %q", tc.name, err, tc.errText)
+		case readOnly != tc.readOnly:
+			t.Errorf("%s: validateSAS returned readOnly %v, want %v", tc.name, readOnly, tc.readOnly)
+		}
+	}
+
+	if _, err := parseSASToken("sv=2019-12-12&sp=rl"); err == nil {
+		t.Errorf("parseSASToken accepted a token without signature")
+	}
+}
+
+func TestValidateAccountWithSAS(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.sasSignature = "c2lnbmF0dXJl"
+	useFakeAccount(t, fake)
+	AccountKey = ""
+	SasToken = testSAS(map[string]string{"sr": "c", "sp": "rl", "se": time.Now().Add(time.Hour).UTC().Format(time.RFC3339)})
+
+	if ret := ValidateAccount(); ret != 0 {
+		t.Fatalf("ValidateAccount returned %d", ret)
+	}
+	if !ReadOnly {
+		t.Errorf("read-only SAS did not force a read-only mount")
+	}
+
+	// Blob operations must carry the SAS as well
+	fake.addBlob("file.txt", []byte("data"), nil)
+	b := make([]byte, 4)
+	if err := NewBlobStorage(containerURL).GetRange(context.Background(), "file.txt", 0, b); err != nil {
+		t.Fatalf("GetRange with SAS: %v", err)
+	}
+
+	SasToken = testSAS(map[string]string{"sr": "c", "sp": "rl", "se": "2000-01-01T00:00:00Z"})
+	if ret := ValidateAccount(); ret == 0 {
+		t.Errorf("ValidateAccount accepted an expired SAS token")
+	}
+}
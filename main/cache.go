@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// cacheChunkSize is the size of the ranges a blob is downloaded into the cache with
+const cacheChunkSize = 4 << 20
+
+// cacheEntry is a blob materialized in the cache directory
+type cacheEntry struct {
+	name         string
+	file         *os.File
+	size         int64
+	etag         string
+	lastModified time.Time
+	users        int  // files reading through the entry, it is only evicted when there are none
+	stale        bool // replaced by a newer version of the blob, removed once unused
+	elem         *list.Element
+}
+
+// fileCache keeps recently opened blobs on local disk, up to maxSize bytes, evicting the least
+// recently used ones which are not open. Entries are revalidated against the ETag and
+// Last-Modified time of the blob when a file is opened again.
+type fileCache struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	entries map[string]*cacheEntry
+	lru     *list.List // front is the most recently used
+}
+
+// newFileCache returns a cache storing its files in dir
+func newFileCache(dir string, maxSize int64) *fileCache {
+	return &fileCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+}
+
+// acquire returns the entry holding the version of the blob described by attr, downloading it
+// when it is not cached or has changed. It returns nil when the blob does not fit in the cache.
+// Every entry returned must be given back with release.
+func (c *fileCache) acquire(ctx context.Context, store Storage, attr BlobAttr) (*cacheEntry, error) {
+	c.Lock()
+	if e, exists := c.entries[attr.Name]; exists {
+		if e.etag == attr.ETag && e.lastModified.Equal(attr.LastModified) && e.size == attr.Size {
+			e.users++
+			c.lru.MoveToFront(e.elem)
+			c.Unlock()
+			return e, nil
+		}
+		c.drop(e)
+	}
+	if attr.Size > c.maxSize || !c.reserve(attr.Size) {
+		c.Unlock()
+		return nil, nil
+	}
+	c.Unlock()
+
+	file, err := c.download(ctx, store, attr)
+	c.Lock()
+	defer c.Unlock()
+	if err != nil {
+		c.size -= attr.Size
+		return nil, err
+	}
+	e := &cacheEntry{
+		name:         attr.Name,
+		file:         file,
+		size:         attr.Size,
+		etag:         attr.ETag,
+		lastModified: attr.LastModified,
+		users:        1,
+	}
+	if old, exists := c.entries[attr.Name]; exists {
+		// Downloaded concurrently by another file, the newer download wins
+		c.drop(old)
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[attr.Name] = e
+	return e, nil
+}
+
+// release gives back an entry returned by acquire
+func (c *fileCache) release(e *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	e.users--
+	if e.users == 0 && e.stale {
+		c.remove(e)
+	}
+}
+
+// invalidate drops the cached copy of the blob, it is called when the blob is modified through the mount
+func (c *fileCache) invalidate(name string) {
+	c.Lock()
+	defer c.Unlock()
+	if e, exists := c.entries[name]; exists {
+		c.drop(e)
+	}
+}
+
+// reserve makes room for size bytes by evicting unused entries, the lock must be held
+func (c *fileCache) reserve(size int64) bool {
+	for elem := c.lru.Back(); elem != nil && c.size+size > c.maxSize; {
+		e := elem.Value.(*cacheEntry)
+		elem = elem.Prev()
+		if e.users == 0 {
+			c.drop(e)
+		}
+	}
+	if c.size+size > c.maxSize {
+		return false
+	}
+	c.size += size
+	return true
+}
+
+// drop takes the entry out of the cache, its file is removed once no file reads through it.
+// The lock must be held.
+func (c *fileCache) drop(e *cacheEntry) {
+	if e.stale {
+		return
+	}
+	e.stale = true
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.name)
+	if e.users == 0 {
+		c.remove(e)
+	}
+}
+
+// remove deletes the local copy of an unused entry, the lock must be held
+func (c *fileCache) remove(e *cacheEntry) {
+	e.file.Close()
+	os.Remove(e.file.Name())
+	c.size -= e.size
+}
+
+// download copies the blob to a new file in the cache directory in ranges of cacheChunkSize
+func (c *fileCache) download(ctx context.Context, store Storage, attr BlobAttr) (*os.File, error) {
+	sum := sha256.Sum256([]byte(attr.Name))
+	file, err := ioutil.TempFile(c.dir, hex.EncodeToString(sum[:8])+"-")
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, cacheChunkSize)
+	for offset := int64(0); offset < attr.Size; offset += int64(len(buf)) {
+		if remaining := attr.Size - offset; remaining < int64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		if err = store.GetRange(ctx, attr.Name, offset, buf); err != nil {
+			break
+		}
+		if _, err = file.WriteAt(buf, offset); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Error in caching %s: %v", attr.Name, err)
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// newCacheDir creates the cache directory of this mount inside tmpPath
+func newCacheDir(tmpPath string) (string, error) {
+	if err := os.MkdirAll(tmpPath, 0o700); err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(tmpPath, "blobfuse-go-"+filepath.Base(ContainerName)+"-")
+}
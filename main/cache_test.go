@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// newCachedFS returns a file system over store caching up to maxSize bytes in a temporary directory
+func newCachedFS(t *testing.T, store Storage, maxSize int64) *FS {
+	filesys := NewFS(store)
+	filesys.cache = newFileCache(t.TempDir(), maxSize)
+	return filesys
+}
+
+// openFile opens f and fails the test on error
+func openFile(t *testing.T, f *File) {
+	t.Helper()
+	if _, err := f.Open(context.Background(), &fuse.OpenRequest{}, &fuse.OpenResponse{}); err != nil {
+		t.Fatalf("Open %s: %v", f.path, err)
+	}
+}
+
+// releaseFile releases f and fails the test on error
+func releaseFile(t *testing.T, f *File) {
+	t.Helper()
+	if err := f.Release(context.Background(), &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("Release %s: %v", f.path, err)
+	}
+}
+
+func TestCacheServesUnchangedFileLocally(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "shard", []byte("epoch data"), nil)
+		recorder := &rangeRecorder{Storage: store}
+		filesys := newCachedFS(t, recorder, 1<<20)
+		f := lookupFile(t, filesys, "shard")
+
+		for epoch := 0; epoch < 3; epoch++ {
+			openFile(t, f)
+			if data := readFile(t, f, 0, 100); data != "epoch data" {
+				t.Errorf("Read in epoch %d returned %q", epoch, data)
+			}
+			releaseFile(t, f)
+		}
+		if len(recorder.ranges) != 1 {
+			t.Errorf("blob downloaded with ranges %v, want a single download", recorder.ranges)
+		}
+
+		// A changed blob is downloaded again
+		store.Put(ctx, "shard", []byte("new epoch data"), nil)
+		openFile(t, f)
+		if data := readFile(t, f, 0, 100); data != "new epoch data" {
+			t.Errorf("Read after change returned %q", data)
+		}
+		releaseFile(t, f)
+		if len(recorder.ranges) != 2 {
+			t.Errorf("changed blob not downloaded again, ranges %v", recorder.ranges)
+		}
+	})
+}
+
+func TestCacheEvictsLeastRecentlyUsedClosedFiles(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	for _, name := range []string{"a", "b", "c"} {
+		store.Put(ctx, name, []byte(name+name+name+name), nil)
+	}
+	filesys := newCachedFS(t, store, 10)
+	a, b, c := lookupFile(t, filesys, "a"), lookupFile(t, filesys, "b"), lookupFile(t, filesys, "c")
+
+	openFile(t, a)
+	releaseFile(t, a)
+	openFile(t, b)
+	openFile(t, c)
+	if _, cached := filesys.cache.entries["a"]; cached {
+		t.Errorf("a is still cached after b and c filled the cache")
+	}
+	if b.cached == nil || c.cached == nil {
+		t.Fatalf("open files b and c are not cached")
+	}
+
+	// Open files are never evicted, a is read from the storage instead
+	openFile(t, a)
+	if a.cached != nil {
+		t.Errorf("a was cached by evicting an open file")
+	}
+	if data := readFile(t, a, 0, 10); data != "aaaa" {
+		t.Errorf("Read of uncached file returned %q", data)
+	}
+	releaseFile(t, a)
+
+	releaseFile(t, b)
+	openFile(t, a)
+	if a.cached == nil {
+		t.Errorf("a is not cached after b was closed")
+	}
+	if _, cached := filesys.cache.entries["b"]; cached {
+		t.Errorf("closed file b was not evicted")
+	}
+	if files, _ := ioutil.ReadDir(filesys.cache.dir); len(files) != 2 {
+		t.Errorf("cache directory holds %d files, want 2", len(files))
+	}
+}
+
+func TestCacheInvalidatedByWrite(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "notes.txt", []byte("draft"), nil)
+		filesys := newCachedFS(t, store, 1<<20)
+		f := lookupFile(t, filesys, "notes.txt")
+
+		openFile(t, f)
+		if err := f.Write(ctx, &fuse.WriteRequest{Offset: 0, Data: []byte("final")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		releaseFile(t, f)
+		if len(filesys.cache.entries) != 0 || filesys.cache.size != 0 {
+			t.Errorf("cache holds %d entries of %d bytes after the blob was modified", len(filesys.cache.entries), filesys.cache.size)
+		}
+
+		openFile(t, f)
+		if data := readFile(t, f, 0, 100); data != "final" {
+			t.Errorf("Read after write returned %q", data)
+		}
+		releaseFile(t, f)
+	})
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"gopkg.in/yaml.v2"
+)
+
+// option ties a command line flag to its key in the configuration file and its environment variable
+type option struct {
+	flag   string
+	key    string // dotted path inside the configuration file
+	env    string // environment variable, empty if the option has none
+	secret bool   // redacted by --print-config and requires a private configuration file
+}
+
+// options lists everything that can be configured. Secrets come last so that the environment
+// only supplies the secret of the authentication type selected by the other options.
+var options = []option{
+	{flag: "mountPath", key: "mountPath"},
+	{flag: "accountName", key: "accountName", env: "AZURE_STORAGE_ACCOUNT"},
+	{flag: "containerName", key: "containerName"},
+	{flag: "endpoint", key: "endpoint", env: "AZURE_STORAGE_BLOB_ENDPOINT"},
+	{flag: "dfsEndpoint", key: "dfsEndpoint"},
+	{flag: "hns", key: "hns"},
+	{flag: "useHttp", key: "useHttp"},
+	{flag: "authType", key: "auth.type", env: "AZURE_STORAGE_AUTH_TYPE"},
+	{flag: "accountKeyFile", key: "auth.accountKeyFile"},
+	{flag: "sasTokenFile", key: "auth.sasTokenFile"},
+	{flag: "tenantId", key: "auth.tenantId", env: "AZURE_TENANT_ID"},
+	{flag: "clientId", key: "auth.clientId", env: "AZURE_CLIENT_ID"},
+	{flag: "clientSecretFile", key: "auth.clientSecretFile"},
+	{flag: "clientCertPath", key: "auth.clientCertPath"},
+	{flag: "tokenFile", key: "auth.tokenFile"},
+	{flag: "aadEndpoint", key: "auth.aadEndpoint"},
+	{flag: "imdsEndpoint", key: "auth.imdsEndpoint"},
+	{flag: "readOnly", key: "permissions.readOnly"},
+	{flag: "asOf", key: "versions.asOf"},
+	{flag: "fileMode", key: "permissions.fileMode"},
+	{flag: "dirMode", key: "permissions.dirMode"},
+	{flag: "uid", key: "permissions.uid"},
+	{flag: "gid", key: "permissions.gid"},
+	{flag: "attrTimeout", key: "cache.attrTimeout"},
+	{flag: "tmpPath", key: "cache.tmpPath"},
+	{flag: "cacheSizeMB", key: "cache.sizeMB"},
+	{flag: "operationTimeout", key: "timeouts.operation"},
+	{flag: "transferTimeout", key: "timeouts.transfer"},
+	{flag: "maxTries", key: "retry.maxTries"},
+	{flag: "tryTimeout", key: "retry.tryTimeout"},
+	{flag: "retryPolicy", key: "retry.policy"},
+	{flag: "retryDelay", key: "retry.delay"},
+	{flag: "maxRetryDelay", key: "retry.maxDelay"},
+	{flag: "blockSize", key: "uploads.blockSize"},
+	{flag: "journalPath", key: "rename.journalPath"},
+	{flag: "renameParallelism", key: "rename.parallelism"},
+	{flag: "renameRecovery", key: "rename.recovery"},
+	{flag: "directoryMarkers", key: "directories.markers"},
+	{flag: "deleteSnapshots", key: "remove.snapshots"},
+	{flag: "uploadTier", key: "tiers.upload"},
+	{flag: "rehydratePriority", key: "tiers.rehydratePriority"},
+	{flag: "snapshotDir", key: "snapshots.dir"},
+	{flag: "trashDir", key: "trash.dir"},
+	{flag: "trashRetention", key: "trash.retention"},
+	{flag: "logFile", key: "logging.file"},
+	{flag: "sasToken", key: "auth.sasToken", env: envSasToken, secret: true},
+	{flag: "accountKey", key: "auth.accountKey", env: envAccountKey, secret: true},
+	{flag: "clientSecret", key: "auth.clientSecret", env: envClientSecret, secret: true},
+}
+
+// commandLine holds the flags given explicitly on the command line
+var commandLine = make(map[string]bool)
+
+// configure parses args into the flags of f and layers the configuration:
+// configuration file < environment < command line flags
+func configure(f *flag.FlagSet, args []string) error {
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	commandLine = make(map[string]bool)
+	f.Visit(func(fl *flag.Flag) { commandLine[fl.Name] = true })
+
+	if ConfigPath != "" {
+		values, err := readConfigFile(ConfigPath)
+		if err != nil {
+			return err
+		}
+		for _, o := range options {
+			if v, ok := values[o.key]; ok && !commandLine[o.flag] {
+				if err := f.Set(o.flag, v); err != nil {
+					return fmt.Errorf("%s: invalid value %q for %s: %v", ConfigPath, v, o.key, err)
+				}
+			}
+		}
+	}
+
+	for _, o := range options {
+		v := os.Getenv(o.env)
+		if o.env == "" || v == "" || commandLine[o.flag] || (o.secret && !secretFromEnvironment(o.flag)) {
+			continue
+		}
+		if err := f.Set(o.flag, v); err != nil {
+			return fmt.Errorf("invalid value for environment variable %s: %v", o.env, err)
+		}
+	}
+	return validateConfig()
+}
+
+// secretFromEnvironment tells whether the environment may supply the secret flag,
+// only the secret of the selected authentication type is taken from there
+func secretFromEnvironment(name string) bool {
+	switch name {
+	case "sasToken":
+		return SasTokenFile == "" && (authType() == authTypeSAS || AuthType == "" && AccountKey == "" && AccountKeyFile == "")
+	case "accountKey":
+		return AccountKeyFile == "" && SasTokenFile == "" && authType() == authTypeKey
+	case "clientSecret":
+		return ClientSecretFile == "" && ClientCertPath == "" && authType() == authTypeSPN
+	}
+	return false
+}
+
+// readConfigFile parses a YAML or JSON configuration file into option values keyed by their dotted path
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]configValue
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]string)
+	if err := flattenConfig(path, "", tree, values); err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]option)
+	for _, o := range options {
+		known[o.key] = o
+	}
+	hasSecret := false
+	for key := range values {
+		o, ok := known[key]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown option %s%s", path, key, suggestKey(key))
+		}
+		hasSecret = hasSecret || o.secret && values[key] != ""
+	}
+	if hasSecret {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSecretFileMode(path, fi); err != nil {
+			return nil, fmt.Errorf("configuration file holds secrets: %v", err)
+		}
+	}
+	return values, nil
+}
+
+// configValue is a node of a configuration file. Scalars keep the text they are written with, YAML
+// would read a mode such as 0640 as the decimal integer 416.
+type configValue struct {
+	scalar   *string
+	children map[string]configValue
+	list     bool
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (v *configValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&v.children); err == nil {
+		// Null values are empty maps and keep the defaults
+		return nil
+	}
+	var list []interface{}
+	if err := unmarshal(&list); err == nil {
+		v.list = true
+		return nil
+	}
+	var scalar string
+	if err := unmarshal(&scalar); err != nil {
+		return err
+	}
+	v.scalar = &scalar
+	return nil
+}
+
+// flattenConfig walks the parsed configuration and stores every scalar under its dotted path
+func flattenConfig(path string, prefix string, tree map[string]configValue, values map[string]string) error {
+	for k, v := range tree {
+		key := prefix + k
+		switch {
+		case v.list:
+			return fmt.Errorf("%s: option %s must not be a list", path, key)
+		case v.scalar != nil:
+			values[key] = *v.scalar
+		default:
+			if err := flattenConfig(path, key+".", v.children, values); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// suggestKey returns a hint naming the known option closest to an unknown key
+func suggestKey(key string) string {
+	best, bestDistance := "", 4
+	for _, o := range options {
+		if d := editDistance(strings.ToLower(key), strings.ToLower(o.key)); d < bestDistance {
+			best, bestDistance = o.key, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// validateConfig checks the effective configuration and reports every problem at once
+func validateConfig() error {
+	var problems []string
+	if MountPoint == "" && !PrintConfig {
+		problems = append(problems, "mountPath is required")
+	}
+	if AccountName == "" {
+		problems = append(problems, "accountName is required")
+	}
+	if ContainerName == "" {
+		problems = append(problems, "containerName is required")
+	}
+	switch authType() {
+	case authTypeKey, authTypeSAS, authTypeSPN, authTypeMSI, authTypeTokenFile:
+	default:
+		problems = append(problems, fmt.Sprintf("auth.type %q is not one of Key, SAS, SPN, MSI or TokenFile", AuthType))
+	}
+	for name, endpoint := range map[string]string{"auth.aadEndpoint": AADEndpoint, "auth.imdsEndpoint": IMDSEndpoint} {
+		if u, err := url.Parse(endpoint); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s %q is not a valid URL", name, endpoint))
+		}
+	}
+	switch strings.ToLower(HNS) {
+	case hnsAuto, hnsEnabled, hnsDisabled:
+	default:
+		problems = append(problems, fmt.Sprintf("hns %q is not one of auto, true or false", HNS))
+	}
+	if UID > 1<<32-1 || GID > 1<<32-1 {
+		problems = append(problems, "permissions.uid and permissions.gid must fit in 32 bits")
+	}
+	if BlockSize == 0 || BlockSize > uint64(azblob.BlockBlobMaxStageBlockBytes) {
+		problems = append(problems, fmt.Sprintf("uploads.blockSize must be between 1 and %d bytes", azblob.BlockBlobMaxStageBlockBytes))
+	}
+	if RenameParallelism == 0 {
+		problems = append(problems, "rename.parallelism must be at least 1")
+	}
+	switch strings.ToLower(RenameRecovery) {
+	case renameRecoveryRollback, renameRecoveryResume:
+	default:
+		problems = append(problems, fmt.Sprintf("rename.recovery %q is not one of rollback or resume", RenameRecovery))
+	}
+	for _, marker := range strings.Split(DirectoryMarkers, ",") {
+		switch strings.TrimSpace(marker) {
+		case "", markerMetadata, markerSlash, markerResourceType:
+		default:
+			problems = append(problems, fmt.Sprintf("directories.markers %q is not one of metadata, slash or resourceType", marker))
+		}
+	}
+	switch strings.ToLower(DeleteSnapshots) {
+	case deleteSnapshotsInclude, deleteSnapshotsFail:
+	default:
+		problems = append(problems, fmt.Sprintf("remove.snapshots %q is not one of include or fail", DeleteSnapshots))
+	}
+	if _, ok := parseAccessTier(UploadTier); !ok {
+		problems = append(problems, fmt.Sprintf("tiers.upload %q is not one of Hot, Cool or Archive", UploadTier))
+	}
+	if _, ok := parseRehydratePriority(RehydratePriority); !ok {
+		problems = append(problems, fmt.Sprintf("tiers.rehydratePriority %q is not one of Standard or High", RehydratePriority))
+	}
+	if AsOf != "" {
+		if _, err := time.Parse(time.RFC3339, AsOf); err != nil {
+			problems = append(problems, fmt.Sprintf("versions.asOf %q is not an RFC 3339 time such as 2006-01-02T15:04:05Z", AsOf))
+		}
+	}
+	if strings.Contains(SnapshotDir, "/") || SnapshotDir == "." || SnapshotDir == ".." {
+		problems = append(problems, fmt.Sprintf("snapshots.dir %q is not a file name", SnapshotDir))
+	}
+	if strings.Contains(TrashDir, "/") || TrashDir == "." || TrashDir == ".." {
+		problems = append(problems, fmt.Sprintf("trash.dir %q is not a file name", TrashDir))
+	}
+	if TrashRetention < 0 {
+		problems = append(problems, "trash.retention must not be negative")
+	}
+	if TmpPath != "" && CacheSizeMB == 0 {
+		problems = append(problems, "cache.sizeMB must not be 0 when cache.tmpPath is set")
+	}
+	if AttrTimeout < 0 || OperationTimeout < 0 || TransferTimeout < 0 {
+		problems = append(problems, "cache.attrTimeout, timeouts.operation and timeouts.transfer must not be negative")
+	}
+	if MaxTries == 0 || MaxTries > math.MaxInt32 {
+		problems = append(problems, "retry.maxTries must be at least 1")
+	}
+	if TryTimeout < time.Second {
+		// The pipeline counts the timeout of an attempt in whole seconds
+		problems = append(problems, "retry.tryTimeout must be at least 1s")
+	}
+	switch strings.ToLower(RetryPolicy) {
+	case retryPolicyExponential, retryPolicyFixed:
+	default:
+		problems = append(problems, fmt.Sprintf("retry.policy %q is not one of exponential or fixed", RetryPolicy))
+	}
+	if RetryDelay <= 0 || MaxRetryDelay < RetryDelay {
+		problems = append(problems, "retry.delay must be positive and not exceed retry.maxDelay")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// printConfig writes the effective configuration as YAML, with secrets redacted
+func printConfig(w io.Writer, f *flag.FlagSet) error {
+	root := yaml.MapSlice{}
+	for _, o := range options {
+		fl := f.Lookup(o.flag)
+		if fl == nil {
+			continue
+		}
+		var value interface{} = fl.Value.String()
+		if getter, ok := fl.Value.(flag.Getter); ok {
+			switch v := getter.Get().(type) {
+			case bool, uint, uint64:
+				value = v
+			}
+		}
+		if o.secret && fl.Value.String() != "" {
+			value = "REDACTED"
+		}
+		root = setConfigKey(root, strings.Split(o.key, "."), value)
+	}
+	data, err := yaml.Marshal(root)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// setConfigKey stores value under path in the ordered tree
+func setConfigKey(tree yaml.MapSlice, path []string, value interface{}) yaml.MapSlice {
+	for i := range tree {
+		if tree[i].Key == path[0] {
+			if len(path) > 1 {
+				tree[i].Value = setConfigKey(tree[i].Value.(yaml.MapSlice), path[1:], value)
+			}
+			return tree
+		}
+	}
+	if len(path) == 1 {
+		return append(tree, yaml.MapItem{Key: path[0], Value: value})
+	}
+	return append(tree, yaml.MapItem{Key: path[0], Value: setConfigKey(yaml.MapSlice{}, path[1:], value)})
+}
+
+// modeValue is a flag.Value holding file permissions written in octal
+type modeValue os.FileMode
+
+func (m *modeValue) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *modeValue) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0o777 {
+		return fmt.Errorf("%q is not an octal permission such as 0644", s)
+	}
+	*m = modeValue(v)
+	return nil
+}
+
+func (m *modeValue) Get() interface{} {
+	return os.FileMode(*m)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfigure runs configure on a fresh flag set and resets the configuration when the test ends
+func testConfigure(t *testing.T, args ...string) (*flag.FlagSet, error) {
+	t.Cleanup(func() { registerFlags(flag.NewFlagSet("reset", flag.ContinueOnError)) })
+	f := flag.NewFlagSet("blobfuse-go", flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	registerFlags(f)
+	return f, configure(f, args)
+}
+
+// writeConfig writes a configuration file with the given permissions
+func writeConfig(t *testing.T, name string, content string, perm os.FileMode) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, perm)
+	return path
+}
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key string, value string) {
+	saved, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, saved)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "blobfuse.yaml", `
+accountName: fromfile
+containerName: container
+mountPath: /mnt/file
+permissions:
+  fileMode: "0640"
+  uid: 1000
+cache:
+  attrTimeout: 30s
+`, 0o644)
+	setenv(t, "AZURE_STORAGE_ACCOUNT", "fromenv")
+
+	if _, err := testConfigure(t, "--config", path, "--mountPath", "/mnt/flag"); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if AccountName != "fromenv" {
+		t.Errorf("AccountName is %q, the environment must override the file", AccountName)
+	}
+	if MountPoint != "/mnt/flag" {
+		t.Errorf("MountPoint is %q, the flag must override the file", MountPoint)
+	}
+	if ContainerName != "container" || DefaultFileMode != 0o640 || UID != 1000 || AttrTimeout != 30*time.Second {
+		t.Errorf("file values not applied: container %q, mode %o, uid %d, attrTimeout %v", ContainerName, DefaultFileMode, UID, AttrTimeout)
+	}
+	if DefaultDirMode != defaultDirMode {
+		t.Errorf("DefaultDirMode is %o, want the default %o", DefaultDirMode, defaultDirMode)
+	}
+}
+
+func TestConfigUnquotedModes(t *testing.T) {
+	path := writeConfig(t, "blobfuse.yaml", `
+accountName: a
+containerName: c
+mountPath: /mnt
+permissions:
+  fileMode: 0640
+  dirMode: 750
+`, 0o644)
+	if _, err := testConfigure(t, "--config", path); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if DefaultFileMode != 0o640 || DefaultDirMode != 0o750 {
+		t.Errorf("modes are %o and %o, want 640 and 750", DefaultFileMode, DefaultDirMode)
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	path := writeConfig(t, "blobfuse.json", `{"accountName": "a", "containerName": "c", "mountPath": "/mnt", "auth": {"type": "MSI"}, "permissions": {"readOnly": true}}`, 0o644)
+	if _, err := testConfigure(t, "--config", path); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if authType() != authTypeMSI || !ReadOnly {
+		t.Errorf("authType %q, ReadOnly %v after JSON configuration", authType(), ReadOnly)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		perm    os.FileMode
+		want    string
+	}{
+		{"unknown", "accountName: a\ncontainerName: c\npermissions:\n  filemode: \"0600\"\n", 0o644, "did you mean permissions.fileMode"},
+		{"mode", "permissions:\n  fileMode: rwx\n", 0o644, "invalid value \"rwx\" for permissions.fileMode"},
+		{"timeout", "timeouts:\n  operation: soon\n", 0o644, "timeouts.operation"},
+		{"secret", "auth:\n  accountKey: c2VjcmV0\n", 0o644, "chmod 600"},
+		{"auth", "accountName: a\ncontainerName: c\nauth:\n  type: Password\n", 0o644, "auth.type \"Password\""},
+		{"required", "accountName: a\n", 0o644, "containerName is required"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "blobfuse.yaml", tc.content, tc.perm)
+			_, err := testConfigure(t, "--config", path, "--mountPath", "/mnt")
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("configure returned %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigSecretFromEnvironment(t *testing.T) {
+	setenv(t, envAccountKey, "a2V5LWZyb20tZW52")
+	if _, err := testConfigure(t, "--accountName", "a", "--containerName", "c", "--mountPath", "/mnt"); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if AccountKey != "a2V5LWZyb20tZW52" {
+		t.Errorf("AccountKey is %q, want the value of %s", AccountKey, envAccountKey)
+	}
+
+	// The account key of the environment must not leak into other authentication types
+	if _, err := testConfigure(t, "--accountName", "a", "--containerName", "c", "--mountPath", "/mnt", "--authType", "MSI"); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if AccountKey != "" {
+		t.Errorf("AccountKey is %q for MSI authentication", AccountKey)
+	}
+
+	// Nor be added to a SAS token read from a file, which is only loaded after the configuration
+	sasTokenFile := writeConfig(t, "sas", "sv=2020-08-04&sig=c2ln", 0o600)
+	if _, err := testConfigure(t, "--accountName", "a", "--containerName", "c", "--mountPath", "/mnt", "--sasTokenFile", sasTokenFile); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if AccountKey != "" {
+		t.Errorf("AccountKey is %q with --sasTokenFile", AccountKey)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	path := writeConfig(t, "blobfuse.yaml", "accountName: a\ncontainerName: c\nauth:\n  accountKey: c2VjcmV0\n", 0o600)
+	f, err := testConfigure(t, "--config", path, "--print-config", "--dirMode", "0750")
+	if err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := printConfig(&buf, f); err != nil {
+		t.Fatalf("printConfig: %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "c2VjcmV0") || !strings.Contains(out, "accountKey: REDACTED") {
+		t.Errorf("printConfig does not redact the account key:\n%s", out)
+	}
+	for _, want := range []string{"accountName: a", "dirMode: \"0750\"", "readOnly: false", "attrTimeout: 1m0s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("printConfig output lacks %q:\n%s", want, out)
+		}
+	}
+
+	// The printed configuration is a valid configuration file
+	printed := writeConfig(t, "printed.yaml", strings.Replace(out, "REDACTED", "c2VjcmV0", 1), 0o600)
+	if _, err := testConfigure(t, "--config", printed, "--mountPath", "/mnt"); err != nil {
+		t.Errorf("configure with printed configuration: %v", err)
+	}
+}
+
+func TestModeValue(t *testing.T) {
+	var m modeValue
+	for _, tc := range []struct {
+		in   string
+		want os.FileMode
+		ok   bool
+	}{
+		{"0644", 0o644, true},
+		{"755", 0o755, true},
+		{"1777", 0, false},
+		{"0999", 0, false},
+		{"17777", 0, false},
+		{"", 0, false},
+	} {
+		err := m.Set(tc.in)
+		if (err == nil) != tc.ok || (tc.ok && os.FileMode(m) != tc.want) {
+			t.Errorf("Set(%q) = %o, %v", tc.in, os.FileMode(m), err)
+		}
+	}
+}
@@ -1,50 +1,237 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
+// Polling of server-side copies
+var (
+	copyPollInterval    = 100 * time.Millisecond
+	copyMaxPollInterval = 5 * time.Second
+	copyAbortTimeout    = 30 * time.Second
+)
+
+// Values of RetryPolicy
+const (
+	retryPolicyExponential = "exponential"
+	retryPolicyFixed       = "fixed"
+)
+
+// Values of DeleteSnapshots
+const (
+	deleteSnapshotsInclude = "include"
+	deleteSnapshotsFail    = "fail"
+)
+
 var (
 	serviceURL   azblob.ServiceURL
 	ctx          context.Context
 	containerURL azblob.ContainerURL
+
+	// The Data Lake endpoint of the container, used when the account has a hierarchical namespace
+	hierarchicalNamespace bool
+	dataLakeURL           url.URL
+	blobPipeline          pipeline.Pipeline
+
+	// Whether the account keeps deleted blobs, from its delete retention policy
+	softDelete bool
 )
 
 // ValidateAccount verifies storage account credentials and returns a connection
 func ValidateAccount() (errno int) {
 
-	credential, err := azblob.NewSharedKeyCredential(AccountName, AccountKey)
+	credential, err := newCredential()
 	if err != nil {
 		log.Printf("%v", err)
-		log.Printf("Error in NewShared KEy")
+		log.Printf("Error in creating credential")
 		return 1
 	}
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", AccountName))
+	p := requestHeaderPipeline{azblob.NewPipeline(credential, azblob.PipelineOptions{Retry: retryOptions()})}
+	u, err := serviceEndpoint(Endpoint, AccountName, UseHTTP)
+	if err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	if authType() == authTypeSAS {
+		sas, err := parseSASToken(SasToken)
+		if err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+		readOnly, err := validateSAS(sas, time.Now())
+		if err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+		if readOnly && !ReadOnly {
+			log.Printf("SAS token does not grant write permission, mounting read-only")
+			ReadOnly = true
+		}
+		// The SAS is carried by every container and blob URL derived from the service URL
+		u.RawQuery = strings.TrimPrefix(strings.TrimSpace(SasToken), "?")
+	}
 	serviceURL = azblob.NewServiceURL(*u, p)
 
 	// Try to list the blobs to verify the connection and account
 	ctx = context.Background()
 	containerURL = serviceURL.NewContainerURL(ContainerName)
 	marker := (azblob.Marker{})
-	_, err = containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{})
+	listCtx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	_, err = containerURL.ListBlobsHierarchySegment(listCtx, marker, "/", azblob.ListBlobsSegmentOptions{})
 	if err != nil {
-		log.Printf("List me Error h")
-		log.Fatal(err)
+		log.Printf("Error in listing container %s: %v", ContainerName, err)
+		if serr, ok := err.(azblob.StorageError); ok && SasToken != "" && serr.Response() != nil &&
+			serr.Response().StatusCode == http.StatusForbidden {
+			log.Printf("SAS token was rejected by the storage account (%s), check that it has not expired or been revoked", serr.ServiceCode())
+		}
 		return 1
 	}
+
+	if detectHierarchicalNamespace(ctx, containerURL) {
+		dataLakeURL, err = dataLakeEndpoint(DfsEndpoint, containerURL)
+		if err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+		hierarchicalNamespace = true
+		blobPipeline = p
+		log.Printf("Account has a hierarchical namespace, using %s for directories", dataLakeURL.Host)
+	}
+	softDelete = detectSoftDelete(ctx, serviceURL)
 	return 0
 }
 
-// GetBlobItems return list of blobs in the storage account
-func GetBlobItems(prefix string) (blobItems []azblob.BlobItem) {
-	// log.Printf("Get Blob Items: %s", prefix)
+// detectSoftDelete tells whether the delete retention policy of the account is enabled, so that deleted
+// blobs can be listed and undeleted
+func detectSoftDelete(ctx context.Context, service azblob.ServiceURL) bool {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	props, err := service.GetProperties(ctx)
+	if err != nil {
+		log.Printf("Cannot read the delete retention policy of the account, assuming soft delete is off: %v", err)
+		return false
+	}
+	return props.DeleteRetentionPolicy != nil && props.DeleteRetentionPolicy.Enabled
+}
+
+// newStorage returns the Storage of the validated container, going through the Data Lake endpoint
+// for directories when the account has a hierarchical namespace
+func newStorage() Storage {
+	blobs := NewBlobStorage(containerURL)
+	blobs.softDelete = softDelete
+	if !hierarchicalNamespace {
+		return blobs
+	}
+	return NewDataLakeStorage(blobs, dataLakeURL, blobPipeline)
+}
+
+// serviceEndpoint returns the URL of the Blob service to connect with.
+// endpoint may be empty (public cloud), a host name (sovereign clouds, private endpoints)
+// or a full URL including the account in the path (Azurite and other emulators).
+func serviceEndpoint(endpoint string, accountName string, useHTTP bool) (*url.URL, error) {
+	scheme := "https"
+	if useHTTP {
+		scheme = "http"
+	}
+	if endpoint == "" {
+		return url.Parse(fmt.Sprintf("%s://%s.blob.core.windows.net", scheme, accountName))
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = scheme + "://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	switch {
+	case u.Host == "":
+		return nil, fmt.Errorf("invalid endpoint %q: missing host", endpoint)
+	case u.Scheme == "http" && !useHTTP:
+		return nil, fmt.Errorf("endpoint %q uses plain HTTP, pass --useHttp to allow it", endpoint)
+	case u.Scheme != "http" && u.Scheme != "https":
+		return nil, fmt.Errorf("invalid endpoint %q: unsupported scheme %s", endpoint, u.Scheme)
+	case u.RawQuery != "" || u.Fragment != "":
+		return nil, fmt.Errorf("invalid endpoint %q: query and fragment are not allowed", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// withTimeout bounds ctx by timeout, OperationTimeout for requests on metadata or TransferTimeout
+// for requests moving content. The context of a FUSE request is canceled when it is interrupted.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// retryOptions returns the retry policy of the pipeline from the configuration. Requests failing
+// with 500, 502 or 503, a network error or a try timeout are retried.
+func retryOptions() azblob.RetryOptions {
+	policy := azblob.RetryPolicyExponential
+	if strings.ToLower(RetryPolicy) == retryPolicyFixed {
+		policy = azblob.RetryPolicyFixed
+	}
+	return azblob.RetryOptions{
+		Policy:        policy,
+		MaxTries:      int32(MaxTries),
+		TryTimeout:    TryTimeout,
+		RetryDelay:    RetryDelay,
+		MaxRetryDelay: MaxRetryDelay,
+	}
+}
+
+// BlobStorage implements Storage on top of an azblob container
+type BlobStorage struct {
+	container  azblob.ContainerURL
+	softDelete bool // the account keeps deleted blobs
+}
+
+var _ TieredStorage = (*BlobStorage)(nil)
+var _ SnapshotStorage = (*BlobStorage)(nil)
+var _ VersionedStorage = (*BlobStorage)(nil)
+var _ TrashStorage = (*BlobStorage)(nil)
+
+// NewBlobStorage returns a Storage backed by the given container
+func NewBlobStorage(container azblob.ContainerURL) *BlobStorage {
+	return &BlobStorage{container: container}
+}
+
+// toBlobAttr converts the properties of a listed blob into a BlobAttr
+func toBlobAttr(blobInfo azblob.BlobItemInternal) BlobAttr {
+	attr := BlobAttr{
+		Name:         blobInfo.Name,
+		LastModified: blobInfo.Properties.LastModified,
+		ETag:         string(blobInfo.Properties.Etag),
+		Metadata:     blobInfo.Metadata,
+		Snapshot:     blobInfo.Snapshot,
+	}
+	if blobInfo.Properties.ContentLength != nil {
+		attr.Size = *blobInfo.Properties.ContentLength
+	}
+	if blobInfo.VersionID != nil {
+		attr.VersionID = *blobInfo.VersionID
+	}
+	if blobInfo.Deleted && blobInfo.Properties.DeletedTime != nil {
+		attr.DeletedTime = *blobInfo.Properties.DeletedTime
+	}
+	return attr
+}
+
+// List return list of blobs in the container directly under prefix, and the prefixes of the virtual directories below it
+func (s *BlobStorage) List(ctx context.Context, prefix string) (blobItems []BlobAttr, prefixes []string, err error) {
 	for marker := (azblob.Marker{}); marker.NotDone(); {
 		// Get a result segment starting with the blob indicated by the current Marker.
 		options := azblob.ListBlobsSegmentOptions{}
@@ -52,10 +239,12 @@ func GetBlobItems(prefix string) (blobItems []azblob.BlobItem) {
 		if prefix != "" {
 			options.Prefix = prefix
 		}
-		listBlob, err := containerURL.ListBlobsHierarchySegment(ctx, marker, "/", options)
+		// Each page is bounded, long listings are not cut short
+		pageCtx, cancel := withTimeout(ctx, OperationTimeout)
+		listBlob, err := s.container.ListBlobsHierarchySegment(pageCtx, marker, "/", options)
+		cancel()
 		if err != nil {
-			fmt.Printf("Error")
-			log.Fatal(err)
+			return nil, nil, err
 		}
 		// IMPORTANT: ListBlobs returns the start of the next segment; you MUST use this to get
 		// the next segment (after processing the current result segment).
@@ -63,47 +252,316 @@ func GetBlobItems(prefix string) (blobItems []azblob.BlobItem) {
 
 		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
 		for _, blobInfo := range listBlob.Segment.BlobItems {
-			namearray := strings.Split(blobInfo.Name, "/")
-			blobInfo.Name = namearray[len(namearray)-1]
-			// log.Printf(blobInfo.Name)
-			blobItems = append(blobItems, blobInfo)
+			blobItems = append(blobItems, toBlobAttr(blobInfo))
+		}
+		// Directories created by other tools only exist as the common prefix of their blobs
+		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
+			prefixes = append(prefixes, blobPrefix.Name)
+		}
+	}
+	return blobItems, prefixes, nil
+}
+
+// ListRecursive returns every blob in the container whose name starts with prefix
+func (s *BlobStorage) ListRecursive(ctx context.Context, prefix string) (blobItems []BlobAttr, err error) {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		options := azblob.ListBlobsSegmentOptions{Prefix: prefix}
+		options.Details.Metadata = true
+		pageCtx, cancel := withTimeout(ctx, OperationTimeout)
+		listBlob, err := s.container.ListBlobsFlatSegment(pageCtx, marker, options)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			blobItems = append(blobItems, toBlobAttr(blobInfo))
 		}
 	}
-	return blobItems
+	return blobItems, nil
 }
 
-// ReadBlobContents returns the byte array of the content of blob
-func ReadBlobContents(blobName string, blobsize uint64) []byte {
-	// log.Printf("RedBlobContent: %s", blobName)
-	blobURL := containerURL.NewBlobURL(blobName)
-	b := make([]byte, blobsize)
+// GetRange fills b with the content of the blob starting at offset
+func (s *BlobStorage) GetRange(ctx context.Context, name string, offset int64, b []byte) error {
+	return s.download(ctx, s.container.NewBlobURL(name), offset, b)
+}
+
+// download fills b with the content of blobURL starting at offset
+func (s *BlobStorage) download(ctx context.Context, blobURL azblob.BlobURL, offset int64, b []byte) error {
+	ctx, cancel := withTimeout(ctx, TransferTimeout)
+	defer cancel()
+	if len(b) == 0 {
+		return nil
+	}
 	o := azblob.DownloadFromBlobOptions{
 		Parallelism: 5,
 	}
-	err := azblob.DownloadBlobToBuffer(ctx, blobURL, 0, 0, b, o)
+	return azblob.DownloadBlobToBuffer(ctx, blobURL, offset, int64(len(b)), b, o)
+}
+
+// Put uploads data as the content of the block blob
+func (s *BlobStorage) Put(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	ctx, cancel := withTimeout(ctx, TransferTimeout)
+	defer cancel()
+	blobURL := s.container.NewBlockBlobURL(name)
+	o := azblob.UploadToBlockBlobOptions{
+		Metadata:       metadata,
+		BlobAccessTier: uploadTier(),
+		Parallelism:    5,
+	}
+	_, err := azblob.UploadBufferToBlockBlob(ctx, data, blobURL, o)
+	return err
+}
+
+// StageBlock uploads data as an uncommitted block of the block blob
+func (s *BlobStorage) StageBlock(ctx context.Context, name string, blockID string, data []byte) error {
+	ctx, cancel := withTimeout(ctx, TransferTimeout)
+	defer cancel()
+	blobURL := s.container.NewBlockBlobURL(name)
+	_, err := blobURL.StageBlock(ctx, blockID, bytes.NewReader(data), azblob.LeaseAccessConditions{}, nil, azblob.ClientProvidedKeyOptions{})
+	return err
+}
+
+// CommitBlocks commits the listed blocks as the content of the block blob
+func (s *BlobStorage) CommitBlocks(ctx context.Context, name string, blockIDs []string, metadata map[string]string) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	blobURL := s.container.NewBlockBlobURL(name)
+	_, err := blobURL.CommitBlockList(ctx, blockIDs, azblob.BlobHTTPHeaders{}, metadata, azblob.BlobAccessConditions{},
+		uploadTier(), nil, azblob.ClientProvidedKeyOptions{})
+	return err
+}
+
+// Delete removes the blob, its snapshots are deleted with it unless DeleteSnapshots is fail
+func (s *BlobStorage) Delete(ctx context.Context, name string) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	snapshots := azblob.DeleteSnapshotsOptionInclude
+	if strings.ToLower(DeleteSnapshots) == deleteSnapshotsFail {
+		// The service refuses to delete a blob which has snapshots
+		snapshots = azblob.DeleteSnapshotsOptionNone
+	}
+	blobURL := s.container.NewBlobURL(name)
+	_, err := blobURL.Delete(ctx, snapshots, azblob.BlobAccessConditions{})
+	return err
+}
+
+// Copy starts a server side copy of src to dst and waits for it to finish, polling with backoff.
+// A copy which fails or does not finish in time is aborted and its destination removed.
+func (s *BlobStorage) Copy(ctx context.Context, src string, dst string) error {
+	ctx, cancel := withTimeout(ctx, TransferTimeout)
+	defer cancel()
+	srcURL := s.container.NewBlobURL(src)
+	dstURL := s.container.NewBlobURL(dst)
+	resp, err := dstURL.StartCopyFromURL(ctx, srcURL.URL(), nil, azblob.ModifiedAccessConditions{},
+		azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil)
+	if err != nil {
+		return err
+	}
+	status, copyID := resp.CopyStatus(), resp.CopyID()
+	for wait := copyPollInterval; status == azblob.CopyStatusPending; {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(wait):
+			var props *azblob.BlobGetPropertiesResponse
+			if props, err = dstURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{}); err == nil {
+				status = props.CopyStatus()
+			}
+		}
+		if err != nil {
+			// Do not leave a copy running in the background, it would overwrite dst later
+			abortCtx, abortCancel := context.WithTimeout(context.Background(), copyAbortTimeout)
+			if _, abortErr := dstURL.AbortCopyFromURL(abortCtx, copyID, azblob.LeaseAccessConditions{}); abortErr != nil {
+				log.Printf("Error in aborting copy of %s to %s: %v", src, dst, abortErr)
+			}
+			abortCancel()
+			s.removeFailedCopy(dst)
+			return err
+		}
+		if wait *= 2; wait > copyMaxPollInterval {
+			wait = copyMaxPollInterval
+		}
+	}
+	if status != azblob.CopyStatusSuccess {
+		s.removeFailedCopy(dst)
+		return fmt.Errorf("copy of %s to %s finished with status %s", src, dst, status)
+	}
+	return nil
+}
+
+// removeFailedCopy deletes the empty blob left behind by a failed or aborted copy
+func (s *BlobStorage) removeFailedCopy(dst string) {
+	ctx, cancel := context.WithTimeout(context.Background(), copyAbortTimeout)
+	defer cancel()
+	if err := s.Delete(ctx, dst); err != nil {
+		log.Printf("Error in removing %s after failed copy: %v", dst, err)
+	}
+}
+
+// GetProperties returns the properties and metadata of the blob
+func (s *BlobStorage) GetProperties(ctx context.Context, name string) (BlobAttr, error) {
+	return s.properties(ctx, name, s.container.NewBlobURL(name))
+}
+
+// properties returns the properties and metadata of blobURL, the blob called name
+func (s *BlobStorage) properties(ctx context.Context, name string, blobURL azblob.BlobURL) (BlobAttr, error) {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
-		log.Fatal(err)
+		return BlobAttr{}, err
 	}
-	return b
+	return BlobAttr{
+		Name:         name,
+		Size:         props.ContentLength(),
+		LastModified: props.LastModified(),
+		ETag:         string(props.ETag()),
+		Metadata:     props.NewMetadata(),
+		ResourceType: props.Response().Header.Get("x-ms-resource-type"),
+		ContentType:  props.ContentType(),
+		ContentMD5:   props.ContentMD5(),
+		AccessTier:   props.AccessTier(),
+
+		ArchiveStatus:     props.ArchiveStatus(),
+		RehydratePriority: props.RehydratePriority(),
+	}, nil
 }
 
-// UploadBlobContents returns status
-func UploadBlobContents(blobName string, data []byte, isDir bool) int {
-	// log.Printf("UploadBlobContent: %s", blobName)
-	blobURL := containerURL.NewBlockBlobURL(blobName)
-	metadata := azblob.Metadata{}
-	if isDir {
-		metadata = azblob.Metadata{
-			"hdi_isFolder": "true",
+// SetMetadata replaces the metadata of the blob
+func (s *BlobStorage) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	blobURL := s.container.NewBlobURL(name)
+	_, err := blobURL.SetMetadata(ctx, metadata, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	return err
+}
+
+// ListSnapshots returns the snapshots of every blob under prefix, the service does not list snapshots
+// by hierarchy
+func (s *BlobStorage) ListSnapshots(ctx context.Context, prefix string) (snapshots []BlobAttr, err error) {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		options := azblob.ListBlobsSegmentOptions{Prefix: prefix}
+		options.Details.Metadata = true
+		options.Details.Snapshots = true
+		pageCtx, cancel := withTimeout(ctx, OperationTimeout)
+		listBlob, err := s.container.ListBlobsFlatSegment(pageCtx, marker, options)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			if blobInfo.Snapshot != "" {
+				snapshots = append(snapshots, toBlobAttr(blobInfo))
+			}
 		}
 	}
-	o := azblob.UploadToBlockBlobOptions{
-		Metadata:    metadata,
-		Parallelism: 5,
+	return snapshots, nil
+}
+
+// GetSnapshotRange fills b with the content of the snapshot of the blob starting at offset
+func (s *BlobStorage) GetSnapshotRange(ctx context.Context, name string, snapshot string, offset int64, b []byte) error {
+	return s.download(ctx, s.container.NewBlobURL(name).WithSnapshot(snapshot), offset, b)
+}
+
+// GetSnapshotProperties returns the properties and metadata of the snapshot of the blob
+func (s *BlobStorage) GetSnapshotProperties(ctx context.Context, name string, snapshot string) (BlobAttr, error) {
+	attr, err := s.properties(ctx, name, s.container.NewBlobURL(name).WithSnapshot(snapshot))
+	if err != nil {
+		return BlobAttr{}, err
 	}
-	_, err := azblob.UploadBufferToBlockBlob(ctx, data, blobURL, o)
+	attr.Snapshot = snapshot
+	return attr, nil
+}
+
+// ListVersions returns the versions of the blobs under prefix, directly under it unless recursive
+func (s *BlobStorage) ListVersions(ctx context.Context, prefix string, recursive bool) ([]BlobAttr, []string, error) {
+	details := azblob.BlobListingDetails{Metadata: true, Versions: true}
+	return s.listDetails(ctx, prefix, recursive, details, func(azblob.BlobItemInternal) bool { return true })
+}
+
+// ListDeleted returns the soft deleted blobs under prefix, directly under it unless recursive
+func (s *BlobStorage) ListDeleted(ctx context.Context, prefix string, recursive bool) ([]BlobAttr, []string, error) {
+	details := azblob.BlobListingDetails{Metadata: true, Deleted: true}
+	return s.listDetails(ctx, prefix, recursive, details, func(blobInfo azblob.BlobItemInternal) bool {
+		return blobInfo.Deleted && blobInfo.Snapshot == ""
+	})
+}
+
+// listDetails returns the blobs under prefix listed with details for which keep is true, directly
+// under prefix with the prefixes below it unless recursive
+func (s *BlobStorage) listDetails(ctx context.Context, prefix string, recursive bool, details azblob.BlobListingDetails,
+	keep func(azblob.BlobItemInternal) bool) (blobs []BlobAttr, prefixes []string, err error) {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		options := azblob.ListBlobsSegmentOptions{Prefix: prefix, Details: details}
+		pageCtx, cancel := withTimeout(ctx, OperationTimeout)
+		var blobItems []azblob.BlobItemInternal
+		if recursive {
+			var listBlob *azblob.ListBlobsFlatSegmentResponse
+			listBlob, err = s.container.ListBlobsFlatSegment(pageCtx, marker, options)
+			if err == nil {
+				marker, blobItems = listBlob.NextMarker, listBlob.Segment.BlobItems
+			}
+		} else {
+			var listBlob *azblob.ListBlobsHierarchySegmentResponse
+			listBlob, err = s.container.ListBlobsHierarchySegment(pageCtx, marker, "/", options)
+			if err == nil {
+				marker, blobItems = listBlob.NextMarker, listBlob.Segment.BlobItems
+				for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
+					prefixes = append(prefixes, blobPrefix.Name)
+				}
+			}
+		}
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, blobInfo := range blobItems {
+			if keep(blobInfo) {
+				blobs = append(blobs, toBlobAttr(blobInfo))
+			}
+		}
+	}
+	return blobs, prefixes, nil
+}
+
+// SoftDeleteEnabled tells whether the account keeps deleted blobs
+func (s *BlobStorage) SoftDeleteEnabled() bool {
+	return s.softDelete
+}
+
+// Undelete restores the soft deleted blob with its snapshots
+func (s *BlobStorage) Undelete(ctx context.Context, name string) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	_, err := s.container.NewBlobURL(name).Undelete(ctx)
+	return err
+}
+
+// GetVersionRange fills b with the content of the version of the blob starting at offset
+func (s *BlobStorage) GetVersionRange(ctx context.Context, name string, versionID string, offset int64, b []byte) error {
+	return s.download(ctx, s.container.NewBlobURL(name).WithVersionID(versionID), offset, b)
+}
+
+// GetVersionProperties returns the properties and metadata of the version of the blob
+func (s *BlobStorage) GetVersionProperties(ctx context.Context, name string, versionID string) (BlobAttr, error) {
+	attr, err := s.properties(ctx, name, s.container.NewBlobURL(name).WithVersionID(versionID))
 	if err != nil {
-		return 1
+		return BlobAttr{}, err
 	}
-	return 0
+	attr.VersionID = versionID
+	return attr, nil
+}
+
+// CreateSnapshot takes a snapshot of the blob with its current metadata
+func (s *BlobStorage) CreateSnapshot(ctx context.Context, name string) (string, error) {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	blobURL := s.container.NewBlobURL(name)
+	resp, err := blobURL.CreateSnapshot(ctx, nil, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return "", err
+	}
+	return resp.Snapshot(), nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestServiceEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint string
+		useHTTP  bool
+		want     string
+	}{
+		{"", false, "https://account.blob.core.windows.net"},
+		{"account.blob.core.chinacloudapi.cn", false, "https://account.blob.core.chinacloudapi.cn"},
+		{"https://account.privatelink.blob.core.windows.net/", false, "https://account.privatelink.blob.core.windows.net"},
+		{"http://127.0.0.1:10000/devstoreaccount1", true, "http://127.0.0.1:10000/devstoreaccount1"},
+		{"127.0.0.1:10000/devstoreaccount1", true, "http://127.0.0.1:10000/devstoreaccount1"},
+	} {
+		u, err := serviceEndpoint(tc.endpoint, "account", tc.useHTTP)
+		if err != nil {
+			t.Errorf("serviceEndpoint(%q): %v", tc.endpoint, err)
+			continue
+		}
+		if u.String() != tc.want {
+			t.Errorf("serviceEndpoint(%q) = %s, want %s", tc.endpoint, u, tc.want)
+		}
+	}
+
+	for _, endpoint := range []string{
+		"http://127.0.0.1:10000/devstoreaccount1", // plain HTTP without useHTTP
+		"ftp://account.blob.core.windows.net",
+		"https://",
+		"https://account.blob.core.windows.net?sv=2020",
+	} {
+		if _, err := serviceEndpoint(endpoint, "account", false); err == nil {
+			t.Errorf("serviceEndpoint(%q) succeeded, want error", endpoint)
+		}
+	}
+}
+
+// useFakeAccount points the account globals at fake and restores them, with the retry and timeout
+// options and the connection set up by ValidateAccount, when the test ends
+func useFakeAccount(t *testing.T, fake *fakeBlobService) {
+	accountName, accountKey, sasToken, containerName := AccountName, AccountKey, SasToken, ContainerName
+	endpoint, dfsEndpoint, useHTTP, hns := Endpoint, DfsEndpoint, UseHTTP, HNS
+	readOnly, authType := ReadOnly, AuthType
+	accountKeyFile, sasTokenFile, clientSecretFile := AccountKeyFile, SasTokenFile, ClientSecretFile
+	maxTries, tryTimeout, operationTimeout := MaxTries, TryTimeout, OperationTimeout
+	retryPolicy, retryDelay, maxRetryDelay := RetryPolicy, RetryDelay, MaxRetryDelay
+	savedService, savedCtx, savedContainer := serviceURL, ctx, containerURL
+	savedHNS, savedDataLake, savedPipeline, savedSoftDelete := hierarchicalNamespace, dataLakeURL, blobPipeline, softDelete
+	t.Cleanup(func() {
+		AccountName, AccountKey, SasToken, ContainerName = accountName, accountKey, sasToken, containerName
+		Endpoint, DfsEndpoint, UseHTTP, HNS = endpoint, dfsEndpoint, useHTTP, hns
+		ReadOnly, AuthType = readOnly, authType
+		AccountKeyFile, SasTokenFile, ClientSecretFile = accountKeyFile, sasTokenFile, clientSecretFile
+		MaxTries, TryTimeout, OperationTimeout = maxTries, tryTimeout, operationTimeout
+		RetryPolicy, RetryDelay, MaxRetryDelay = retryPolicy, retryDelay, maxRetryDelay
+		serviceURL, ctx, containerURL = savedService, savedCtx, savedContainer
+		hierarchicalNamespace, dataLakeURL, blobPipeline, softDelete = savedHNS, savedDataLake, savedPipeline, savedSoftDelete
+	})
+	AccountName = fakeAccount
+	AccountKey = base64.StdEncoding.EncodeToString([]byte("key"))
+	AccountKeyFile, SasTokenFile, ClientSecretFile = "", "", ""
+	SasToken = ""
+	AuthType = ""
+	ContainerName = fake.container
+	Endpoint = fake.server.URL + "/" + fakeAccount
+	DfsEndpoint = ""
+	UseHTTP = true
+	HNS = hnsAuto
+	ReadOnly = false
+	MaxTries = 1
+}
+
+func TestValidateAccountWithPathStyleEndpoint(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	useFakeAccount(t, fake)
+	if ret := ValidateAccount(); ret != 0 {
+		t.Fatalf("ValidateAccount returned %d", ret)
+	}
+	if got, want := containerURL.String(), fake.server.URL+"/"+fakeAccount+"/testcontainer"; got != want {
+		t.Errorf("container URL is %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// dataLakeVersion is the REST API version of the requests to the Data Lake endpoint
+const dataLakeVersion = "2019-12-12"
+
+// Values of HNS
+const (
+	hnsAuto     = "auto"
+	hnsEnabled  = "true"
+	hnsDisabled = "false"
+)
+
+// DataLakeStorage is the Storage of an account with a hierarchical namespace (ADLS Gen2). Content
+// goes through the Blob endpoint while directories are listed, created, renamed and deleted through
+// the Data Lake endpoint, where they exist on their own and a rename or delete is a single atomic
+// request. Listings carry the POSIX owner, group and permissions of every path.
+type DataLakeStorage struct {
+	*BlobStorage
+	filesystem url.URL // the container on the Data Lake endpoint
+	pipeline   pipeline.Pipeline
+}
+
+// NewDataLakeStorage returns a DataLakeStorage sending the Data Lake requests for the container
+// to filesystem through p
+func NewDataLakeStorage(blobs *BlobStorage, filesystem url.URL, p pipeline.Pipeline) *DataLakeStorage {
+	return &DataLakeStorage{BlobStorage: blobs, filesystem: filesystem, pipeline: p}
+}
+
+// dataLakeEndpoint returns the URL of the container on the Data Lake endpoint of the account. The host of
+// the Blob endpoint is translated unless endpoint, the Data Lake endpoint of the account, is given.
+func dataLakeEndpoint(endpoint string, container azblob.ContainerURL) (url.URL, error) {
+	blobURL := container.URL()
+	if endpoint != "" {
+		u, err := serviceEndpoint(endpoint, AccountName, UseHTTP)
+		if err != nil {
+			return url.URL{}, err
+		}
+		u.Path += "/" + ContainerName
+		u.RawQuery = blobURL.RawQuery // a SAS token
+		return *u, nil
+	}
+	if !strings.Contains(blobURL.Host, ".blob.") {
+		return url.URL{}, fmt.Errorf("cannot derive the Data Lake endpoint from %s, set dfsEndpoint", blobURL.Host)
+	}
+	u := blobURL
+	u.Host = strings.Replace(u.Host, ".blob.", ".dfs.", 1)
+	return u, nil
+}
+
+// dataLakeError is a failed request to the Data Lake endpoint. It implements azblob.StorageError,
+// so that it is retried and translated into an errno like the errors of the Blob endpoint.
+type dataLakeError struct {
+	response *http.Response
+	code     string
+	message  string
+}
+
+func (e *dataLakeError) Error() string {
+	return fmt.Sprintf("%s %s: %s %s %s", e.response.Request.Method, e.response.Request.URL.Path,
+		e.response.Status, e.code, e.message)
+}
+
+func (e *dataLakeError) Timeout() bool { return false }
+
+func (e *dataLakeError) Temporary() bool {
+	switch e.response.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+func (e *dataLakeError) Response() *http.Response { return e.response }
+
+func (e *dataLakeError) ServiceCode() azblob.ServiceCodeType { return azblob.ServiceCodeType(e.code) }
+
+// dataLakeResponder turns the error responses of the Data Lake endpoint into a dataLakeError
+var dataLakeResponder = pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+	return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		resp, err := next.Do(ctx, request)
+		if err != nil {
+			return resp, err
+		}
+		r := resp.Response()
+		if r.StatusCode >= 200 && r.StatusCode < 300 {
+			return resp, nil
+		}
+		defer r.Body.Close()
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&body)
+		code := r.Header.Get("x-ms-error-code")
+		if code == "" {
+			code = body.Error.Code
+		}
+		return resp, &dataLakeError{response: r, code: code, message: body.Error.Message}
+	}
+})
+
+// do sends a request for the path name of the file system, the empty name standing for the file system
+// itself and "/" for its root directory
+func (s *DataLakeStorage) do(ctx context.Context, method string, name string, query url.Values, header http.Header) (*http.Response, error) {
+	u := s.filesystem
+	if name != "" {
+		u.Path += "/" + strings.TrimPrefix(name, "/")
+	}
+	for key, values := range u.Query() {
+		// A SAS token carried by the endpoint
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	req, err := pipeline.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("x-ms-version", dataLakeVersion)
+	resp, err := s.pipeline.Do(ctx, dataLakeResponder, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Response(), nil
+}
+
+// dataLakePath is an entry of a List Paths response, numbers and booleans are sent as strings
+type dataLakePath struct {
+	Name          string      `json:"name"`
+	IsDirectory   jsonLiteral `json:"isDirectory"`
+	ContentLength jsonLiteral `json:"contentLength"`
+	LastModified  string      `json:"lastModified"`
+	ETag          string      `json:"etag"`
+	Owner         string      `json:"owner"`
+	Group         string      `json:"group"`
+	Permissions   string      `json:"permissions"`
+}
+
+// jsonLiteral is a JSON string, number or boolean kept as its text
+type jsonLiteral string
+
+func (l *jsonLiteral) UnmarshalJSON(b []byte) error {
+	if s, err := strconv.Unquote(string(b)); err == nil {
+		*l = jsonLiteral(s)
+		return nil
+	}
+	*l = jsonLiteral(b)
+	return nil
+}
+
+// List returns the files and directories directly under prefix. Directories are returned as
+// blobs of the directory resource type, there are no virtual directories. The service lists no
+// metadata, the attributes kept there are only read by GetProperties: with a hierarchical namespace
+// the POSIX permissions and owner of the path stand for them.
+func (s *DataLakeStorage) List(ctx context.Context, prefix string) (blobItems []BlobAttr, prefixes []string, err error) {
+	query := url.Values{"resource": {"filesystem"}, "recursive": {"false"}}
+	if prefix != "" {
+		query.Set("directory", strings.TrimSuffix(prefix, "/"))
+	}
+	for continuation := ""; ; {
+		if continuation != "" {
+			query.Set("continuation", continuation)
+		}
+		pageCtx, cancel := withTimeout(ctx, OperationTimeout)
+		resp, err := s.do(pageCtx, http.MethodGet, "", query, nil)
+		if err != nil {
+			cancel()
+			if isNotFound(err) {
+				// Like a prefix without blobs
+				return nil, nil, nil
+			}
+			return nil, nil, err
+		}
+		var page struct {
+			Paths []dataLakePath `json:"paths"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range page.Paths {
+			blobItems = append(blobItems, p.attr())
+		}
+		if continuation = resp.Header.Get("x-ms-continuation"); continuation == "" {
+			return blobItems, nil, nil
+		}
+	}
+}
+
+// attr returns the properties of a listed path
+func (p dataLakePath) attr() BlobAttr {
+	attr := BlobAttr{
+		Name:        p.Name,
+		ETag:        p.ETag,
+		Owner:       p.Owner,
+		Group:       p.Group,
+		Permissions: p.Permissions,
+	}
+	attr.Size, _ = strconv.ParseInt(string(p.ContentLength), 10, 64)
+	attr.LastModified, _ = time.Parse(http.TimeFormat, p.LastModified)
+	if p.IsDirectory == "true" {
+		attr.ResourceType = "directory"
+	}
+	return attr
+}
+
+// GetProperties returns the properties of the blob along with its owner, group, permissions and ACL
+func (s *DataLakeStorage) GetProperties(ctx context.Context, name string) (BlobAttr, error) {
+	attr, err := s.BlobStorage.GetProperties(ctx, name)
+	if err != nil {
+		return attr, err
+	}
+	ac, err := s.GetAccessControl(ctx, name)
+	if err != nil {
+		return BlobAttr{}, err
+	}
+	attr.Owner, attr.Group, attr.Permissions, attr.ACL = ac.Owner, ac.Group, ac.Permissions, ac.ACL
+	if ac.ResourceType != "" {
+		attr.ResourceType = ac.ResourceType
+	}
+	return attr, nil
+}
+
+// GetAccessControl returns the owner, group, permissions and ACL of the path name, the empty name
+// being the root directory
+func (s *DataLakeStorage) GetAccessControl(ctx context.Context, name string) (BlobAttr, error) {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	resp, err := s.do(ctx, http.MethodHead, "/"+name, url.Values{"action": {"getAccessControl"}}, nil)
+	if err != nil {
+		return BlobAttr{}, err
+	}
+	resp.Body.Close()
+	return BlobAttr{
+		Name:         name,
+		Owner:        resp.Header.Get("x-ms-owner"),
+		Group:        resp.Header.Get("x-ms-group"),
+		Permissions:  resp.Header.Get("x-ms-permissions"),
+		ACL:          resp.Header.Get("x-ms-acl"),
+		ResourceType: resp.Header.Get("x-ms-resource-type"),
+	}, nil
+}
+
+// SetAccessControl replaces the access and default ACL of the path name, the empty name being the root directory
+func (s *DataLakeStorage) SetAccessControl(ctx context.Context, name string, acl string) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	resp, err := s.do(ctx, http.MethodPatch, "/"+name, url.Values{"action": {"setAccessControl"}}, http.Header{"x-ms-acl": {acl}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// CreateDirectory creates the directory name with the permissions of mode, it fails when the path exists
+func (s *DataLakeStorage) CreateDirectory(ctx context.Context, name string, mode os.FileMode) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	header := http.Header{
+		"If-None-Match":    {"*"},
+		"x-ms-permissions": {fmt.Sprintf("%04o", mode.Perm())},
+		// The umask of the caller is already applied to mode, the service would apply 0027 otherwise
+		"x-ms-umask": {"0000"},
+	}
+	resp, err := s.do(ctx, http.MethodPut, name, url.Values{"resource": {"directory"}}, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename moves the file or directory src to dst atomically, replacing a file at dst
+func (s *DataLakeStorage) Rename(ctx context.Context, src string, dst string) error {
+	source := (&url.URL{Path: s.filesystem.Path + "/" + src}).EscapedPath()
+	return s.continued(ctx, http.MethodPut, dst, url.Values{"mode": {"legacy"}}, http.Header{"x-ms-rename-source": {source}})
+}
+
+// DeleteDirectory removes the empty directory name, the kernel removes the entries of a tree one by one
+func (s *DataLakeStorage) DeleteDirectory(ctx context.Context, name string) error {
+	return s.continued(ctx, http.MethodDelete, name, url.Values{"recursive": {"false"}}, nil)
+}
+
+// continued sends a request which the service may split, repeating it with the continuation token
+// of the previous response until it is complete
+func (s *DataLakeStorage) continued(ctx context.Context, method string, name string, query url.Values, header http.Header) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	for {
+		resp, err := s.do(ctx, method, name, query, header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		continuation := resp.Header.Get("x-ms-continuation")
+		if continuation == "" {
+			return nil
+		}
+		query.Set("continuation", continuation)
+	}
+}
+
+// detectHierarchicalNamespace tells whether the account of the container has a hierarchical namespace,
+// according to HNS or, when it is auto, to the account information
+func detectHierarchicalNamespace(ctx context.Context, container azblob.ContainerURL) bool {
+	switch strings.ToLower(HNS) {
+	case hnsEnabled:
+		return true
+	case hnsDisabled:
+		return false
+	}
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	info, err := container.GetAccountInfo(ctx)
+	if err != nil {
+		log.Printf("Cannot tell whether the account has a hierarchical namespace, assuming it has none: %v", err)
+		return false
+	}
+	return info.Response().Header.Get("x-ms-is-hns-enabled") == "true"
+}
+
+// parsePermissions translates permissions in the symbolic form of the Data Lake endpoint, such as
+// rwxr-x---+, into a file mode
+func parsePermissions(permissions string) (os.FileMode, bool) {
+	permissions = strings.TrimSuffix(permissions, "+") // an extended ACL is present
+	if len(permissions) != 9 {
+		return 0, false
+	}
+	var mode os.FileMode
+	for i, c := range permissions {
+		bit := os.FileMode(1) << uint(8-i)
+		switch {
+		case c == rune("rwxrwxrwx"[i]):
+			mode |= bit
+		case i == 8 && c == 't':
+			mode |= bit | os.ModeSticky
+		case i == 8 && c == 'T':
+			mode |= os.ModeSticky
+		case c != '-':
+			return 0, false
+		}
+	}
+	return mode, true
+}
+
+// posixAttr applies the owner, group and permissions of a path in a hierarchical namespace to attr.
+// Owners which are not numeric, such as Azure AD object ids, keep the configured uid and gid.
+func posixAttr(attr *fuse.Attr, blob BlobAttr) {
+	if mode, ok := parsePermissions(blob.Permissions); ok {
+		attr.Mode = attr.Mode&os.ModeType | mode
+	}
+	if uid, err := strconv.ParseUint(blob.Owner, 10, 32); err == nil {
+		attr.Uid = uint32(uid)
+	}
+	if gid, err := strconv.ParseUint(blob.Group, 10, 32); err == nil {
+		attr.Gid = uint32(gid)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// newDataLakeStorage returns a DataLakeStorage over a fake service with a hierarchical namespace
+func newDataLakeStorage(t *testing.T) (*fakeBlobService, *DataLakeStorage) {
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.hns = true
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1}})
+	u, _ := url.Parse(fake.server.URL + "/" + fakeAccount + "/" + fake.container)
+	return fake, NewDataLakeStorage(NewBlobStorage(azblob.NewContainerURL(*u, p)), *u, p)
+}
+
+func TestDataLakeDirectoriesAndPermissions(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newDataLakeStorage(t)
+	fake.addBlob("data/a.csv", []byte("a"), nil)
+	fake.blobs["data/a.csv"].owner, fake.blobs["data/a.csv"].permissions = "1001", "rwxr-x--t+"
+	filesys := NewFS(store)
+
+	if got := readDirNames(t, filesys.root); len(got) != 1 || got["data"] != fuse.DT_Dir {
+		t.Fatalf("root lists %v, want the directory data", got)
+	}
+	n, _ := filesys.root.Lookup(ctx, "data")
+	data := n.(*Dir)
+	if data.attr.Mode != os.ModeDir|0o750 {
+		t.Errorf("directory has mode %v, want drwxr-x---", data.attr.Mode)
+	}
+	readDirNames(t, data)
+	a, err := data.Lookup(ctx, "a.csv")
+	if err != nil {
+		t.Fatalf("Lookup a.csv: %v", err)
+	}
+	if attr := a.(*File).attr; attr.Mode != os.ModeSticky|0o751 || attr.Uid != 1001 || attr.Gid != uint32(GID) {
+		t.Errorf("file has mode %v, uid %d and gid %d", attr.Mode, attr.Uid, attr.Gid)
+	}
+
+	attr, err := store.GetProperties(ctx, "data/a.csv")
+	if err != nil || attr.Owner != "1001" || attr.ACL != "user::rwx,group::r-x,other::--t" {
+		t.Errorf("GetProperties returned %+v, %v", attr, err)
+	}
+
+	if _, err := data.Mkdir(ctx, &fuse.MkdirRequest{Name: "sub", Mode: os.ModeDir | 0o775, Umask: 0o022}); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if b := fake.blobs["data/sub"]; b == nil || !isFakeDirectory(b) || b.permissions != "rwxr-xr-x" {
+		t.Errorf("Mkdir created %+v, want a directory with rwxr-xr-x", b)
+	}
+	_, h, err := data.Create(ctx, &fuse.CreateRequest{Name: "private.csv", Mode: 0o666, Umask: 0o066}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	releaseFile(t, h.(*File))
+	if b := fake.blobs["data/private.csv"]; b == nil || b.permissions != "rw-------" {
+		t.Errorf("Create made %+v, want a file with rw-------", b)
+	}
+}
+
+func TestDataLakeRenameIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newDataLakeStorage(t)
+	putDataset(t, store)
+	etag := fake.blobs["data/sub/b.csv"].etag
+	filesys := NewFS(store)
+	journal := useJournal(t, filesys)
+	readDirNames(t, filesys.root)
+	n, _ := filesys.root.Lookup(ctx, "data")
+	readDirNames(t, n.(*Dir))
+
+	if err := filesys.root.Rename(ctx, &fuse.RenameRequest{OldName: "data", NewName: "moved"}, filesys.root); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if got, want := blobNames(t, store), "moved moved/a.csv moved/sub moved/sub/b.csv other.txt"; got != want {
+		t.Errorf("blobs after rename are %q, want %q", got, want)
+	}
+	if b := fake.blobs["moved/sub/b.csv"]; b == nil || b.etag != etag {
+		t.Errorf("renamed blob was copied instead of moved")
+	}
+	if left := journals(t, journal); len(left) != 0 {
+		t.Errorf("journals written for a hierarchical rename: %v", left)
+	}
+
+	// Files replace their destination
+	moved := n.(*Dir)
+	if err := moved.Rename(ctx, &fuse.RenameRequest{OldName: "a.csv", NewName: "other.txt"}, filesys.root); err != nil {
+		t.Fatalf("Rename of file: %v", err)
+	}
+	if got, want := blobNames(t, store), "moved moved/sub moved/sub/b.csv other.txt"; got != want {
+		t.Errorf("blobs after file rename are %q, want %q", got, want)
+	}
+	if data, _, _ := fake.blob("other.txt"); string(data) != "a" {
+		t.Errorf("replaced file holds %q", data)
+	}
+}
+
+// failingRename is a DataLakeStorage whose renames onto a path which does not exist fail
+type failingRename struct {
+	*DataLakeStorage
+}
+
+func (f *failingRename) Rename(ctx context.Context, src string, dst string) error {
+	if _, err := f.GetAccessControl(ctx, dst); isNotFound(err) {
+		return fuse.EIO
+	}
+	return f.DataLakeStorage.Rename(ctx, src, dst)
+}
+
+func TestDataLakeRenameOntoDirectory(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newDataLakeStorage(t)
+	putDataset(t, store)
+	store.CreateDirectory(ctx, "empty", 0o750)
+
+	err := renameHierarchical(ctx, store, "empty/", "data/")
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.ENOTEMPTY {
+		t.Errorf("rename onto a non-empty directory returned %v, want ENOTEMPTY", err)
+	}
+	if err := renameHierarchical(ctx, &failingRename{store}, "data/", "empty/"); err == nil {
+		t.Errorf("failing rename succeeded")
+	}
+	if b := fake.blobs["empty"]; b == nil || !isFakeDirectory(b) {
+		t.Errorf("directory replaced by a failed rename is gone")
+	}
+	if err := renameHierarchical(ctx, store, "data/", "empty/"); err != nil {
+		t.Fatalf("rename onto an empty directory: %v", err)
+	}
+	if got, want := blobNames(t, store), "empty empty/a.csv empty/sub empty/sub/b.csv other.txt"; got != want {
+		t.Errorf("blobs after rename are %q, want %q", got, want)
+	}
+}
+
+func TestDataLakeRemoveDirectory(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newDataLakeStorage(t)
+	putDataset(t, store)
+	store.CreateDirectory(ctx, "empty", 0o750)
+	filesys := NewFS(store)
+	readDirNames(t, filesys.root)
+
+	err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "data", Dir: true})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.ENOTEMPTY {
+		t.Errorf("Remove of non-empty directory returned %v, want ENOTEMPTY", err)
+	}
+	if err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "empty", Dir: true}); err != nil {
+		t.Errorf("Remove of empty directory: %v", err)
+	}
+	if err := store.DeleteDirectory(ctx, "data/sub"); err == nil {
+		t.Errorf("DeleteDirectory of non-empty directory succeeded")
+	}
+	if len(fake.blobs) != 5 || fake.blobs["empty"] != nil {
+		t.Errorf("blobs after deletes are %q", blobNames(t, store))
+	}
+}
+
+func TestDetectHierarchicalNamespace(t *testing.T) {
+	saved := HNS
+	defer func() { HNS = saved }()
+	fake := newFakeBlobService(t, "testcontainer")
+	for _, tc := range []struct {
+		hns      string
+		fakeHNS  bool
+		detected bool
+	}{
+		{hnsAuto, true, true},
+		{hnsAuto, false, false},
+		{hnsDisabled, true, false},
+		{hnsEnabled, false, true},
+	} {
+		HNS, fake.hns = tc.hns, tc.fakeHNS
+		if got := detectHierarchicalNamespace(context.Background(), fake.ContainerURL()); got != tc.detected {
+			t.Errorf("hns %s on account with hierarchical namespace %v detected %v", tc.hns, tc.fakeHNS, got)
+		}
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	for permissions, want := range map[string]os.FileMode{
+		"rwxr-x---":  0o750,
+		"rw-r--r--+": 0o644,
+		"rwxrwxrwt":  os.ModeSticky | 0o777,
+		"rwxrwxr-T":  os.ModeSticky | 0o774,
+	} {
+		if mode, ok := parsePermissions(permissions); !ok || mode != want {
+			t.Errorf("parsePermissions(%q) = %v, %v, want %v", permissions, mode, ok, want)
+		}
+	}
+	for _, permissions := range []string{"", "0750", "rwxr-x-w-x"} {
+		if _, ok := parsePermissions(permissions); ok {
+			t.Errorf("parsePermissions(%q) succeeded", permissions)
+		}
+	}
+}
+
+func TestDataLakeEndpoint(t *testing.T) {
+	u, _ := url.Parse("https://account.blob.core.windows.net/container?sv=2019-12-12&sig=x")
+	container := azblob.NewContainerURL(*u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	got, err := dataLakeEndpoint("", container)
+	if err != nil || got.String() != "https://account.dfs.core.windows.net/container?sv=2019-12-12&sig=x" {
+		t.Errorf("dataLakeEndpoint returned %v, %v", got.String(), err)
+	}
+
+	u, _ = url.Parse("http://127.0.0.1:10000/devstoreaccount1/container")
+	container = azblob.NewContainerURL(*u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	if _, err := dataLakeEndpoint("", container); err == nil {
+		t.Errorf("dataLakeEndpoint derived an endpoint from an emulator URL")
+	}
+}
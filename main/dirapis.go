@@ -1,8 +1,12 @@
 package main
 
 import (
+	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -18,6 +22,10 @@ type Dir struct {
 	fs     *FS
 	parent *Dir
 	nodes  map[string]fs.Node //Children
+	// snapshots is the SnapshotDir of the directory once looked up
+	snapshots *snapshotsDir
+	// trash is the root of the TrashDir of the root directory once looked up
+	trash *Dir
 }
 
 // Attr implements Node interface for directories
@@ -26,38 +34,90 @@ func (d *Dir) Attr(ctx context.Context, o *fuse.Attr) error {
 	d.RLock()
 	*o = d.attr
 	d.RUnlock()
+	o.Valid = AttrTimeout
 	return nil
 }
 
-// Lookup implements NodeStringLookuper interface of Node
+// Lookup implements NodeStringLookuper interface of Node, names which were not listed yet are looked up in the storage
 func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	// log.Printf("Lookup with caller: %s", d.path)
+	if n, ok := d.lookupSnapshots(name); ok {
+		return n, nil
+	}
+	if n, ok := d.lookupTrash(name); ok {
+		return n, nil
+	}
+	if d.path == "" && name+"/" == trashPrefix {
+		return nil, fuse.ENOENT
+	}
 	d.RLock()
 	n, exist := d.nodes[name]
 	d.RUnlock()
+	if exist {
+		return n, nil
+	}
 
-	if !exist {
-		return nil, fuse.ENOENT
+	n, err := d.findRemote(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if known, exists := d.nodes[name]; exists {
+		// Listed or created meanwhile
+		return known, nil
 	}
+	d.addNode(name, n)
 	return n, nil
 }
 
-// ReadDirAll implements
+// ReadDirAll implements HandleReadDirAller, the listing of the storage is merged into the known nodes
 func (d *Dir) ReadDirAll(ctx context.Context) (dirs []fuse.Dirent, err error) {
 	// log.Printf("ReadDirAll with caller: %s", d.path)
-	blobItems := GetBlobItems(d.path)
+	blobItems, prefixes, err := d.fs.store.List(ctx, d.path)
+	if err != nil {
+		log.Printf("Error in listing %s: %v", d.path, err)
+		return nil, toErrno(err)
+	}
+	d.Lock()
+	defer d.Unlock()
 	for _, blob := range blobItems {
-		if len(blob.Metadata) == 1 {
-			// Directory
-			dir := d.fs.NewDir(d.path+blob.Name+"/", 0o660, uint64(*blob.Properties.ContentLength), blob.Properties.LastModified)
-			// log.Printf("Updating in : %s", d.path)
-			d.nodes[blob.Name] = dir
+		if blob.Name == d.path {
+			// The marker of this directory, named with a trailing "/"
+			continue
 		}
-		if len(blob.Metadata) == 0 {
-			file := d.fs.NewFile(d.path+blob.Name, 0o770, uint64(*blob.Properties.ContentLength), blob.Properties.LastModified)
-			// log.Printf("Updating in : %s", d.path)
-			d.nodes[blob.Name] = file
+		name := toName(blob.Name)
+		if d.path == "" && name+"/" == trashPrefix {
+			continue
 		}
+		switch n := d.nodes[name].(type) {
+		case *Dir:
+			if isDirBlob(blob) {
+				continue
+			}
+		case *File:
+			if !isDirBlob(blob) {
+				n.refresh(blob)
+				continue
+			}
+		}
+		d.addNode(name, d.newNode(blob))
+	}
+	for _, prefix := range prefixes {
+		if prefix == trashPrefix {
+			// Removed files kept for TrashRetention are shown in TrashDir
+			continue
+		}
+		name := toName(strings.TrimSuffix(prefix, "/"))
+		switch d.nodes[name].(type) {
+		case *Dir:
+			// Merged with its marker blob
+			continue
+		case *File:
+			// The blobs below the prefix would be unreachable otherwise
+			log.Printf("Showing %s as a directory, it is also the name of a blob", prefix)
+		}
+		d.addNode(name, d.fs.NewDir(prefix, DefaultDirMode, 0, time.Now()))
 	}
 	for name, node := range d.nodes {
 		ent := fuse.Dirent{
@@ -76,6 +136,174 @@ func (d *Dir) ReadDirAll(ctx context.Context) (dirs []fuse.Dirent, err error) {
 	return dirs, nil
 }
 
+// Conventions of blobs standing for a directory, selected with DirectoryMarkers
+const (
+	markerMetadata     = "metadata"     // hdi_isFolder=true metadata, as written by Mkdir and by ADLS Gen2
+	markerSlash        = "slash"        // empty blob named like the directory with a trailing "/"
+	markerResourceType = "resourceType" // directory resource type reported with a hierarchical namespace
+)
+
+// directoryMarker tells whether the convention is enabled in DirectoryMarkers
+func directoryMarker(convention string) bool {
+	for _, marker := range strings.Split(DirectoryMarkers, ",") {
+		if strings.TrimSpace(marker) == convention {
+			return true
+		}
+	}
+	return false
+}
+
+// isDirBlob tells whether a blob is the marker of a directory, other blobs are files whatever their metadata
+func isDirBlob(blob BlobAttr) bool {
+	if directoryMarker(markerMetadata) {
+		for key, value := range blob.Metadata {
+			if strings.EqualFold(key, "hdi_isFolder") && strings.EqualFold(value, "true") {
+				return true
+			}
+		}
+	}
+	if directoryMarker(markerSlash) && strings.HasSuffix(blob.Name, "/") && blob.Size == 0 {
+		return true
+	}
+	if directoryMarker(markerResourceType) &&
+		(strings.EqualFold(blob.ResourceType, "directory") || strings.EqualFold(blob.ResourceType, "folder")) {
+		return true
+	}
+	return false
+}
+
+// isSlashMarker tells whether blob is the marker of the directory path named with a trailing "/"
+func isSlashMarker(blob BlobAttr, path string) bool {
+	return blob.Name == path && isDirBlob(blob)
+}
+
+// newNode returns the node of a blob listed in the directory, with the attributes persisted in its
+// metadata or, on accounts with a hierarchical namespace, the owner and permissions of the path
+func (d *Dir) newNode(blob BlobAttr) fs.Node {
+	name := toName(blob.Name)
+	if isDirBlob(blob) {
+		n := d.fs.NewDir(d.path+name+"/", DefaultDirMode, uint64(blob.Size), blob.LastModified)
+		metadataAttr(&n.attr, blob.Metadata)
+		posixAttr(&n.attr, blob)
+		if d.fs.readOnly {
+			n.attr.Mode &^= 0o222
+		}
+		return n
+	}
+	n := d.fs.NewFile(d.path+name, DefaultFileMode, uint64(blob.Size), blob.LastModified)
+	n.metadata = blob.Metadata
+	metadataAttr(&n.attr, blob.Metadata)
+	posixAttr(&n.attr, blob)
+	if d.fs.readOnly {
+		n.attr.Mode &^= 0o222
+	}
+	return n
+}
+
+// addNode adds or replaces the child called name, the lock must be held
+func (d *Dir) addNode(name string, n fs.Node) {
+	if _, exists := d.nodes[name]; !exists {
+		atomic.AddUint64(&d.fs.nodeCount, 1)
+	}
+	d.nodes[name] = n
+}
+
+// findRemote returns a new node for name when it exists in the storage, either as a blob or as the
+// prefix of other blobs. It returns ENOENT otherwise.
+func (d *Dir) findRemote(ctx context.Context, name string) (fs.Node, error) {
+	blob, err := d.fs.store.GetProperties(ctx, d.path+name)
+	if err == nil {
+		return d.newNode(blob), nil
+	}
+	if !isNotFound(err) {
+		log.Printf("Error in looking up %s: %v", d.path+name, err)
+		return nil, toErrno(err)
+	}
+	blobItems, prefixes, err := d.fs.store.List(ctx, d.path+name+"/")
+	if err != nil {
+		log.Printf("Error in listing %s: %v", d.path+name+"/", err)
+		return nil, toErrno(err)
+	}
+	if len(blobItems) == 0 && len(prefixes) == 0 {
+		return nil, fuse.ENOENT
+	}
+	return d.fs.NewDir(d.path+name+"/", DefaultDirMode, 0, time.Now()), nil
+}
+
+// Setattr implements NodeSetattrer for directories, the mode, owner and mtime are persisted in the
+// metadata of the directory marker, which is created for virtual directories
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if d.fs.readOnly {
+		return errReadOnly
+	}
+	d.Lock()
+	defer d.Unlock()
+	attr := d.attr
+	applySetattr(&attr, req)
+	if persistsAttr(req) && d.path != "" {
+		if err := d.persistAttr(ctx, attr, req); err != nil {
+			return err
+		}
+	}
+	d.attr = attr
+	resp.Attr = d.attr
+	return nil
+}
+
+// persistAttr records the attributes changed by req in the metadata of the directory marker, the lock must be held
+func (d *Dir) persistAttr(ctx context.Context, attr fuse.Attr, req *fuse.SetattrRequest) error {
+	if req.Valid.Mode() {
+		if err := d.fs.setModeACL(ctx, strings.TrimSuffix(d.path, "/"), attr.Mode); err != nil {
+			return err
+		}
+	}
+	err := d.updateMetadata(ctx, func(metadata map[string]string) error {
+		setMetadataAttr(metadata, attr, req)
+		return nil
+	})
+	if err == errShadowedDir {
+		// The attributes are kept in memory only
+		return nil
+	}
+	return err
+}
+
+// errShadowedDir is returned when the metadata of a directory cannot be kept because a blob which is
+// not a marker has its name
+var errShadowedDir = fuse.Errno(syscall.ENOTSUP)
+
+// updateMetadata changes the metadata of the directory marker with update, the marker of a virtual
+// directory is created. The lock must be held.
+func (d *Dir) updateMetadata(ctx context.Context, update func(metadata map[string]string) error) error {
+	name := strings.TrimSuffix(d.path, "/")
+	blob, err := d.fs.store.GetProperties(ctx, name)
+	exists := err == nil
+	metadata := map[string]string{"hdi_isFolder": "true"}
+	switch {
+	case exists && isDirBlob(blob):
+		metadata = copyMetadata(blob.Metadata)
+	case exists:
+		log.Printf("Not persisting metadata of %s, it is also the name of a blob", d.path)
+		return errShadowedDir
+	case !isNotFound(err):
+		log.Printf("Error in reading metadata of %s: %v", d.path, err)
+		return toErrno(err)
+	}
+	if err := update(metadata); err != nil {
+		return err
+	}
+	if exists {
+		err = d.fs.store.SetMetadata(ctx, name, metadata)
+	} else {
+		err = d.fs.store.Put(ctx, name, nil, metadata)
+	}
+	if err != nil {
+		log.Printf("Error in setting metadata of %s: %v", d.path, err)
+		return toErrno(err)
+	}
+	return nil
+}
+
 // Mkdir implements NodeMkdirer interface for Node
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
 	// log.Printf("Mkdir with caller: %s and param: %s", d.path, req.Name)
@@ -84,15 +312,30 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 	if _, exists := d.nodes[req.Name]; exists {
 		return nil, fuse.EEXIST
 	}
-	n := d.fs.NewDir(d.path+req.Name+"/", 0o775, 0, time.Now())
+	if n, err := d.findRemote(ctx, req.Name); err == nil {
+		// A blob or a virtual directory which was not listed yet
+		d.addNode(req.Name, n)
+		return nil, fuse.EEXIST
+	} else if err != fuse.ENOENT {
+		return nil, err
+	}
+	mode := req.Mode.Perm() &^ req.Umask
+	var err error
+	if hs, ok := d.fs.store.(HierarchicalStorage); ok {
+		err = hs.CreateDirectory(ctx, d.path+req.Name, mode)
+	} else {
+		// Upload an empty blob with this name
+		metadata := map[string]string{"hdi_isFolder": "true"}
+		setMetadataValue(metadata, metadataMode, "0"+strconv.FormatUint(uint64(mode), 8))
+		err = d.fs.store.Put(ctx, d.path+req.Name, nil, metadata)
+	}
+	if err != nil {
+		log.Printf("Error in creating directory %s: %v", d.path+req.Name, err)
+		return nil, toErrno(err)
+	}
+	n := d.fs.NewDir(d.path+req.Name+"/", mode, 0, time.Now())
 	d.nodes[req.Name] = n
 	atomic.AddUint64(&d.fs.nodeCount, 1)
-	// Upload an empty blob with this name
-	ret := UploadBlobContents(d.path+req.Name, []byte(""), true)
-	if ret != 0 {
-		// log.Printf("Error in Creating Empty Blob")
-		return nil, fuse.ENODATA
-	}
 	return n, nil
 }
 
@@ -104,24 +347,45 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	if _, exists := d.nodes[req.Name]; exists {
 		return nil, nil, fuse.EEXIST
 	}
-	n := d.fs.NewFile(d.path+req.Name, 0o666, 0, time.Now())
-	n.fs = d.fs
+	mode := req.Mode.Perm() &^ req.Umask
+	n := d.fs.NewFile(d.path+req.Name, mode, 0, time.Now())
+	n.metadata = map[string]string{metadataMode: "0" + strconv.FormatUint(uint64(mode), 8)}
+	// Upload an empty blob with this name
+	err := d.fs.store.Put(ctx, n.path, nil, n.metadata)
+	if err != nil {
+		log.Printf("Error in creating %s: %v", n.path, err)
+		return nil, nil, toErrno(err)
+	}
+	// With a hierarchical namespace the permissions of the path are shown rather than the metadata
+	if err := d.fs.setModeACL(ctx, n.path, mode); err != nil {
+		return nil, nil, err
+	}
+	// The node is returned as an open handle
+	n.opens = 1
 	d.nodes[req.Name] = n
 	atomic.AddUint64(&d.fs.nodeCount, 1)
 	resp.Attr = n.attr
-	// Upload an empty blob with this name
-	ret := UploadBlobContents(n.path, []byte(""), false)
-	if ret != 0 {
-		// log.Printf("Error in Creating Empty Blob")
-		return nil, nil, fuse.ENODATA
-	}
 	return n, n, nil
 }
 
-// Rename implements
+// Rename implements NodeRenamer, files are moved in the container with a server-side copy,
+// directories by moving every blob below them, unless the account has a hierarchical namespace
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
 	// log.Printf("Rename")
 	nd := newDir.(*Dir)
+	if d == nd && req.OldName == req.NewName {
+		return nil
+	}
+	if _, inTrash := d.fs.store.(*trashStorage); !inTrash {
+		// Views such as snapshots share the paths of the mount, moving across them would move live blobs.
+		// Files only leave the trash by being restored and enter it by being removed.
+		if nd.fs != d.fs {
+			return fuse.Errno(syscall.EXDEV)
+		}
+		if d.fs.readOnly {
+			return errReadOnly
+		}
+	}
 	if d.attr.Inode == nd.attr.Inode {
 		d.Lock()
 		defer d.Unlock()
@@ -137,14 +401,43 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 		defer d.Unlock()
 	}
 
-	if _, exists := d.nodes[req.OldName]; !exists {
+	n, exists := d.nodes[req.OldName]
+	if !exists {
 		return fuse.ENOENT
 	}
+	if ts, inTrash := d.fs.store.(*trashStorage); inTrash {
+		return d.restore(ctx, ts, n, req, nd)
+	}
+	switch n := n.(type) {
+	case *File:
+		if _, isDir := nd.nodes[req.NewName].(*Dir); isDir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if err := n.rename(ctx, nd.path+req.NewName); err != nil {
+			return err
+		}
+	case *Dir:
+		if _, isFile := nd.nodes[req.NewName].(*File); isFile {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		newPath := nd.path + req.NewName + "/"
+		if strings.HasPrefix(newPath, n.path) {
+			// A directory cannot be moved below itself
+			return fuse.Errno(syscall.EINVAL)
+		}
+		if err := n.flushAll(ctx); err != nil {
+			return err
+		}
+		if err := d.fs.renameDir(ctx, n.path, newPath); err != nil {
+			return err
+		}
+		n.setPath(newPath)
+	}
 
 	// Rename can be used as an atomic replace, override an existing file.
 	if old, exists := nd.nodes[req.NewName]; exists {
 		atomic.AddUint64(&d.fs.nodeCount, ^uint64(0)) // decrement by one
-		if oldFile, ok := old.(*File); !ok {
+		if oldFile, ok := old.(*File); ok {
 			atomic.AddInt64(&d.fs.size, -int64(oldFile.attr.Size))
 		}
 	}
@@ -154,19 +447,104 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 	return nil
 }
 
-// Remove implements
+// Remove implements NodeRemover, deleting the blob of a file or the marker blob of an empty directory.
+// Whether a directory is empty is decided by listing the storage, the nodes known locally may be stale,
+// or by the service with a hierarchical namespace.
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	// log.Printf("Remove")
 	d.Lock()
 	defer d.Unlock()
 
-	if n, exists := d.nodes[req.Name]; !exists {
+	n, exists := d.nodes[req.Name]
+	if !exists {
 		return fuse.ENOENT
-	} else if req.Dir && len(n.(*Dir).nodes) > 0 {
-		return fuse.ENODATA
+	}
+	switch n := n.(type) {
+	case *File:
+		if req.Dir {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		if err := n.remove(ctx); err != nil {
+			return err
+		}
+		atomic.AddInt64(&d.fs.size, -int64(n.attr.Size))
+	case *Dir:
+		if !req.Dir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if hs, ok := d.fs.store.(HierarchicalStorage); ok {
+			// The service refuses to delete a directory which is not empty
+			if err := hs.DeleteDirectory(ctx, strings.TrimSuffix(n.path, "/")); err != nil && !isNotFound(err) {
+				log.Printf("Error in deleting directory %s: %v", n.path, err)
+				return toErrno(err)
+			}
+			break
+		}
+		children, err := d.fs.store.ListRecursive(ctx, n.path)
+		if err != nil {
+			log.Printf("Error in listing %s: %v", n.path, err)
+			return toErrno(err)
+		}
+		// Directories without a marker blob only exist through their children
+		markers := []string{strings.TrimSuffix(n.path, "/")}
+		for _, child := range children {
+			if !isSlashMarker(child, n.path) {
+				return fuse.Errno(syscall.ENOTEMPTY)
+			}
+			markers = append(markers, child.Name)
+		}
+		for _, marker := range markers {
+			if err := d.fs.discard(ctx, marker); err != nil && !isNotFound(err) {
+				log.Printf("Error in deleting %s: %v", marker, err)
+				return toErrno(err)
+			}
+		}
 	}
 
 	delete(d.nodes, req.Name)
 	atomic.AddUint64(&d.fs.nodeCount, ^uint64(0)) // decrement by one
 	return nil
 }
+
+// flushAll uploads the pending writes of every file below the directory
+func (d *Dir) flushAll(ctx context.Context) error {
+	d.RLock()
+	defer d.RUnlock()
+	for _, node := range d.nodes {
+		switch n := node.(type) {
+		case *Dir:
+			if err := n.flushAll(ctx); err != nil {
+				return err
+			}
+		case *File:
+			n.Lock()
+			err := n.flush(ctx)
+			if err == nil && n.upload != nil {
+				// Later appends cannot reuse blocks committed under the old name
+				err = n.endUpload(ctx)
+			}
+			n.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setPath moves the directory and everything below it to path after their blobs were renamed
+func (d *Dir) setPath(path string) {
+	d.Lock()
+	defer d.Unlock()
+	d.path = path
+	for name, node := range d.nodes {
+		switch n := node.(type) {
+		case *Dir:
+			n.setPath(path + name + "/")
+		case *File:
+			n.Lock()
+			n.path = path + name
+			n.Unlock()
+		}
+	}
+}
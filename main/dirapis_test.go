@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// readDirNames returns the sorted names and types of the entries of d
+func readDirNames(t *testing.T, d *Dir) map[string]fuse.DirentType {
+	t.Helper()
+	dirents, err := d.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatalf("ReadDirAll of %q: %v", d.path, err)
+	}
+	entries := make(map[string]fuse.DirentType)
+	for _, ent := range dirents {
+		entries[ent.Name] = ent.Type
+	}
+	return entries
+}
+
+func TestReadDirAllListsFilesAndDirs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "file.txt", []byte("data"), nil)
+		store.Put(ctx, "dir", nil, map[string]string{"hdi_isFolder": "true"})
+		store.Put(ctx, "dir/inner.txt", []byte("inner"), nil)
+
+		filesys := NewFS(store)
+		entries := readDirNames(t, filesys.root)
+		if len(entries) != 2 || entries["file.txt"] != fuse.DT_File || entries["dir"] != fuse.DT_Dir {
+			t.Fatalf("root entries are %v", entries)
+		}
+
+		n, err := filesys.root.Lookup(ctx, "dir")
+		if err != nil {
+			t.Fatalf("Lookup dir: %v", err)
+		}
+		entries = readDirNames(t, n.(*Dir))
+		if len(entries) != 1 || entries["inner.txt"] != fuse.DT_File {
+			t.Errorf("dir entries are %v", entries)
+		}
+
+		if _, err := filesys.root.Lookup(ctx, "missing"); err != fuse.ENOENT {
+			t.Errorf("Lookup of missing entry returned %v, want ENOENT", err)
+		}
+	})
+}
+
+func TestMkdirCreatesMarkerBlob(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		filesys := NewFS(store)
+		if _, err := filesys.root.Mkdir(ctx, &fuse.MkdirRequest{Name: "photos", Mode: 0o755}); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		props, err := store.GetProperties(ctx, "photos")
+		if err != nil {
+			t.Fatalf("marker blob was not created: %v", err)
+		}
+		if mode, _ := metadataValue(props.Metadata, metadataMode); props.Size != 0 || len(props.Metadata) != 2 || mode != "0755" {
+			t.Errorf("marker blob has properties %+v", props)
+		}
+		if _, err := filesys.root.Mkdir(ctx, &fuse.MkdirRequest{Name: "photos"}); err != fuse.EEXIST {
+			t.Errorf("second Mkdir returned %v, want EEXIST", err)
+		}
+
+		// A fresh mount must see the directory
+		entries := readDirNames(t, NewFS(store).root)
+		if entries["photos"] != fuse.DT_Dir {
+			t.Errorf("remounted root entries are %v", entries)
+		}
+	})
+}
+
+func TestCreateUploadsEmptyBlob(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		filesys := NewFS(store)
+		resp := &fuse.CreateResponse{}
+		if _, _, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "empty.txt"}, resp); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		items, _, err := store.List(ctx, "")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		var names []string
+		for _, item := range items {
+			names = append(names, item.Name)
+		}
+		sort.Strings(names)
+		if len(names) != 1 || names[0] != "empty.txt" {
+			t.Errorf("container holds %v", names)
+		}
+		if _, _, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "empty.txt"}, resp); err != fuse.EEXIST {
+			t.Errorf("second Create returned %v, want EEXIST", err)
+		}
+	})
+}
+
+func TestRenameMovesBlob(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "report.txt", []byte("old"), nil)
+		store.Put(ctx, "report.txt.tmp", []byte("new"), nil)
+		store.Put(ctx, "archive", nil, map[string]string{"hdi_isFolder": "true"})
+
+		filesys := NewFS(store)
+		readDirNames(t, filesys.root)
+		// Editors save through a temporary file renamed over the original
+		if err := filesys.root.Rename(ctx, &fuse.RenameRequest{OldName: "report.txt.tmp", NewName: "report.txt"}, filesys.root); err != nil {
+			t.Fatalf("Rename: %v", err)
+		}
+		if _, err := store.GetProperties(ctx, "report.txt.tmp"); err == nil {
+			t.Errorf("source blob still exists after rename")
+		}
+		props, err := store.GetProperties(ctx, "report.txt")
+		if err != nil || props.Size != 3 {
+			t.Errorf("renamed blob has properties %+v, %v", props, err)
+		}
+
+		archive, err := filesys.root.Lookup(ctx, "archive")
+		if err != nil {
+			t.Fatalf("Lookup archive: %v", err)
+		}
+		if err := filesys.root.Rename(ctx, &fuse.RenameRequest{OldName: "report.txt", NewName: "report-1.txt"}, archive); err != nil {
+			t.Fatalf("Rename into directory: %v", err)
+		}
+		b := make([]byte, 3)
+		if err := store.GetRange(ctx, "archive/report-1.txt", 0, b); err != nil || string(b) != "new" {
+			t.Errorf("blob moved into directory is %q, %v", b, err)
+		}
+		if entries := readDirNames(t, archive.(*Dir)); entries["report-1.txt"] != fuse.DT_File {
+			t.Errorf("archive entries after rename are %v", entries)
+		}
+	})
+}
+
+func TestRenameFlushesPendingWrites(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		filesys := NewFS(store)
+		_, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "draft"}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		h.(*File).Write(ctx, &fuse.WriteRequest{Data: []byte("unsaved")}, &fuse.WriteResponse{})
+		if err := filesys.root.Rename(ctx, &fuse.RenameRequest{OldName: "draft", NewName: "final"}, filesys.root); err != nil {
+			t.Fatalf("Rename: %v", err)
+		}
+		b := make([]byte, 7)
+		if err := store.GetRange(ctx, "final", 0, b); err != nil || string(b) != "unsaved" {
+			t.Errorf("renamed blob is %q, %v", b, err)
+		}
+	})
+}
+
+func TestRenameFailedCopyKeepsSource(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.addBlob("keep.txt", []byte("data"), nil)
+	fake.copyFails = true
+	filesys := NewFS(NewBlobStorage(fake.ContainerURL()))
+	readDirNames(t, filesys.root)
+	if err := filesys.root.Rename(context.Background(), &fuse.RenameRequest{OldName: "keep.txt", NewName: "moved.txt"}, filesys.root); err == nil {
+		t.Fatalf("Rename succeeded although the copy failed")
+	}
+	if _, _, exists := fake.blob("keep.txt"); !exists {
+		t.Errorf("source blob was deleted")
+	}
+	if _, _, exists := fake.blob("moved.txt"); exists {
+		t.Errorf("destination of failed copy was left behind")
+	}
+	if _, err := filesys.root.Lookup(context.Background(), "keep.txt"); err != nil {
+		t.Errorf("Lookup of source after failed rename: %v", err)
+	}
+}
+
+func TestRemoveDeletesBlobs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		putDataset(t, store)
+		filesys := NewFS(store)
+		readDirNames(t, filesys.root)
+		n, _ := filesys.root.Lookup(ctx, "data")
+		data := n.(*Dir)
+		readDirNames(t, data)
+
+		// A blob written by someone else since the listing keeps the directory from being removed
+		store.Put(ctx, "data/sub/late.csv", []byte("late"), nil)
+		if err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "data", Dir: true}); err != fuse.Errno(syscall.ENOTEMPTY) {
+			t.Errorf("Remove of non-empty directory returned %v, want ENOTEMPTY", err)
+		}
+		sub, _ := data.Lookup(ctx, "sub")
+		if err := data.Remove(ctx, &fuse.RemoveRequest{Name: "sub", Dir: true}); err != fuse.Errno(syscall.ENOTEMPTY) {
+			t.Errorf("Remove of directory with unlisted blob returned %v, want ENOTEMPTY", err)
+		}
+		for _, name := range []string{"b.csv", "late.csv"} {
+			readDirNames(t, sub.(*Dir))
+			if err := sub.(*Dir).Remove(ctx, &fuse.RemoveRequest{Name: name}); err != nil {
+				t.Fatalf("Remove %s: %v", name, err)
+			}
+		}
+		if err := data.Remove(ctx, &fuse.RemoveRequest{Name: "sub", Dir: true}); err != nil {
+			t.Fatalf("Remove of empty directory: %v", err)
+		}
+		if got, want := blobNames(t, store), "data data/a.csv other.txt"; got != want {
+			t.Errorf("blobs after remove are %q, want %q", got, want)
+		}
+		if entries := readDirNames(t, data); len(entries) != 1 {
+			t.Errorf("removed entries came back: %v", entries)
+		}
+	})
+}
+
+func TestRemoveOpenFileIsNotUploadedAgain(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	filesys := NewFS(store)
+	n, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "tmp.txt"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f := h.(*File)
+	if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("scratch")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "tmp.txt"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	releaseFile(t, n.(*File))
+	if names := blobNames(t, store); names != "" {
+		t.Errorf("blobs after removing an open file: %q", names)
+	}
+	if err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "tmp.txt"}); err != fuse.ENOENT {
+		t.Errorf("second Remove returned %v, want ENOENT", err)
+	}
+}
+
+func TestVirtualDirectories(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		// Written by a tool which creates no marker blobs
+		store.Put(ctx, "logs/2020/01.log", []byte("jan"), nil)
+		store.Put(ctx, "logs/2020/02.log", []byte("feb"), nil)
+		store.Put(ctx, "marked", nil, map[string]string{"hdi_isFolder": "true"})
+		store.Put(ctx, "marked/x", []byte("x"), nil)
+		filesys := NewFS(store)
+
+		// Lookup works before the directory was listed
+		n, err := filesys.root.Lookup(ctx, "logs")
+		if err != nil {
+			t.Fatalf("Lookup of virtual directory: %v", err)
+		}
+		logs, ok := n.(*Dir)
+		if !ok {
+			t.Fatalf("virtual directory looked up as %T", n)
+		}
+		if entries := readDirNames(t, logs); len(entries) != 1 || entries["2020"] != fuse.DT_Dir {
+			t.Errorf("logs entries are %v", entries)
+		}
+		if _, err := filesys.root.Lookup(ctx, "missing"); err != fuse.ENOENT {
+			t.Errorf("Lookup of missing entry returned %v, want ENOENT", err)
+		}
+
+		entries := readDirNames(t, filesys.root)
+		if len(entries) != 2 || entries["logs"] != fuse.DT_Dir || entries["marked"] != fuse.DT_Dir {
+			t.Errorf("root entries are %v", entries)
+		}
+		if again, _ := filesys.root.Lookup(ctx, "logs"); again != n {
+			t.Errorf("listing replaced the node of the directory")
+		}
+		if _, err := logs.Mkdir(ctx, &fuse.MkdirRequest{Name: "2020"}); err != fuse.EEXIST {
+			t.Errorf("Mkdir of virtual directory returned %v, want EEXIST", err)
+		}
+
+		y, _ := logs.Lookup(ctx, "2020")
+		for _, name := range []string{"01.log", "02.log"} {
+			if _, err := y.(*Dir).Lookup(ctx, name); err != nil {
+				t.Fatalf("Lookup %s: %v", name, err)
+			}
+			if err := y.(*Dir).Remove(ctx, &fuse.RemoveRequest{Name: name}); err != nil {
+				t.Fatalf("Remove %s: %v", name, err)
+			}
+		}
+		if err := logs.Remove(ctx, &fuse.RemoveRequest{Name: "2020", Dir: true}); err != nil {
+			t.Errorf("Remove of virtual directory: %v", err)
+		}
+		if got, want := blobNames(t, store), "marked marked/x"; got != want {
+			t.Errorf("blobs are %q, want %q", got, want)
+		}
+	})
+}
+
+func TestIsDirBlob(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		blob    BlobAttr
+		markers string
+		want    bool
+	}{
+		{"marker", BlobAttr{Name: "d", Metadata: map[string]string{"hdi_isFolder": "true"}}, defaultDirectoryMarkers, true},
+		{"lower case marker", BlobAttr{Name: "d", Metadata: map[string]string{"hdi_isfolder": "True"}}, defaultDirectoryMarkers, true},
+		{"marker set to false", BlobAttr{Name: "d", Metadata: map[string]string{"hdi_isfolder": "false"}}, defaultDirectoryMarkers, false},
+		{"user metadata", BlobAttr{Name: "f", Metadata: map[string]string{"owner": "me"}}, defaultDirectoryMarkers, false},
+		{"two keys", BlobAttr{Name: "f", Metadata: map[string]string{"owner": "me", "team": "data"}}, defaultDirectoryMarkers, false},
+		{"trailing slash", BlobAttr{Name: "d/"}, defaultDirectoryMarkers, true},
+		{"trailing slash with content", BlobAttr{Name: "d/", Size: 1}, defaultDirectoryMarkers, false},
+		{"resource type", BlobAttr{Name: "d", ResourceType: "directory"}, defaultDirectoryMarkers, true},
+		{"folder resource type", BlobAttr{Name: "d", ResourceType: "Folder"}, defaultDirectoryMarkers, true},
+		{"file resource type", BlobAttr{Name: "f", ResourceType: "file"}, defaultDirectoryMarkers, false},
+		{"metadata disabled", BlobAttr{Name: "d", Metadata: map[string]string{"hdi_isFolder": "true"}}, markerSlash, false},
+		{"slash disabled", BlobAttr{Name: "d/"}, markerMetadata + "," + markerResourceType, false},
+	} {
+		saved := DirectoryMarkers
+		DirectoryMarkers = tc.markers
+		if got := isDirBlob(tc.blob); got != tc.want {
+			t.Errorf("%s: isDirBlob(%+v) = %v, want %v", tc.name, tc.blob, got, tc.want)
+		}
+		DirectoryMarkers = saved
+	}
+}
+
+func TestFilesWithMetadataStayFiles(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "one.txt", []byte("1"), map[string]string{"owner": "me"})
+		store.Put(ctx, "two.txt", []byte("2"), map[string]string{"owner": "me", "team": "data"})
+		store.Put(ctx, "hns", nil, map[string]string{"hdi_isfolder": "true"})
+		store.Put(ctx, "tool/", nil, nil)
+		filesys := NewFS(store)
+
+		entries := readDirNames(t, filesys.root)
+		want := map[string]fuse.DirentType{"one.txt": fuse.DT_File, "two.txt": fuse.DT_File, "hns": fuse.DT_Dir, "tool": fuse.DT_Dir}
+		if fmt.Sprint(entries) != fmt.Sprint(want) {
+			t.Errorf("root entries are %v, want %v", entries, want)
+		}
+		tool, _ := filesys.root.Lookup(ctx, "tool")
+		if entries := readDirNames(t, tool.(*Dir)); len(entries) != 0 {
+			t.Errorf("directory marked with a trailing slash lists %v", entries)
+		}
+		if err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "tool", Dir: true}); err != nil {
+			t.Errorf("Remove of directory marked with a trailing slash: %v", err)
+		}
+		if got, want := blobNames(t, store), "hns one.txt two.txt"; got != want {
+			t.Errorf("blobs are %q, want %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,1169 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// fakeAccount is the account name used in the path-style URLs served by fakeBlobService
+const fakeAccount = "devstoreaccount1"
+
+// fakeBlob is a committed blob inside fakeBlobService
+type fakeBlob struct {
+	data         []byte
+	metadata     map[string]string
+	lastModified time.Time
+	etag         string
+	leaseID      string
+	blocks       map[string][]byte // committed blocks by id, when created by Put Block List
+	copyID       string
+	copyStatus   string // pending, success, failed or aborted when created by Copy Blob
+	pendingPolls int    // Get Blob Properties requests until a pending copy completes
+	contentType  string
+	contentMD5   []byte // set by Put Blob
+
+	snapshot  string    // time of the snapshot, empty for the base blob
+	versionID string    // time of the version when the service has versioning
+	deleted   time.Time // when the blob was soft deleted
+
+	// Access tier, empty for the inferred Hot tier, and the rehydration of an archived blob
+	tier, archiveStatus, rehydratePriority string
+
+	// POSIX access control with a hierarchical namespace, acl is derived from permissions unless set
+	owner, group, permissions, acl string
+}
+
+// fakeBlobService is an in-process implementation of the subset of the Blob REST API
+// used by BlobStorage. It serves a single container using path-style URLs
+// (http://127.0.0.1:port/devstoreaccount1/container) so that tests need no network.
+type fakeBlobService struct {
+	sync.Mutex
+	container string
+	blobs     map[string]*fakeBlob
+	blocks    map[string]map[string][]byte // uncommitted blocks of each blob
+	snapshots map[string][]*fakeBlob       // snapshots of each blob, oldest first
+	etag      uint64
+	server    *httptest.Server
+
+	// versioning keeps previous versions of blobs, also those of deleted blobs, oldest first
+	versioning  bool
+	versions    map[string][]*fakeBlob
+	lastVersion string
+	// softDelete keeps deleted blobs until they are undeleted, oldest first
+	softDelete bool
+	deleted    map[string][]*fakeBlob
+
+	// sasSignature, when set, is the SAS signature every request must carry
+	sasSignature string
+
+	// copyPolls makes copies pending for that many Get Blob Properties requests, copyFails makes them fail
+	copyPolls int
+	copyFails bool
+
+	// failures makes every request for a blob fail with the given status and error code
+	failures map[string]fakeFailure
+
+	// hns gives the account a hierarchical namespace, served on the same URLs as the Blob service
+	hns bool
+	// root is the root directory of the hierarchical namespace
+	root fakeBlob
+}
+
+// fakeFailure is an error response injected into fakeBlobService
+type fakeFailure struct {
+	status int
+	code   string
+	times  int // number of requests failing, 0 for all
+}
+
+// newFakeBlobService starts a fake Blob service serving container, it is closed with the test
+func newFakeBlobService(t *testing.T, container string) *fakeBlobService {
+	f := &fakeBlobService{
+		container: container,
+		root:      fakeBlob{owner: "$superuser", group: "$superuser", permissions: "rwxr-x---"},
+		blobs:     make(map[string]*fakeBlob),
+		blocks:    make(map[string]map[string][]byte),
+		snapshots: make(map[string][]*fakeBlob),
+		versions:  make(map[string][]*fakeBlob),
+		deleted:   make(map[string][]*fakeBlob),
+	}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// ContainerURL returns an azblob container URL pointing at the fake service, without retries
+func (f *fakeBlobService) ContainerURL() azblob.ContainerURL {
+	return f.containerURL(azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1}})
+}
+
+// ServiceURL returns an azblob service URL pointing at the fake service, without retries
+func (f *fakeBlobService) ServiceURL() azblob.ServiceURL {
+	u, _ := url.Parse(fmt.Sprintf("%s/%s", f.server.URL, fakeAccount))
+	return azblob.NewServiceURL(*u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{Retry: azblob.RetryOptions{MaxTries: 1}}))
+}
+
+// containerURL returns an azblob container URL pointing at the fake service using a pipeline with options
+func (f *fakeBlobService) containerURL(options azblob.PipelineOptions) azblob.ContainerURL {
+	u, _ := url.Parse(fmt.Sprintf("%s/%s/%s", f.server.URL, fakeAccount, f.container))
+	return azblob.NewContainerURL(*u, requestHeaderPipeline{azblob.NewPipeline(azblob.NewAnonymousCredential(), options)})
+}
+
+// blob returns a copy of the committed content of the blob
+func (f *fakeBlobService) blob(name string) ([]byte, map[string]string, bool) {
+	f.Lock()
+	defer f.Unlock()
+	b, exists := f.blobs[name]
+	if !exists {
+		return nil, nil, false
+	}
+	return append([]byte(nil), b.data...), copyMetadata(b.metadata), true
+}
+
+// addBlob stores a blob directly, bypassing the REST API
+func (f *fakeBlobService) addBlob(name string, data []byte, metadata map[string]string) {
+	f.Lock()
+	defer f.Unlock()
+	f.commit(name, data, metadata)
+}
+
+// commit replaces the blob with name, the caller must hold the lock
+func (f *fakeBlobService) commit(name string, data []byte, metadata map[string]string) *fakeBlob {
+	f.etag++
+	b := &fakeBlob{
+		data:         data,
+		metadata:     metadata,
+		lastModified: time.Now().UTC().Truncate(time.Second),
+		etag:         fmt.Sprintf("\"0x%X\"", f.etag),
+	}
+	if old, exists := f.blobs[name]; exists {
+		b.leaseID = old.leaseID
+		b.owner, b.group, b.permissions, b.acl = old.owner, old.group, old.permissions, old.acl
+		f.keepVersion(name, old)
+	}
+	if f.versioning {
+		f.lastVersion = nextFakeTimestamp(f.lastVersion)
+		b.versionID = f.lastVersion
+	}
+	f.blobs[name] = b
+	delete(f.blocks, name)
+	if f.hns {
+		f.addToNamespace(name, b)
+	}
+	return b
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	q := r.URL.Query()
+	if strings.TrimSuffix(r.URL.Path, "/") == "/"+fakeAccount && q.Get("restype") == "service" &&
+		q.Get("comp") == "properties" && r.Method == http.MethodGet {
+		f.serviceProperties(w)
+		return
+	}
+	root := "/" + fakeAccount + "/" + f.container
+	if r.URL.Path != root && !strings.HasPrefix(r.URL.Path, root+"/") {
+		writeFakeError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, root), "/")
+	if f.sasSignature != "" && q.Get("sig") != f.sasSignature {
+		writeFakeError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	if f.hns && f.serveDataLake(w, r, name, q) {
+		return
+	}
+
+	if name == "" {
+		switch {
+		case q.Get("restype") == "account" && q.Get("comp") == "properties" && r.Method == http.MethodGet:
+			w.Header().Set("x-ms-sku-name", "Standard_LRS")
+			w.Header().Set("x-ms-account-kind", "StorageV2")
+			w.Header().Set("x-ms-is-hns-enabled", strconv.FormatBool(f.hns))
+			w.WriteHeader(http.StatusOK)
+		case q.Get("restype") == "container" && q.Get("comp") == "list" && r.Method == http.MethodGet:
+			f.listBlobs(w, q)
+		case q.Get("restype") == "container" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+			w.Header().Set("ETag", "\"0x1\"")
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeFakeError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+		}
+		return
+	}
+
+	if failure, failing := f.failures[name]; failing {
+		if failure.times--; failure.times == 0 {
+			delete(f.failures, name)
+		} else {
+			f.failures[name] = failure
+		}
+		writeFakeError(w, failure.status, failure.code)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && q.Get("comp") == "":
+		f.getBlob(w, r, name, true)
+	case r.Method == http.MethodHead:
+		f.getBlob(w, r, name, false)
+	case r.Method == http.MethodPut && q.Get("comp") == "lease":
+		f.lease(w, r, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		f.putBlock(w, r, name, q.Get("blockid"))
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		f.putBlockList(w, r, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "copy" && r.Header.Get("x-ms-copy-action") == "abort":
+		f.abortCopy(w, r, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "undelete":
+		f.undelete(w, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "snapshot":
+		f.createSnapshot(w, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "tier":
+		f.setTier(w, r, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "metadata":
+		f.setMetadata(w, r, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "" && r.Header.Get("x-ms-copy-source") != "":
+		f.copyBlob(w, r, name)
+	case r.Method == http.MethodPut && q.Get("comp") == "":
+		f.putBlob(w, r, name)
+	case r.Method == http.MethodDelete && q.Get("comp") == "":
+		f.deleteBlob(w, r, name)
+	default:
+		writeFakeError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+// createSnapshot takes a snapshot of the blob, named after the current time with the precision of the service
+func (f *fakeBlobService) createSnapshot(w http.ResponseWriter, name string) {
+	b, exists := f.blobs[name]
+	if !exists {
+		writeFakeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	last := ""
+	if taken := f.snapshots[name]; len(taken) > 0 {
+		last = taken[len(taken)-1].snapshot
+	}
+	s := *b
+	s.snapshot = nextFakeTimestamp(last)
+	s.leaseID = ""
+	f.snapshots[name] = append(f.snapshots[name], &s)
+	w.Header().Set("x-ms-snapshot", s.snapshot)
+	w.Header().Set("ETag", b.etag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// nextFakeTimestamp returns the current time with the precision of the service, after last if set
+func nextFakeTimestamp(last string) string {
+	at := time.Now().UTC()
+	if t, err := time.Parse(time.RFC3339Nano, last); err == nil && !at.After(t) {
+		at = t.Add(100 * time.Nanosecond)
+	}
+	return at.Format("2006-01-02T15:04:05.0000000Z")
+}
+
+// keepVersion keeps the blob replaced or deleted as a previous version, the caller must hold the lock
+func (f *fakeBlobService) keepVersion(name string, b *fakeBlob) {
+	if b.versionID != "" {
+		v := *b
+		v.leaseID = ""
+		f.versions[name] = append(f.versions[name], &v)
+	}
+}
+
+// version returns the current or a previous version of the blob
+func (f *fakeBlobService) version(name string, versionID string) (*fakeBlob, bool) {
+	if b, exists := f.blobs[name]; exists && b.versionID == versionID {
+		return b, true
+	}
+	for _, v := range f.versions[name] {
+		if v.versionID == versionID {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// snapshot returns the snapshot of the blob taken at the time snapshot
+func (f *fakeBlobService) snapshot(name string, snapshot string) (*fakeBlob, bool) {
+	for _, s := range f.snapshots[name] {
+		if s.snapshot == snapshot {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// setTier moves the blob to another tier, an archived blob stays archived until rehydrate is called
+func (f *fakeBlobService) setTier(w http.ResponseWriter, r *http.Request, name string) {
+	b, exists := f.blobs[name]
+	if !exists {
+		writeFakeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	tier, priority := r.Header.Get("x-ms-access-tier"), r.Header.Get("x-ms-rehydrate-priority")
+	switch {
+	case tier != "Hot" && tier != "Cool" && tier != "Archive":
+		writeFakeError(w, http.StatusBadRequest, "InvalidHeaderValue")
+	case b.tier != "Archive" && priority != "":
+		writeFakeError(w, http.StatusBadRequest, "InvalidHeaderValue")
+	case b.archiveStatus != "" && tier == "Archive":
+		writeFakeError(w, http.StatusConflict, "BlobBeingRehydrated")
+	case b.tier == "Archive" && tier != "Archive":
+		if priority == "" {
+			priority = "Standard"
+		}
+		b.archiveStatus, b.rehydratePriority = "rehydrate-pending-to-"+strings.ToLower(tier), priority
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		b.tier = tier
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// rehydrate completes the pending rehydration of the blob
+func (f *fakeBlobService) rehydrate(name string) {
+	f.Lock()
+	defer f.Unlock()
+	b := f.blobs[name]
+	tier := strings.TrimPrefix(b.archiveStatus, "rehydrate-pending-to-")
+	b.tier = strings.ToUpper(tier[:1]) + tier[1:]
+	b.archiveStatus, b.rehydratePriority = "", ""
+}
+
+// writeFakeError writes a Blob service error response with the given code
+func writeFakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// metadataFromHeaders extracts x-ms-meta-* headers, the keys are lower cased by net/http canonicalization
+func metadataFromHeaders(h http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range h {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-meta-") && len(v) > 0 {
+			metadata[strings.TrimPrefix(k, "x-ms-meta-")] = v[0]
+		}
+	}
+	return metadata
+}
+
+// checkLease verifies that a write to the blob carries the lease id if the blob is leased
+func checkLease(w http.ResponseWriter, r *http.Request, b *fakeBlob) bool {
+	leaseID := r.Header.Get("x-ms-lease-id")
+	switch {
+	case b == nil || b.leaseID == "":
+		if leaseID != "" {
+			writeFakeError(w, http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation")
+			return false
+		}
+	case leaseID == "":
+		writeFakeError(w, http.StatusPreconditionFailed, "LeaseIdMissing")
+		return false
+	case leaseID != b.leaseID:
+		writeFakeError(w, http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation")
+		return false
+	}
+	return true
+}
+
+func writeBlobHeaders(w http.ResponseWriter, b *fakeBlob) {
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("x-ms-blob-type", "BlockBlob")
+	if b.tier != "" {
+		w.Header().Set("x-ms-access-tier", b.tier)
+	} else {
+		w.Header().Set("x-ms-access-tier", "Hot")
+		w.Header().Set("x-ms-access-tier-inferred", "true")
+	}
+	if b.archiveStatus != "" {
+		w.Header().Set("x-ms-archive-status", b.archiveStatus)
+		w.Header().Set("x-ms-rehydrate-priority", b.rehydratePriority)
+	}
+	if b.contentType != "" {
+		w.Header().Set("Content-Type", b.contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if b.contentMD5 != nil {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(b.contentMD5))
+	}
+	if b.leaseID != "" {
+		w.Header().Set("x-ms-lease-state", "leased")
+		w.Header().Set("x-ms-lease-status", "locked")
+	} else {
+		w.Header().Set("x-ms-lease-state", "available")
+		w.Header().Set("x-ms-lease-status", "unlocked")
+	}
+	if b.copyStatus != "" {
+		w.Header().Set("x-ms-copy-id", b.copyID)
+		w.Header().Set("x-ms-copy-status", b.copyStatus)
+	}
+	for k, v := range b.metadata {
+		w.Header().Set("x-ms-meta-"+k, v)
+	}
+}
+
+// parseRange parses a "bytes=start-end" header value against a blob of size
+func parseRange(value string, size int64) (start int64, end int64, ok bool) {
+	spec := strings.TrimPrefix(value, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if parts[1] != "" {
+		if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func (f *fakeBlobService) getBlob(w http.ResponseWriter, r *http.Request, name string, withBody bool) {
+	b, exists := f.blobs[name]
+	if snapshot := r.URL.Query().Get("snapshot"); snapshot != "" {
+		b, exists = f.snapshot(name, snapshot)
+	}
+	if versionID := r.URL.Query().Get("versionid"); versionID != "" {
+		b, exists = f.version(name, versionID)
+	}
+	if !exists {
+		writeFakeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if b.tier == "Archive" && withBody {
+		writeFakeError(w, http.StatusConflict, "BlobArchived")
+		return
+	}
+	if b.copyStatus == "pending" && !withBody {
+		if b.pendingPolls--; b.pendingPolls <= 0 {
+			b.copyStatus = "success"
+			if f.copyFails {
+				b.copyStatus, b.data = "failed", nil
+			}
+		}
+	}
+	writeBlobHeaders(w, b)
+	size := int64(len(b.data))
+	rangeHeader := r.Header.Get("x-ms-range")
+	if rangeHeader == "" {
+		rangeHeader = r.Header.Get("Range")
+	}
+	if rangeHeader == "" || !withBody {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		if withBody {
+			w.Write(b.data)
+		}
+		return
+	}
+	start, end, ok := parseRange(rangeHeader, size)
+	if !ok {
+		writeFakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(b.data[start : end+1])
+}
+
+func (f *fakeBlobService) putBlob(w http.ResponseWriter, r *http.Request, name string) {
+	if !checkLease(w, r, f.blobs[name]) {
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+	b := f.commit(name, data, metadataFromHeaders(r.Header))
+	b.tier = r.Header.Get("x-ms-access-tier")
+	b.contentType = r.Header.Get("x-ms-blob-content-type")
+	sum := md5.Sum(data)
+	b.contentMD5 = sum[:]
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBlobService) putBlock(w http.ResponseWriter, r *http.Request, name string, blockID string) {
+	if blockID == "" {
+		writeFakeError(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+		return
+	}
+	if !checkLease(w, r, f.blobs[name]) {
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+	if f.blocks[name] == nil {
+		f.blocks[name] = make(map[string][]byte)
+	}
+	f.blocks[name][blockID] = data
+	w.WriteHeader(http.StatusCreated)
+}
+
+// fakeBlockList is the body of a Put Block List request
+type fakeBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Blocks  []struct {
+		XMLName xml.Name
+		ID      string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+func (f *fakeBlobService) putBlockList(w http.ResponseWriter, r *http.Request, name string) {
+	if !checkLease(w, r, f.blobs[name]) {
+		return
+	}
+	var list fakeBlockList
+	if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "InvalidXmlDocument")
+		return
+	}
+	var data []byte
+	committed := make(map[string][]byte, len(list.Blocks))
+	for _, block := range list.Blocks {
+		// Latest looks in the uncommitted blocks first, then in the committed ones
+		chunk, exists := f.blocks[name][block.ID]
+		if old := f.blobs[name]; !exists && old != nil && block.XMLName.Local != "Uncommitted" {
+			chunk, exists = old.blocks[block.ID]
+		}
+		if !exists {
+			writeFakeError(w, http.StatusBadRequest, "InvalidBlockList")
+			return
+		}
+		data = append(data, chunk...)
+		committed[block.ID] = chunk
+	}
+	b := f.commit(name, data, metadataFromHeaders(r.Header))
+	b.tier = r.Header.Get("x-ms-access-tier")
+	b.blocks = committed
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBlobService) setMetadata(w http.ResponseWriter, r *http.Request, name string) {
+	b, exists := f.blobs[name]
+	if !exists {
+		writeFakeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if !checkLease(w, r, b) {
+		return
+	}
+	f.etag++
+	b.metadata = metadataFromHeaders(r.Header)
+	b.etag = fmt.Sprintf("\"0x%X\"", f.etag)
+	w.Header().Set("ETag", b.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeBlobService) copyBlob(w http.ResponseWriter, r *http.Request, name string) {
+	src, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "InvalidHeaderValue")
+		return
+	}
+	srcName := strings.TrimPrefix(src.Path, "/"+fakeAccount+"/"+f.container+"/")
+	srcBlob, exists := f.blobs[srcName]
+	if !exists {
+		writeFakeError(w, http.StatusNotFound, "CannotVerifyCopySource")
+		return
+	}
+	if !checkLease(w, r, f.blobs[name]) {
+		return
+	}
+	metadata := metadataFromHeaders(r.Header)
+	if len(metadata) == 0 {
+		metadata = copyMetadata(srcBlob.metadata)
+	}
+	b := f.commit(name, append([]byte(nil), srcBlob.data...), metadata)
+	b.copyID, b.copyStatus = fmt.Sprintf("copy-%d", f.etag), "success"
+	if f.copyPolls > 0 {
+		b.copyStatus, b.pendingPolls = "pending", f.copyPolls
+	} else if f.copyFails {
+		b.copyStatus, b.data = "failed", nil
+	}
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.Header().Set("x-ms-copy-id", b.copyID)
+	w.Header().Set("x-ms-copy-status", b.copyStatus)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeBlobService) abortCopy(w http.ResponseWriter, r *http.Request, name string) {
+	b, exists := f.blobs[name]
+	if !exists || b.copyStatus != "pending" || r.URL.Query().Get("copyid") != b.copyID {
+		writeFakeError(w, http.StatusConflict, "NoPendingCopyOperation")
+		return
+	}
+	b.copyStatus, b.data = "aborted", nil
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeBlobService) deleteBlob(w http.ResponseWriter, r *http.Request, name string) {
+	b, exists := f.blobs[name]
+	if !exists {
+		writeFakeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	if !checkLease(w, r, b) {
+		return
+	}
+	if len(f.snapshots[name]) > 0 {
+		if r.Header.Get("x-ms-delete-snapshots") != "include" {
+			writeFakeError(w, http.StatusConflict, "SnapshotsPresent")
+			return
+		}
+		delete(f.snapshots, name)
+	}
+	f.keepVersion(name, b)
+	if f.softDelete {
+		d := *b
+		d.leaseID, d.deleted = "", time.Now().UTC().Truncate(time.Second)
+		f.deleted[name] = append(f.deleted[name], &d)
+	}
+	delete(f.blobs, name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// undelete restores the last soft deleted blob unless the blob exists
+func (f *fakeBlobService) undelete(w http.ResponseWriter, name string) {
+	if _, exists := f.blobs[name]; !exists {
+		if deleted := f.deleted[name]; len(deleted) > 0 {
+			b := deleted[len(deleted)-1]
+			b.deleted = time.Time{}
+			f.blobs[name] = b
+			f.deleted[name] = deleted[:len(deleted)-1]
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeBlobService) lease(w http.ResponseWriter, r *http.Request, name string) {
+	b, exists := f.blobs[name]
+	if !exists {
+		writeFakeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	leaseID := r.Header.Get("x-ms-lease-id")
+	switch r.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		proposed := r.Header.Get("x-ms-proposed-lease-id")
+		if proposed == "" {
+			proposed = fmt.Sprintf("00000000-0000-0000-0000-%012d", f.etag)
+		}
+		if b.leaseID != "" && b.leaseID != proposed {
+			writeFakeError(w, http.StatusConflict, "LeaseAlreadyPresent")
+			return
+		}
+		b.leaseID = proposed
+		w.Header().Set("x-ms-lease-id", proposed)
+		w.WriteHeader(http.StatusCreated)
+	case "renew", "release", "change":
+		if b.leaseID == "" || b.leaseID != leaseID {
+			writeFakeError(w, http.StatusConflict, "LeaseIdMismatchWithLeaseOperation")
+			return
+		}
+		switch r.Header.Get("x-ms-lease-action") {
+		case "release":
+			b.leaseID = ""
+		case "change":
+			b.leaseID = r.Header.Get("x-ms-proposed-lease-id")
+		}
+		w.Header().Set("x-ms-lease-id", b.leaseID)
+		w.WriteHeader(http.StatusOK)
+	case "break":
+		if b.leaseID == "" {
+			writeFakeError(w, http.StatusConflict, "LeaseNotPresentWithLeaseOperation")
+			return
+		}
+		b.leaseID = ""
+		w.Header().Set("x-ms-lease-time", "0")
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeFakeError(w, http.StatusBadRequest, "InvalidHeaderValue")
+	}
+}
+
+// fakeListResult is the body of a List Blobs response
+type fakeListResult struct {
+	XMLName       xml.Name         `xml:"EnumerationResults"`
+	ContainerName string           `xml:"ContainerName,attr"`
+	Prefix        string           `xml:"Prefix"`
+	Marker        string           `xml:"Marker"`
+	Delimiter     string           `xml:"Delimiter,omitempty"`
+	Blobs         []fakeListBlob   `xml:"Blobs>Blob"`
+	Prefixes      []fakeListPrefix `xml:"Blobs>BlobPrefix"`
+	NextMarker    string           `xml:"NextMarker"`
+}
+
+type fakeListBlob struct {
+	Name       string             `xml:"Name"`
+	Snapshot   string             `xml:"Snapshot,omitempty"`
+	VersionID  string             `xml:"VersionId,omitempty"`
+	Deleted    bool               `xml:"Deleted,omitempty"`
+	IsCurrent  bool               `xml:"IsCurrentVersion,omitempty"`
+	Properties fakeListProperties `xml:"Properties"`
+	Metadata   fakeListMetadata   `xml:"Metadata"`
+}
+
+type fakeListProperties struct {
+	LastModified  string `xml:"Last-Modified"`
+	Etag          string `xml:"Etag"`
+	ContentLength int64  `xml:"Content-Length"`
+	BlobType      string `xml:"BlobType"`
+	DeletedTime   string `xml:"DeletedTime,omitempty"`
+}
+
+type fakeListPrefix struct {
+	Name string `xml:"Name"`
+}
+
+// fakeListMetadata marshals a metadata map as one element per key
+type fakeListMetadata map[string]string
+
+func (m fakeListMetadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := e.EncodeElement(m[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+func (f *fakeBlobService) listBlobs(w http.ResponseWriter, q url.Values) {
+	prefix, delimiter, marker := q.Get("prefix"), q.Get("delimiter"), q.Get("marker")
+	maxResults := 5000
+	if v, err := strconv.Atoi(q.Get("maxresults")); err == nil && v > 0 {
+		maxResults = v
+	}
+	withMetadata := strings.Contains(q.Get("include"), "metadata")
+	withSnapshots := strings.Contains(q.Get("include"), "snapshots")
+	withVersions := strings.Contains(q.Get("include"), "versions")
+	withDeleted := strings.Contains(q.Get("include"), "deleted")
+
+	// Collect the blob names and prefixes in order, the marker is the first entry of the next page
+	entries := make(map[string]bool) // name -> is prefix
+	names := make([]string, 0, len(f.blobs))
+	for name := range f.blobs {
+		names = append(names, name)
+	}
+	if withVersions {
+		// Deleted blobs are listed as long as they have versions
+		for name := range f.versions {
+			if _, exists := f.blobs[name]; !exists {
+				names = append(names, name)
+			}
+		}
+	}
+	if withDeleted {
+		for name := range f.deleted {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				entries[name[:len(prefix)+i+len(delimiter)]] = true
+				continue
+			}
+		}
+		entries[name] = false
+	}
+	names = names[:0]
+	for name := range entries {
+		if name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := fakeListResult{
+		ContainerName: f.container,
+		Prefix:        prefix,
+		Marker:        marker,
+		Delimiter:     delimiter,
+	}
+	for i, name := range names {
+		if i == maxResults {
+			result.NextMarker = name
+			break
+		}
+		if entries[name] {
+			result.Prefixes = append(result.Prefixes, fakeListPrefix{Name: name})
+			continue
+		}
+		if withSnapshots {
+			for _, s := range f.snapshots[name] {
+				item := fakeListBlob{Name: name, Snapshot: s.snapshot, Properties: fakeListProperties{
+					LastModified:  s.lastModified.Format(http.TimeFormat),
+					Etag:          s.etag,
+					ContentLength: int64(len(s.data)),
+					BlobType:      "BlockBlob",
+				}}
+				if withMetadata {
+					item.Metadata = s.metadata
+				}
+				result.Blobs = append(result.Blobs, item)
+			}
+		}
+		if withVersions {
+			for _, v := range f.versions[name] {
+				item := fakeListBlob{Name: name, VersionID: v.versionID, Properties: fakeListProperties{
+					LastModified:  v.lastModified.Format(http.TimeFormat),
+					Etag:          v.etag,
+					ContentLength: int64(len(v.data)),
+					BlobType:      "BlockBlob",
+				}}
+				if withMetadata {
+					item.Metadata = v.metadata
+				}
+				result.Blobs = append(result.Blobs, item)
+			}
+		}
+		if withDeleted {
+			for _, d := range f.deleted[name] {
+				item := fakeListBlob{Name: name, Deleted: true, Properties: fakeListProperties{
+					LastModified:  d.lastModified.Format(http.TimeFormat),
+					Etag:          d.etag,
+					ContentLength: int64(len(d.data)),
+					BlobType:      "BlockBlob",
+					DeletedTime:   d.deleted.Format(http.TimeFormat),
+				}}
+				if withMetadata {
+					item.Metadata = d.metadata
+				}
+				result.Blobs = append(result.Blobs, item)
+			}
+		}
+		b, exists := f.blobs[name]
+		if !exists {
+			continue
+		}
+		item := fakeListBlob{
+			Name: name,
+			Properties: fakeListProperties{
+				LastModified:  b.lastModified.Format(http.TimeFormat),
+				Etag:          b.etag,
+				ContentLength: int64(len(b.data)),
+				BlobType:      "BlockBlob",
+			},
+		}
+		if withVersions {
+			item.VersionID, item.IsCurrent = b.versionID, b.versionID != ""
+		}
+		if withMetadata {
+			item.Metadata = b.metadata
+		}
+		result.Blobs = append(result.Blobs, item)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(result)
+}
+
+// serviceProperties writes the properties of the account, only its delete retention policy is set
+func (f *fakeBlobService) serviceProperties(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(azblob.StorageServiceProperties{
+		DeleteRetentionPolicy: &azblob.RetentionPolicy{Enabled: f.softDelete},
+	})
+}
+
+// isFakeDirectory tells whether the blob is a directory of the hierarchical namespace
+func isFakeDirectory(b *fakeBlob) bool {
+	return b.metadata["hdi_isfolder"] == "true"
+}
+
+// addToNamespace gives a blob committed with a hierarchical namespace its default access control
+// and creates its missing parent directories, the caller must hold the lock
+func (f *fakeBlobService) addToNamespace(name string, b *fakeBlob) {
+	if b.permissions == "" {
+		b.owner, b.group, b.permissions = "$superuser", "$superuser", "rw-r-----"
+		if isFakeDirectory(b) {
+			b.permissions = "rwxr-x---"
+		}
+	}
+	if i := strings.LastIndex(name, "/"); i > 0 {
+		if _, exists := f.blobs[name[:i]]; !exists {
+			f.commit(name[:i], nil, map[string]string{"hdi_isfolder": "true"})
+		}
+	}
+}
+
+// path returns the file or directory name of the hierarchical namespace, the empty name being
+// the root directory, or nil when it does not exist
+func (f *fakeBlobService) path(name string) *fakeBlob {
+	if name == "" {
+		return &f.root
+	}
+	return f.blobs[name]
+}
+
+// setACL replaces the ACL of a path and updates its permissions like the service does, the group
+// permissions being those of the mask when there is one
+func (f *fakeBlobService) setACL(b *fakeBlob, acl string) {
+	b.acl = acl
+	perms := map[string]string{}
+	extended := false
+	for _, entry := range strings.Split(acl, ",") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] != "" {
+			extended = true
+			continue
+		}
+		perms[parts[0]] = parts[2]
+	}
+	group := perms["group"]
+	if mask, exists := perms["mask"]; exists {
+		group = mask
+	}
+	b.permissions = perms["user"] + group + perms["other"]
+	if extended {
+		b.permissions += "+"
+	}
+}
+
+// writeDataLakeError writes a Data Lake service error response with the given code
+func writeDataLakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%q,"message":%q}}`, code, code)
+}
+
+// serveDataLake serves the requests of the Data Lake service used by DataLakeStorage, it returns false
+// for the requests of the Blob service. The caller must hold the lock.
+func (f *fakeBlobService) serveDataLake(w http.ResponseWriter, r *http.Request, name string, q url.Values) bool {
+	switch {
+	case name == "" && r.Method == http.MethodGet && q.Get("resource") == "filesystem":
+		f.listPaths(w, q)
+	case r.Method == http.MethodPut && q.Get("resource") == "directory":
+		f.createDirectory(w, r, name)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-rename-source") != "":
+		f.renamePath(w, r, name)
+	case r.Method == http.MethodDelete && q.Get("recursive") != "":
+		f.deletePath(w, name, q.Get("recursive") == "true")
+	case r.Method == http.MethodHead && q.Get("action") == "getAccessControl":
+		b := f.path(name)
+		if b == nil {
+			w.WriteHeader(http.StatusNotFound)
+			break
+		}
+		w.Header().Set("x-ms-owner", b.owner)
+		w.Header().Set("x-ms-group", b.group)
+		w.Header().Set("x-ms-permissions", b.permissions)
+		acl := b.acl
+		if acl == "" {
+			acl = "user::" + b.permissions[:3] + ",group::" + b.permissions[3:6] + ",other::" + b.permissions[6:9]
+		}
+		w.Header().Set("x-ms-acl", acl)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPatch && q.Get("action") == "setAccessControl":
+		b := f.path(name)
+		if b == nil {
+			writeDataLakeError(w, http.StatusNotFound, "PathNotFound")
+			break
+		}
+		f.setACL(b, r.Header.Get("x-ms-acl"))
+		w.WriteHeader(http.StatusOK)
+	default:
+		return false
+	}
+	return true
+}
+
+// fakePath is an entry of a List Paths response
+type fakePath struct {
+	Name          string `json:"name"`
+	IsDirectory   string `json:"isDirectory,omitempty"`
+	ContentLength int    `json:"contentLength"`
+	LastModified  string `json:"lastModified"`
+	ETag          string `json:"etag"`
+	Owner         string `json:"owner"`
+	Group         string `json:"group"`
+	Permissions   string `json:"permissions"`
+}
+
+func (f *fakeBlobService) listPaths(w http.ResponseWriter, q url.Values) {
+	prefix := ""
+	if directory := q.Get("directory"); directory != "" {
+		if b, exists := f.blobs[directory]; !exists || !isFakeDirectory(b) {
+			writeDataLakeError(w, http.StatusNotFound, "PathNotFound")
+			return
+		}
+		prefix = directory + "/"
+	}
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var result struct {
+		Paths []fakePath `json:"paths"`
+	}
+	for _, name := range names {
+		b := f.blobs[name]
+		p := fakePath{
+			Name:          name,
+			ContentLength: len(b.data),
+			LastModified:  b.lastModified.Format(http.TimeFormat),
+			ETag:          b.etag,
+			Owner:         b.owner,
+			Group:         b.group,
+			Permissions:   b.permissions,
+		}
+		if isFakeDirectory(b) {
+			p.IsDirectory = "true"
+		}
+		result.Paths = append(result.Paths, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeBlobService) createDirectory(w http.ResponseWriter, r *http.Request, name string) {
+	if _, exists := f.blobs[name]; exists && r.Header.Get("If-None-Match") == "*" {
+		writeDataLakeError(w, http.StatusConflict, "PathAlreadyExists")
+		return
+	}
+	b := f.commit(name, nil, map[string]string{"hdi_isfolder": "true"})
+	if perm, err := strconv.ParseUint(r.Header.Get("x-ms-permissions"), 8, 32); err == nil {
+		umask, err := strconv.ParseUint(r.Header.Get("x-ms-umask"), 8, 32)
+		if err != nil {
+			umask = 0o027
+		}
+		b.permissions = fakePermissions(perm &^ umask)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// fakePermissions returns the symbolic form of the permission bits perm, as in rwxr-x---
+func fakePermissions(perm uint64) string {
+	s := []byte("rwxrwxrwx")
+	for i := range s {
+		if perm&(1<<uint(8-i)) == 0 {
+			s[i] = '-'
+		}
+	}
+	return string(s)
+}
+
+// renamePath moves a file or a directory with everything below it, the blobs keep their ETag
+func (f *fakeBlobService) renamePath(w http.ResponseWriter, r *http.Request, name string) {
+	source, err := url.PathUnescape(r.Header.Get("x-ms-rename-source"))
+	if err != nil {
+		writeDataLakeError(w, http.StatusBadRequest, "InvalidSourceUri")
+		return
+	}
+	source = strings.TrimPrefix(source, "/"+fakeAccount+"/"+f.container+"/")
+	src, exists := f.blobs[source]
+	if !exists {
+		writeDataLakeError(w, http.StatusNotFound, "SourcePathNotFound")
+		return
+	}
+	if i := strings.LastIndex(name, "/"); i > 0 {
+		if parent, exists := f.blobs[name[:i]]; !exists || !isFakeDirectory(parent) {
+			writeDataLakeError(w, http.StatusNotFound, "RenameDestinationParentPathNotFound")
+			return
+		}
+	}
+	if dst, exists := f.blobs[name]; exists && (isFakeDirectory(dst) || isFakeDirectory(src)) {
+		writeDataLakeError(w, http.StatusConflict, "PathAlreadyExists")
+		return
+	}
+	moved := make(map[string]*fakeBlob)
+	for old, b := range f.blobs {
+		if old == source || strings.HasPrefix(old, source+"/") {
+			moved[name+strings.TrimPrefix(old, source)] = b
+			delete(f.blobs, old)
+		}
+	}
+	for name, b := range moved {
+		f.blobs[name] = b
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBlobService) deletePath(w http.ResponseWriter, name string, recursive bool) {
+	if _, exists := f.blobs[name]; !exists {
+		writeDataLakeError(w, http.StatusNotFound, "PathNotFound")
+		return
+	}
+	var below []string
+	for child := range f.blobs {
+		if strings.HasPrefix(child, name+"/") {
+			below = append(below, child)
+		}
+	}
+	if len(below) > 0 && !recursive {
+		writeDataLakeError(w, http.StatusConflict, "DirectoryNotEmpty")
+		return
+	}
+	delete(f.blobs, name)
+	for _, child := range below {
+		delete(f.blobs, child)
+	}
+	w.WriteHeader(http.StatusOK)
+}
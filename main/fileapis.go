@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,6 +19,18 @@ type File struct {
 	fs    *FS
 	data  []byte
 	isMod bool
+	// upload streams a file written sequentially from its start as blocks, it is nil otherwise
+	upload *blockUpload
+	// loaded is set once data holds the whole content, reads are served from the storage until then
+	loaded bool
+	// cached is the local copy of the blob in the file cache, if any
+	cached *cacheEntry
+	// opens counts the open handles, buffers are freed when the last one is released
+	opens int
+	// removed is set once the blob was deleted, writes through handles still open are not uploaded
+	removed bool
+	// metadata of the blob, uploaded with the content, nil until known
+	metadata map[string]string
 }
 
 // Attr implements Node interface for files
@@ -26,33 +39,190 @@ func (f *File) Attr(ctx context.Context, o *fuse.Attr) error {
 	f.RLock()
 	*o = f.attr
 	f.RUnlock()
+	o.Valid = AttrTimeout
 	return nil
 }
 
-// Open implements NodeOpener
+// Open implements NodeOpener, the content is not downloaded until it is read or modified
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	// log.Printf("Open with caller: %s", f.path)
-	ret := ReadBlobContents(f.path, f.attr.Size)
-	f.attr.Size = uint64(len(ret))
-	f.data = ret
-	f.attr.Mtime = time.Now()
-	f.attr.Atime = time.Now()
-	f.attr.Crtime = time.Now()
-	f.isMod = false
+	if f.fs.readOnly && !req.Flags.IsReadOnly() {
+		return nil, errReadOnly
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.opens++
+	if !f.isMod && f.upload == nil {
+		// Drop content loaded by an earlier handle so that reads see the current blob
+		f.data = make([]byte, 0)
+		f.loaded = false
+		if f.fs.cache != nil {
+			f.openCached(ctx)
+		} else {
+			f.revalidate(ctx)
+		}
+	}
 	return f, nil
 }
 
-// ReadAll implements HandleReadAller interface
-func (f *File) ReadAll(ctx context.Context) ([]byte, error) {
-	// log.Printf("ReadAll with caller: %s", f.path)
-	return f.data, nil
+// revalidate takes the properties of the blob, which may have been overwritten since it was listed,
+// so that reads are not cut at a stale size. The lock must be held.
+func (f *File) revalidate(ctx context.Context) {
+	blob, err := f.fs.store.GetProperties(ctx, f.path)
+	if err != nil {
+		if !isNotFound(err) {
+			log.Printf("Error in revalidating %s: %v", f.path, err)
+		}
+		return
+	}
+	f.setBlobAttr(blob)
 }
 
-// Write implements HandleWriter interface
+// Read implements HandleReader interface, reading only the requested range of the blob
+func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	// log.Printf("Read with caller: %s", f.path)
+	f.RLock()
+	if f.upload != nil && f.upload.uncommitted(req.Offset, int64(req.Size)) {
+		// Staged blocks cannot be read before they are committed, the rest of the upload is read
+		// from the committed blocks and the buffer
+		f.RUnlock()
+		f.Lock()
+		var err error
+		// A truncate or a remove may have dropped the upload meanwhile
+		if f.upload != nil && f.upload.uncommitted(req.Offset, int64(req.Size)) {
+			err = f.commitUpload(ctx)
+		}
+		f.Unlock()
+		if err != nil {
+			return err
+		}
+		f.RLock()
+	}
+	defer f.RUnlock()
+	size := int64(f.attr.Size)
+	if req.Offset >= size {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > size {
+		end = size
+	}
+	if f.loaded {
+		resp.Data = append(resp.Data[:0], f.data[req.Offset:end]...)
+		return nil
+	}
+	buf := resp.Data[:cap(resp.Data)]
+	if int64(len(buf)) < end-req.Offset {
+		buf = make([]byte, end-req.Offset)
+	}
+	buf = buf[:end-req.Offset]
+	var err error
+	if f.upload != nil {
+		err = f.readUpload(ctx, req.Offset, buf)
+	} else {
+		err = f.readRange(ctx, req.Offset, buf)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Data = buf
+	return nil
+}
+
+// readRange fills b with the content starting at offset, from the file cache when the blob is cached
+func (f *File) readRange(ctx context.Context, offset int64, b []byte) error {
+	if f.cached != nil {
+		if _, err := f.cached.file.ReadAt(b, offset); err != nil {
+			log.Printf("Error in reading cached copy of %s: %v", f.path, err)
+			return fuse.EIO
+		}
+		return nil
+	}
+	if err := f.fs.store.GetRange(ctx, f.path, offset, b); err != nil {
+		log.Printf("Error in reading %s at %d: %v", f.path, offset, err)
+		return toErrno(err)
+	}
+	return nil
+}
+
+// openCached attaches the cached copy of the current version of the blob, downloading it
+// when needed. Without it reads go to the storage. The lock must be held.
+func (f *File) openCached(ctx context.Context) {
+	attr, err := f.fs.store.GetProperties(ctx, f.path)
+	if err != nil {
+		log.Printf("Error in revalidating cached copy of %s: %v", f.path, err)
+		f.dropCached()
+		return
+	}
+	if isArchived(attr) {
+		// Reads fail until the blob is rehydrated
+		f.dropCached()
+		return
+	}
+	entry, err := f.fs.cache.acquire(ctx, f.fs.store, attr)
+	if err != nil || entry == f.cached {
+		if entry != nil {
+			// The file already holds this entry
+			f.fs.cache.release(entry)
+		}
+		return
+	}
+	f.dropCached()
+	f.cached = entry
+	atomic.AddInt64(&f.fs.size, attr.Size-int64(f.attr.Size))
+	f.attr.Size = uint64(attr.Size)
+}
+
+// dropCached detaches the cached copy of the blob, the lock must be held
+func (f *File) dropCached() {
+	if f.cached != nil {
+		f.fs.cache.release(f.cached)
+		f.cached = nil
+	}
+}
+
+// load downloads the whole content into data so that it can be modified, the lock must be held
+func (f *File) load(ctx context.Context) error {
+	if f.loaded {
+		return nil
+	}
+	data := make([]byte, f.attr.Size)
+	if err := f.readRange(ctx, 0, data); err != nil {
+		return err
+	}
+	f.data = data
+	f.loaded = true
+	return nil
+}
+
+// Write implements HandleWriter interface. Sequential writes from the start of an empty file are
+// streamed to the storage block by block, other writes modify the content in memory.
 func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 	// log.Printf("Write with caller: %s", f.path)
 	f.Lock()
 	defer f.Unlock()
+	if err := f.modified(ctx); err != nil {
+		return err
+	}
+	if f.upload == nil && req.Offset == 0 && f.attr.Size == 0 {
+		f.upload = newBlockUpload()
+	}
+	if f.upload != nil {
+		if uint64(req.Offset) == f.attr.Size {
+			if err := f.appendData(ctx, req.Data); err != nil {
+				return err
+			}
+			resp.Size = len(req.Data)
+			return nil
+		}
+		if err := f.endUpload(ctx); err != nil {
+			return err
+		}
+	}
+	if err := f.load(ctx); err != nil {
+		return err
+	}
 	l := len(req.Data)
 	end := int(req.Offset) + l
 	if end > len(f.data) {
@@ -70,49 +240,218 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 // Flush implements HandleFlusher interface
 func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 	// log.Printf("Flush with caller: %s", f.path)
-	if f.isMod {
-		ret := UploadBlobContents(f.path, f.data, false)
-		if ret != 0 {
-			return fuse.ENODATA
+	f.Lock()
+	defer f.Unlock()
+	return f.flush(ctx)
+}
+
+// flush uploads the modified content, the lock must be held
+func (f *File) flush(ctx context.Context) error {
+	if !f.isMod || f.removed {
+		return nil
+	}
+	if f.upload != nil {
+		if err := f.commitUpload(ctx); err != nil {
+			return err
+		}
+	} else {
+		err := f.fs.store.Put(ctx, f.path, f.data, f.metadata)
+		if err != nil {
+			log.Printf("Error in uploading %s: %v", f.path, err)
+			return toErrno(err)
 		}
+		f.isMod = false
+	}
+	if f.fs.cache != nil {
+		// The cached copy is of the previous version
+		f.dropCached()
+		f.fs.cache.invalidate(f.path)
 	}
 	return nil
 }
 
-// Setattr implements NodeSetattrer interface for files
-func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	// log.Printf("Setattr with caller: %s", f.path)
+// rename moves the blob to newPath with a server-side copy followed by the deletion of the source.
+// When the source cannot be deleted the copy is removed again, so that the blob stays in one place.
+// With a hierarchical namespace the service renames the file atomically.
+func (f *File) rename(ctx context.Context, newPath string) error {
 	f.Lock()
-
-	if req.Valid.Size() {
-		delta := int(req.Size) - len(f.data)
-		if delta > 0 {
-			f.data = append(f.data, make([]byte, delta)...)
-		} else {
-			f.data = f.data[0:req.Size]
+	defer f.Unlock()
+	if err := f.flush(ctx); err != nil {
+		return err
+	}
+	if f.upload != nil {
+		// Later appends cannot reuse blocks committed under the old name
+		if err := f.endUpload(ctx); err != nil {
+			return err
 		}
-		f.attr.Size = req.Size
-		atomic.AddInt64(&f.fs.size, int64(delta))
 	}
+	if hs, ok := f.fs.store.(HierarchicalStorage); ok {
+		if err := hs.Rename(ctx, f.path, newPath); err != nil {
+			log.Printf("Error in renaming %s to %s: %v", f.path, newPath, err)
+			return toErrno(err)
+		}
+	} else if err := f.fs.store.Copy(ctx, f.path, newPath); err != nil {
+		log.Printf("Error in copying %s to %s: %v", f.path, newPath, err)
+		return toErrno(err)
+	} else if err := f.fs.store.Delete(ctx, f.path); err != nil {
+		log.Printf("Error in deleting %s after copying it to %s: %v", f.path, newPath, err)
+		if err := f.fs.store.Delete(ctx, newPath); err != nil {
+			log.Printf("Error in removing copy %s: %v", newPath, err)
+		}
+		return toErrno(err)
+	}
+	if f.fs.cache != nil {
+		f.dropCached()
+		f.fs.cache.invalidate(f.path)
+		f.fs.cache.invalidate(newPath)
+	}
+	f.path = newPath
+	return nil
+}
 
-	if req.Valid.Mode() {
-		f.attr.Mode = req.Mode
+// remove deletes the blob, a blob which is already gone is not an error. Handles still open keep
+// reading what is loaded or cached.
+func (f *File) remove(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.fs.discard(ctx, f.path); err != nil && !isNotFound(err) {
+		log.Printf("Error in deleting %s: %v", f.path, err)
+		// EBUSY when the blob has snapshots which must not be deleted
+		return toErrno(err)
+	}
+	f.removed, f.isMod = true, false
+	// The staged blocks are dropped by the service
+	f.upload = nil
+	if f.fs.cache != nil {
+		f.fs.cache.invalidate(f.path)
+	}
+	return nil
+}
+
+// refresh takes the size and modification time of a listed blob unless the file is in use
+func (f *File) refresh(blob BlobAttr) {
+	f.Lock()
+	defer f.Unlock()
+	if f.opens > 0 || f.isMod {
+		return
+	}
+	f.setBlobAttr(blob)
+}
+
+// setBlobAttr takes the size, modification time and metadata of the blob, the lock must be held
+func (f *File) setBlobAttr(blob BlobAttr) {
+	atomic.AddInt64(&f.fs.size, blob.Size-int64(f.attr.Size))
+	f.attr.Size = uint64(blob.Size)
+	f.attr.Mtime = blob.LastModified
+	f.metadata = blob.Metadata
+	metadataAttr(&f.attr, blob.Metadata)
+	posixAttr(&f.attr, blob)
+}
+
+// loadMetadata fetches the metadata of the blob unless it is known, the lock must be held
+func (f *File) loadMetadata(ctx context.Context) error {
+	if f.metadata != nil {
+		return nil
+	}
+	blob, err := f.fs.store.GetProperties(ctx, f.path)
+	if err != nil && !isNotFound(err) {
+		log.Printf("Error in reading metadata of %s: %v", f.path, err)
+		return toErrno(err)
+	}
+	f.metadata = blob.Metadata
+	if f.metadata == nil {
+		f.metadata = make(map[string]string)
+	}
+	return nil
+}
+
+// modified records a change of the content, the time of the change replaces the mtime set by touch.
+// The lock must be held.
+func (f *File) modified(ctx context.Context) error {
+	if err := f.loadMetadata(ctx); err != nil {
+		return err
+	}
+	deleteMetadataValue(f.metadata, metadataMtime)
+	f.attr.Mtime = time.Now()
+	return nil
+}
+
+// Release implements HandleReleaser interface, committing what was not flushed yet
+func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	// log.Printf("Release with caller: %s", f.path)
+	err := f.Flush(ctx, &fuse.FlushRequest{})
+	f.Lock()
+	defer f.Unlock()
+	if f.opens--; f.opens > 0 {
+		return err
+	}
+	if err != nil && f.isMod {
+		log.Printf("Discarding the changes of %s which could not be uploaded", f.path)
+	}
+	// Free the buffers, the content is read back from the storage when needed again
+	f.opens = 0
+	f.isMod = false
+	f.upload = nil
+	f.data, f.loaded = make([]byte, 0), false
+	if f.fs.cache != nil {
+		f.dropCached()
+	}
+	return err
+}
+
+// Setattr implements NodeSetattrer interface for files
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	// log.Printf("Setattr with caller: %s", f.path)
+	if f.fs.readOnly {
+		return errReadOnly
 	}
+	f.Lock()
 
-	if req.Valid.Atime() {
-		f.attr.Atime = req.Atime
+	if req.Valid.Size() && req.Size != f.attr.Size {
+		if err := f.modified(ctx); err != nil {
+			f.Unlock()
+			return err
+		}
 	}
 
-	if req.Valid.AtimeNow() {
-		f.attr.Atime = time.Now()
+	if req.Valid.Size() && f.upload != nil && req.Size != f.attr.Size {
+		var err error
+		if req.Size == 0 {
+			// The staged blocks are dropped by the next commit
+			f.upload = nil
+		} else {
+			err = f.endUpload(ctx)
+		}
+		if err != nil {
+			f.Unlock()
+			return err
+		}
 	}
 
-	if req.Valid.Mtime() {
-		f.attr.Mtime = req.Mtime
+	if req.Valid.Size() && f.upload == nil {
+		if req.Size == 0 {
+			// Truncating to zero does not need the old content
+			f.data, f.loaded = f.data[:0], true
+		} else if err := f.load(ctx); err != nil {
+			f.Unlock()
+			return err
+		}
+		if grow := int(req.Size) - len(f.data); grow > 0 {
+			f.data = append(f.data, make([]byte, grow)...)
+		} else {
+			f.data = f.data[0:req.Size]
+		}
+		atomic.AddInt64(&f.fs.size, int64(req.Size)-int64(f.attr.Size))
+		f.attr.Size = req.Size
+		f.isMod = true
 	}
 
-	if req.Valid.MtimeNow() {
-		f.attr.Mtime = time.Now()
+	applySetattr(&f.attr, req)
+	if persistsAttr(req) {
+		if err := f.persistAttr(ctx, req); err != nil {
+			f.Unlock()
+			return err
+		}
 	}
 
 	resp.Attr = f.attr
@@ -120,3 +459,25 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	f.Unlock()
 	return nil
 }
+
+// persistAttr records the attributes changed by req in the metadata of the blob, modified content
+// carries them when it is uploaded. The lock must be held.
+func (f *File) persistAttr(ctx context.Context, req *fuse.SetattrRequest) error {
+	if req.Valid.Mode() {
+		if err := f.fs.setModeACL(ctx, f.path, f.attr.Mode); err != nil {
+			return err
+		}
+	}
+	if err := f.loadMetadata(ctx); err != nil {
+		return err
+	}
+	setMetadataAttr(f.metadata, f.attr, req)
+	if f.isMod || f.removed {
+		return nil
+	}
+	if err := f.fs.store.SetMetadata(ctx, f.path, f.metadata); err != nil {
+		log.Printf("Error in setting metadata of %s: %v", f.path, err)
+		return toErrno(err)
+	}
+	return nil
+}
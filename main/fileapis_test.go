@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// lookupFile lists the root of filesys and returns the file with name
+func lookupFile(t *testing.T, filesys *FS, name string) *File {
+	t.Helper()
+	readDirNames(t, filesys.root)
+	n, err := filesys.root.Lookup(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Lookup %s: %v", name, err)
+	}
+	return n.(*File)
+}
+
+// readFile reads size bytes at offset through the file handle
+func readFile(t *testing.T, f *File, offset int64, size int) string {
+	t.Helper()
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, size)}
+	if err := f.Read(context.Background(), &fuse.ReadRequest{Offset: offset, Size: size}, resp); err != nil {
+		t.Fatalf("Read at %d: %v", offset, err)
+	}
+	return string(resp.Data)
+}
+
+// rangeRecorder is a Storage recording the ranges read
+type rangeRecorder struct {
+	Storage
+	ranges [][2]int64
+}
+
+func (r *rangeRecorder) GetRange(ctx context.Context, name string, offset int64, b []byte) error {
+	r.ranges = append(r.ranges, [2]int64{offset, int64(len(b))})
+	return r.Storage.GetRange(ctx, name, offset, b)
+}
+
+// blockRecorder is a Storage counting the blocks staged and the requests uploading whole blobs
+type blockRecorder struct {
+	Storage
+	staged  []int
+	commits int
+	puts    int
+	fail    bool // StageBlock fails
+}
+
+func (r *blockRecorder) StageBlock(ctx context.Context, name string, blockID string, data []byte) error {
+	if r.fail {
+		return errors.New("stage failed")
+	}
+	r.staged = append(r.staged, len(data))
+	return r.Storage.StageBlock(ctx, name, blockID, data)
+}
+
+func (r *blockRecorder) CommitBlocks(ctx context.Context, name string, blockIDs []string, metadata map[string]string) error {
+	r.commits++
+	return r.Storage.CommitBlocks(ctx, name, blockIDs, metadata)
+}
+
+func (r *blockRecorder) Put(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	r.puts++
+	return r.Storage.Put(ctx, name, data, metadata)
+}
+
+// useBlockSize changes BlockSize for the duration of the test
+func useBlockSize(t *testing.T, size uint64) {
+	saved := BlockSize
+	t.Cleanup(func() { BlockSize = saved })
+	BlockSize = size
+}
+
+func TestOpenReadsBlobContent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "data.csv", []byte("a,b,c\n1,2,3\n"), nil)
+
+		f := lookupFile(t, NewFS(store), "data.csv")
+		if _, err := f.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{}); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if data := readFile(t, f, 0, 4096); data != "a,b,c\n1,2,3\n" {
+			t.Errorf("Read returned %q", data)
+		}
+		if data := readFile(t, f, 6, 3); data != "1,2" {
+			t.Errorf("Read at offset 6 returned %q", data)
+		}
+		if data := readFile(t, f, 12, 10); data != "" {
+			t.Errorf("Read at end of file returned %q", data)
+		}
+	})
+}
+
+func TestOpenSeesRemoteOverwrite(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "log.txt", []byte("short"), nil)
+		f := lookupFile(t, NewFS(store), "log.txt")
+		store.Put(ctx, "log.txt", []byte("much longer"), nil)
+		openFile(t, f)
+		if data := readFile(t, f, 0, 100); data != "much longer" {
+			t.Errorf("Read after a remote overwrite returned %q", data)
+		}
+		releaseFile(t, f)
+	})
+}
+
+func TestReadFetchesOnlyRequestedRange(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		big := make([]byte, 1<<20)
+		for i := range big {
+			big[i] = byte('a' + i%26)
+		}
+		store.Put(ctx, "big.csv", big, nil)
+
+		recorder := &rangeRecorder{Storage: store}
+		f := lookupFile(t, NewFS(recorder), "big.csv")
+		if _, err := f.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{}); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if len(recorder.ranges) != 0 {
+			t.Errorf("Open downloaded %v", recorder.ranges)
+		}
+		if data := readFile(t, f, 4096, 8); data != string(big[4096:4104]) {
+			t.Errorf("Read returned %q", data)
+		}
+		if data := readFile(t, f, 1<<20-2, 4096); data != string(big[1<<20-2:]) {
+			t.Errorf("Read at the end returned %q", data)
+		}
+		want := [][2]int64{{4096, 8}, {1<<20 - 2, 2}}
+		if len(recorder.ranges) != 2 || recorder.ranges[0] != want[0] || recorder.ranges[1] != want[1] {
+			t.Errorf("ranges read are %v, want %v", recorder.ranges, want)
+		}
+	})
+}
+
+func TestWriteFlushUploadsBlob(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		filesys := NewFS(store)
+		n, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "out.txt"}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		f := h.(*File)
+		for _, w := range []struct {
+			offset int64
+			data   string
+		}{{0, "hello "}, {6, "world"}, {0, "H"}} {
+			resp := &fuse.WriteResponse{}
+			if err := f.Write(ctx, &fuse.WriteRequest{Offset: w.offset, Data: []byte(w.data)}, resp); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if resp.Size != len(w.data) {
+				t.Errorf("Write reported %d bytes, want %d", resp.Size, len(w.data))
+			}
+		}
+		if err := f.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+
+		b := make([]byte, 11)
+		if err := store.GetRange(ctx, "out.txt", 0, b); err != nil {
+			t.Fatalf("GetRange: %v", err)
+		}
+		if string(b) != "Hello world" {
+			t.Errorf("uploaded blob is %q", b)
+		}
+		var attr fuse.Attr
+		n.Attr(ctx, &attr)
+		if attr.Size != 11 {
+			t.Errorf("file size is %d, want 11", attr.Size)
+		}
+	})
+}
+
+func TestReleaseAfterFailedFlush(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	filesys := NewFS(NewBlobStorage(fake.ContainerURL()))
+	_, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "denied.txt"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f := h.(*File)
+	fake.failures = map[string]fakeFailure{"denied.txt": {http.StatusForbidden, "AuthorizationPermissionMismatch", 0}}
+	if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("lost")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Release(ctx, &fuse.ReleaseRequest{}); err == nil {
+		t.Errorf("Release succeeded although the upload failed")
+	}
+	if f.opens != 0 || f.isMod || len(f.data) != 0 {
+		t.Errorf("released file has %d opens, modified %v and %d bytes", f.opens, f.isMod, len(f.data))
+	}
+}
+
+func TestSetattrTruncate(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "trunc.txt", []byte("0123456789"), nil)
+
+		f := lookupFile(t, NewFS(store), "trunc.txt")
+		if _, err := f.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{}); err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		req := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 4}
+		resp := &fuse.SetattrResponse{}
+		if err := f.Setattr(ctx, req, resp); err != nil {
+			t.Fatalf("Setattr: %v", err)
+		}
+		if resp.Attr.Size != 4 {
+			t.Errorf("Setattr reported size %d, want 4", resp.Attr.Size)
+		}
+		if data := readFile(t, f, 0, 10); data != "0123" {
+			t.Errorf("truncated content is %q", data)
+		}
+	})
+}
+
+func TestSequentialWriteStagesBlocks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		useBlockSize(t, 4)
+		recorder := &blockRecorder{Storage: store}
+		filesys := NewFS(recorder)
+		_, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "big.out"}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		f := h.(*File)
+		var offset int64
+		for _, w := range []string{"abc", "defgh", "ij", "klmnopq", "r"} {
+			if err := f.Write(ctx, &fuse.WriteRequest{Offset: offset, Data: []byte(w)}, &fuse.WriteResponse{}); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			offset += int64(len(w))
+			if len(f.upload.buf) >= int(BlockSize) {
+				t.Errorf("%d bytes buffered, more than a block", len(f.upload.buf))
+			}
+		}
+		if len(f.data) != 0 {
+			t.Errorf("sequential writes were buffered in memory")
+		}
+		if err := f.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if got := fmt.Sprint(recorder.staged); got != "[4 4 4 4 2]" || recorder.commits != 1 {
+			t.Errorf("staged blocks %s with %d commits", got, recorder.commits)
+		}
+
+		// Appending after the commit extends the committed blocks
+		if err := f.Write(ctx, &fuse.WriteRequest{Offset: offset, Data: []byte("st")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if data := readFile(t, f, 0, 100); data != "abcdefghijklmnopqrst" {
+			t.Errorf("Read returned %q", data)
+		}
+		if err := f.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+		b := make([]byte, 20)
+		if err := store.GetRange(ctx, "big.out", 0, b); err != nil || string(b) != "abcdefghijklmnopqrst" {
+			t.Errorf("uploaded blob is %q, %v", b, err)
+		}
+	})
+}
+
+func TestReadDuringUploadCommitsOnlyStagedBlocks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		useBlockSize(t, 4)
+		recorder := &blockRecorder{Storage: store}
+		filesys := NewFS(recorder)
+		_, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "log.out"}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		f := h.(*File)
+		if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("abcdef")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if data := readFile(t, f, 4, 2); data != "ef" || recorder.commits != 0 {
+			t.Errorf("Read of the buffer returned %q with %d commits", data, recorder.commits)
+		}
+		if data := readFile(t, f, 0, 6); data != "abcdef" || recorder.commits != 1 {
+			t.Errorf("Read of a staged block returned %q with %d commits", data, recorder.commits)
+		}
+		if err := f.Write(ctx, &fuse.WriteRequest{Offset: 6, Data: []byte("gh")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if data := readFile(t, f, 0, 8); data != "abcdefgh" || recorder.commits != 1 {
+			t.Errorf("Read of committed blocks and the buffer returned %q with %d commits", data, recorder.commits)
+		}
+		releaseFile(t, f)
+	})
+}
+
+func TestFailedStageDropsWrite(t *testing.T) {
+	ctx := context.Background()
+	useBlockSize(t, 4)
+	recorder := &blockRecorder{Storage: NewMemStorage()}
+	filesys := NewFS(recorder)
+	_, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "big.out"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f := h.(*File)
+	if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("abcde")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	recorder.fail = true
+	if err := f.Write(ctx, &fuse.WriteRequest{Offset: 5, Data: []byte("fghijk")}, &fuse.WriteResponse{}); err == nil {
+		t.Fatalf("Write succeeded although staging failed")
+	}
+	if f.attr.Size != 5 || string(f.upload.buf) != "e" {
+		t.Errorf("failed write left size %d and %q buffered", f.attr.Size, f.upload.buf)
+	}
+	recorder.fail = false
+	if err := f.Write(ctx, &fuse.WriteRequest{Offset: 5, Data: []byte("fghijk")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	b := make([]byte, 11)
+	if err := recorder.GetRange(ctx, "big.out", 0, b); err != nil || string(b) != "abcdefghijk" {
+		t.Errorf("uploaded blob is %q, %v", b, err)
+	}
+}
+
+func TestSmallWriteUsesSingleUpload(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		recorder := &blockRecorder{Storage: store}
+		filesys := NewFS(recorder)
+		_, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "small.txt"}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		f := h.(*File)
+		f.Write(ctx, &fuse.WriteRequest{Offset: 0, Data: []byte("small")}, &fuse.WriteResponse{})
+		if err := f.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+		// One upload for Create and one for the content
+		if len(recorder.staged) != 0 || recorder.commits != 0 || recorder.puts != 2 {
+			t.Errorf("staged %v, %d commits, %d puts", recorder.staged, recorder.commits, recorder.puts)
+		}
+	})
+}
+
+func TestRandomWriteAfterStagedBlocks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		useBlockSize(t, 4)
+		filesys := NewFS(store)
+		_, h, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "mixed.txt"}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		f := h.(*File)
+		for _, w := range []struct {
+			offset int64
+			data   string
+		}{{0, "0123456789"}, {2, "ab"}, {10, "cd"}} {
+			if err := f.Write(ctx, &fuse.WriteRequest{Offset: w.offset, Data: []byte(w.data)}, &fuse.WriteResponse{}); err != nil {
+				t.Fatalf("Write at %d: %v", w.offset, err)
+			}
+		}
+		if err := f.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		b := make([]byte, 12)
+		if err := store.GetRange(ctx, "mixed.txt", 0, b); err != nil || string(b) != "01ab456789cd" {
+			t.Errorf("uploaded blob is %q, %v", b, err)
+		}
+	})
+}
@@ -14,6 +14,33 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Permissions of files and directories unless configured otherwise or persisted in their metadata
+const (
+	defaultFileMode = 0o644
+	defaultDirMode  = 0o755
+
+	// defaultBlockSize is the size of the blocks staged while writing a file sequentially
+	defaultBlockSize = 8 << 20
+
+	// defaultRenameParallelism is the number of blobs copied at the same time by a directory rename
+	defaultRenameParallelism = 16
+
+	// defaultOperationTimeout bounds requests on metadata, so that a slow account fails an ls instead of hanging it
+	defaultOperationTimeout = 2 * time.Minute
+
+	// defaultAttrTimeout is the attribute cache of bazil.org/fuse when nodes do not set one
+	defaultAttrTimeout = time.Minute
+
+	// Retry policy of the pipeline, the defaults of azblob
+	defaultMaxTries      = 4
+	defaultTryTimeout    = time.Minute
+	defaultRetryDelay    = 4 * time.Second
+	defaultMaxRetryDelay = 2 * time.Minute
+
+	// defaultDirectoryMarkers are the conventions recognized for blobs standing for a directory
+	defaultDirectoryMarkers = markerMetadata + "," + markerSlash + "," + markerResourceType
+)
+
 var (
 	// MountPoint is the Path of Directory where file system will be mounted
 	MountPoint string
@@ -24,8 +51,144 @@ var (
 	// AccountKey is the Shared Access Key of Storage Account
 	AccountKey string
 
+	// AccountKeyFile is a file (or "-" for stdin) holding AccountKey
+	AccountKeyFile string
+
+	// SasToken is a container or account Shared Access Signature used instead of AccountKey
+	SasToken string
+
+	// SasTokenFile is a file (or "-" for stdin) holding SasToken
+	SasTokenFile string
+
+	// AuthType selects the authentication: Key, SAS, SPN, MSI or TokenFile
+	AuthType string
+
+	// TenantID is the Azure AD tenant of the service principal
+	TenantID string
+
+	// ClientID is the application id of the service principal or of the user assigned managed identity
+	ClientID string
+
+	// ClientSecret is the secret of the service principal
+	ClientSecret string
+
+	// ClientSecretFile is a file (or "-" for stdin) holding ClientSecret
+	ClientSecretFile string
+
+	// ClientCertPath is the PEM file with the certificate and private key of the service principal
+	ClientCertPath string
+
+	// TokenFile is a file holding a bearer token which is refreshed by another process
+	TokenFile string
+
+	// AADEndpoint is the Azure AD authority used for service principals
+	AADEndpoint string
+
+	// IMDSEndpoint is the token endpoint of the Instance Metadata Service used for managed identities
+	IMDSEndpoint string
+
 	// ContainerName is the name of container to be mounted
 	ContainerName string
+
+	// Endpoint is the URL of the Blob service, by default https://<AccountName>.blob.core.windows.net
+	Endpoint string
+
+	// DfsEndpoint is the URL of the Data Lake service, by default derived from Endpoint
+	DfsEndpoint string
+
+	// HNS tells whether the account has a hierarchical namespace: auto detects it when mounting, true or false
+	HNS = hnsAuto
+
+	// UseHTTP allows plain HTTP endpoints, meant for local emulators such as Azurite
+	UseHTTP bool
+
+	// ReadOnly mounts the container read-only, it is forced for SAS tokens without write permission
+	ReadOnly bool
+
+	// AsOf mounts read-only the versions of the blobs written at or before that time (RFC 3339), deleted blobs included
+	AsOf string
+
+	// DefaultFileMode is the permission of files without a mode in their metadata
+	DefaultFileMode os.FileMode = defaultFileMode
+
+	// DefaultDirMode is the permission of directories without a mode in their metadata
+	DefaultDirMode os.FileMode = defaultDirMode
+
+	// UID and GID own the files and directories without an owner in their metadata
+	UID, GID = uint(os.Getuid()), uint(os.Getgid())
+
+	// AttrTimeout is how long the kernel caches attributes returned by the file system, 0 disables the cache
+	AttrTimeout time.Duration = defaultAttrTimeout
+
+	// OperationTimeout bounds each request on metadata or listing page, retries included, 0 means no deadline
+	OperationTimeout time.Duration = defaultOperationTimeout
+
+	// TransferTimeout bounds each upload, download or copy, retries included, 0 means no deadline
+	TransferTimeout time.Duration
+
+	// MaxTries is the number of attempts of a request before it fails
+	MaxTries uint = defaultMaxTries
+
+	// TryTimeout bounds a single attempt of a request
+	TryTimeout = defaultTryTimeout
+
+	// RetryPolicy is the backoff between attempts: exponential or fixed
+	RetryPolicy = retryPolicyExponential
+
+	// RetryDelay is the delay before the first retry, MaxRetryDelay the longest delay between attempts
+	RetryDelay, MaxRetryDelay = defaultRetryDelay, defaultMaxRetryDelay
+
+	// BlockSize is the size of the blocks large files are uploaded in, it bounds the memory used per written file
+	BlockSize uint64 = defaultBlockSize
+
+	// TmpPath is the directory opened blobs are cached in, caching is disabled when empty
+	TmpPath string
+
+	// CacheSizeMB is the size limit of the file cache in MiB
+	CacheSizeMB uint64
+
+	// JournalPath is the directory journaling directory renames, by default ~/.blobfuse-go/journal
+	JournalPath string
+
+	// RenameParallelism is the number of blobs copied or deleted at the same time by a directory rename
+	RenameParallelism uint = defaultRenameParallelism
+
+	// RenameRecovery is what happens on mount to a directory rename interrupted before all blobs were copied: rollback or resume
+	RenameRecovery = renameRecoveryRollback
+
+	// DirectoryMarkers lists the conventions which make a blob a directory: metadata, slash and resourceType
+	DirectoryMarkers = defaultDirectoryMarkers
+
+	// DeleteSnapshots is what happens to the snapshots of a removed blob: include deletes them with the blob,
+	// fail refuses to remove blobs which have snapshots
+	DeleteSnapshots = deleteSnapshotsInclude
+
+	// UploadTier is the access tier of uploaded blobs: Hot, Cool or Archive, the default tier of the account when empty
+	UploadTier string
+
+	// RehydratePriority is the priority of the rehydration of archived blobs: Standard or High
+	RehydratePriority = defaultRehydratePriority
+
+	// SnapshotDir is the name of the hidden directory listing the snapshots of the files of each
+	// directory, snapshots are not shown when empty
+	SnapshotDir = ".snapshots"
+
+	// TrashDir is the name of the hidden directory at the root listing removed files, which are restored by
+	// moving them out of it. It is disabled when empty.
+	TrashDir = ".trash"
+
+	// TrashRetention keeps removed files in the trash for that long before deleting their blobs, removed
+	// blobs are only kept by the soft delete of the account when 0
+	TrashRetention time.Duration
+
+	// LogFile receives the log instead of stderr when set
+	LogFile string
+
+	// ConfigPath is the configuration file read before environment variables and flags
+	ConfigPath string
+
+	// PrintConfig prints the effective configuration instead of mounting
+	PrintConfig bool
 )
 
 func usage() {
@@ -34,19 +197,90 @@ func usage() {
 	flag.PrintDefaults()
 }
 
+// registerFlags binds the command line flags to the configuration variables and sets their defaults
+func registerFlags(f *flag.FlagSet) {
+	f.StringVar(&ConfigPath, "config", "", "YAML or JSON configuration file, overridden by environment variables and flags")
+	f.BoolVar(&PrintConfig, "print-config", false, "Print the effective configuration with secrets redacted and exit")
+	f.StringVar(&MountPoint, "mountPath", "", "Path of folder to act as a file system")
+	f.StringVar(&AccountName, "accountName", "", "Name of Storage Account to Mount")
+	f.StringVar(&AccountKey, "accountKey", "", "Shared Access Key for the storage account (visible in the process list, prefer accountKeyFile or "+envAccountKey+")")
+	f.StringVar(&AccountKeyFile, "accountKeyFile", "", "File holding the Shared Access Key, - to read it from stdin")
+	f.StringVar(&SasToken, "sasToken", "", "Container or account SAS token, used instead of accountKey (visible in the process list, prefer sasTokenFile or "+envSasToken+")")
+	f.StringVar(&SasTokenFile, "sasTokenFile", "", "File holding the SAS token, - to read it from stdin")
+	f.StringVar(&AuthType, "authType", "", "Authentication type: Key, SAS, SPN, MSI or TokenFile (default Key, or SAS when sasToken is set)")
+	f.StringVar(&TenantID, "tenantId", "", "Azure AD tenant of the service principal")
+	f.StringVar(&ClientID, "clientId", "", "Application id of the service principal or client id of a user assigned managed identity")
+	f.StringVar(&ClientSecret, "clientSecret", "", "Secret of the service principal (visible in the process list, prefer clientSecretFile or "+envClientSecret+")")
+	f.StringVar(&ClientSecretFile, "clientSecretFile", "", "File holding the secret of the service principal, - to read it from stdin")
+	f.StringVar(&ClientCertPath, "clientCertPath", "", "PEM file with certificate and private key of the service principal")
+	f.StringVar(&TokenFile, "tokenFile", "", "File holding a bearer token, re-read before it expires")
+	f.StringVar(&AADEndpoint, "aadEndpoint", defaultAADEndpoint, "Azure AD authority used for service principals")
+	f.StringVar(&IMDSEndpoint, "imdsEndpoint", defaultIMDSEndpoint, "Token endpoint of the Instance Metadata Service")
+	f.StringVar(&ContainerName, "containerName", "", "Name of stroge container to mount")
+	f.StringVar(&Endpoint, "endpoint", "", "URL of the Blob service, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite")
+	f.StringVar(&DfsEndpoint, "dfsEndpoint", "", "URL of the Data Lake service of an account with a hierarchical namespace (default derived from endpoint)")
+	f.StringVar(&HNS, "hns", hnsAuto, "Hierarchical namespace (ADLS Gen2) of the account: auto, true or false")
+	f.BoolVar(&UseHTTP, "useHttp", false, "Allow plain HTTP endpoints (local emulators only)")
+	f.BoolVar(&ReadOnly, "readOnly", false, "Mount the container read-only")
+	f.StringVar(&AsOf, "asOf", "", "Mount read-only the versions of the blobs written at or before this time (RFC 3339), blobs deleted before it are still shown")
+	DefaultFileMode, DefaultDirMode = defaultFileMode, defaultDirMode
+	f.Var((*modeValue)(&DefaultFileMode), "fileMode", "Permissions of files, in octal")
+	f.Var((*modeValue)(&DefaultDirMode), "dirMode", "Permissions of directories, in octal")
+	f.UintVar(&UID, "uid", uint(os.Getuid()), "Owner of files and directories")
+	f.UintVar(&GID, "gid", uint(os.Getgid()), "Group of files and directories")
+	f.DurationVar(&AttrTimeout, "attrTimeout", defaultAttrTimeout, "How long the kernel may cache attributes of files and directories, 0 to always ask the file system")
+	f.DurationVar(&OperationTimeout, "operationTimeout", defaultOperationTimeout, "Deadline of each request on metadata or listing page including retries, 0 for none")
+	f.DurationVar(&TransferTimeout, "transferTimeout", 0, "Deadline of each upload, download or copy including retries, 0 for none")
+	f.UintVar(&MaxTries, "maxTries", defaultMaxTries, "Attempts of a request failing with 500, 502, 503, a network error or a timeout")
+	f.DurationVar(&TryTimeout, "tryTimeout", defaultTryTimeout, "Deadline of a single attempt of a request")
+	f.StringVar(&RetryPolicy, "retryPolicy", retryPolicyExponential, "Backoff between attempts: exponential or fixed")
+	f.DurationVar(&RetryDelay, "retryDelay", defaultRetryDelay, "Delay before the first retry")
+	f.DurationVar(&MaxRetryDelay, "maxRetryDelay", defaultMaxRetryDelay, "Longest delay between attempts")
+	f.Uint64Var(&BlockSize, "blockSize", defaultBlockSize, "Size in bytes of the blocks files are uploaded in while written sequentially")
+	f.StringVar(&TmpPath, "tmpPath", "", "Directory to cache opened blobs in, caching is disabled when not set")
+	f.Uint64Var(&CacheSizeMB, "cacheSizeMB", 1024, "Size limit of the file cache in MiB, least recently used closed files are evicted")
+	f.StringVar(&JournalPath, "journalPath", "", "Directory of the journals of directory renames (default ~/.blobfuse-go/journal)")
+	f.UintVar(&RenameParallelism, "renameParallelism", defaultRenameParallelism, "Number of blobs copied in parallel when renaming a directory")
+	f.StringVar(&RenameRecovery, "renameRecovery", renameRecoveryRollback, "Recovery of a directory rename interrupted while copying: rollback or resume")
+	f.StringVar(&DirectoryMarkers, "directoryMarkers", defaultDirectoryMarkers, "Comma separated conventions for blobs standing for directories: metadata (hdi_isFolder=true), slash (empty blob named dir/) and resourceType (hierarchical namespace)")
+	f.StringVar(&DeleteSnapshots, "deleteSnapshots", deleteSnapshotsInclude, "Snapshots of removed blobs: include to delete them with the blob, fail to refuse removing blobs with snapshots")
+	f.StringVar(&UploadTier, "uploadTier", "", "Access tier of uploaded blobs: Hot, Cool or Archive (default tier of the account)")
+	f.StringVar(&RehydratePriority, "rehydratePriority", defaultRehydratePriority, "Priority of the rehydration of archived blobs moved to another tier: Standard or High")
+	f.StringVar(&SnapshotDir, "snapshotDir", ".snapshots", "Name of the hidden directory of read-only snapshots in each directory, disabled when empty")
+	f.StringVar(&TrashDir, "trashDir", ".trash", "Name of the hidden directory at the root listing removed files, disabled when empty")
+	f.DurationVar(&TrashRetention, "trashRetention", 0, "How long removed files are kept in the trash before their blobs are deleted, 0 to rely on the soft delete of the account")
+	f.StringVar(&LogFile, "logFile", "", "File to write the log to instead of stderr")
+}
+
 func main() {
-	mountpoint := flag.String("mountPath", "", "Path of folder to act as a file system")
-	accountname := flag.String("accountName", "", "Name of Storage Account to Mount")
-	accountkey := flag.String("accountKey", "", "Shared Access Key for the storage account")
-	containername := flag.String("containerName", "", "Name of stroge container to mount")
+	// Keep account keys, SAS signatures and tokens out of the logs
+	log.SetOutput(redactingWriter{w: os.Stderr})
 
+	registerFlags(flag.CommandLine)
 	flag.Usage = usage
-	flag.Parse()
+	if err := configure(flag.CommandLine, os.Args[1:]); err != nil {
+		log.Printf("%v", err)
+		os.Exit(2)
+	}
+	if PrintConfig {
+		if err := printConfig(os.Stdout, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if LogFile != "" {
+		f, err := os.OpenFile(LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		log.SetOutput(redactingWriter{w: f})
+	}
 
-	MountPoint = *mountpoint
-	AccountName = *accountname
-	AccountKey = *accountkey
-	ContainerName = *containername
+	if err := loadSecrets(); err != nil {
+		log.Printf("%v", err)
+		os.Exit(1)
+	}
 
 	log.Printf("Validating Account Credentials")
 	ret := ValidateAccount()
@@ -56,21 +290,67 @@ func main() {
 	}
 	log.Printf("Account Validation Successful, Mounting Directory as FS")
 
-	c, err := fuse.Mount(
-		MountPoint,
+	store := newStorage()
+	if AsOf != "" {
+		vs, ok := store.(VersionedStorage)
+		if !ok {
+			log.Fatal("Blob versions are not supported by the storage")
+		}
+		asOf, _ := time.Parse(time.RFC3339, AsOf)
+		store = newAsOfStorage(vs, asOf)
+		ReadOnly = true
+		log.Printf("Mounting the container as it was at %s", asOf.UTC().Format(time.RFC3339))
+	}
+
+	filesys := NewFS(store)
+	// ReadOnly may also have been forced by a SAS without write permission when validating the account
+	filesys.readOnly = ReadOnly || AsOf != ""
+	filesys.journal = JournalPath
+	if filesys.journal == "" {
+		filesys.journal = defaultJournalPath()
+	}
+	if err := os.MkdirAll(filesys.journal, 0o700); err != nil {
+		log.Fatal(err)
+	}
+	// Renames left halfway are completed before mounting, the mount point would hang meanwhile
+	if !filesys.readOnly {
+		filesys.recoverRenames(context.Background())
+	}
+	if TmpPath != "" {
+		dir, err := newCacheDir(TmpPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		filesys.cache = newFileCache(dir, int64(CacheSizeMB)<<20)
+		log.Printf("Caching files in %s, up to %d MiB", dir, CacheSizeMB)
+	}
+
+	options := []fuse.MountOption{
 		fuse.FSName("blobfuse"),
 		fuse.Subtype("blobfuse-go"),
 		fuse.LocalVolume(),
 		fuse.VolumeName(AccountName),
-	)
+	}
+	if ReadOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(MountPoint, options...)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("%v", err)
+		// log.Fatal would skip removing the cache directory
+		if filesys.cache != nil {
+			os.RemoveAll(filesys.cache.dir)
+		}
+		os.Exit(1)
 	}
 	defer c.Close()
 
 	cfg := &fs.Config{}
 	srv := fs.New(c, cfg)
-	filesys := NewFS()
+	if TrashRetention > 0 && !filesys.readOnly {
+		go filesys.keepPurgingTrash()
+	}
 
 	if err := srv.Serve(filesys); err != nil {
 		log.Fatal(err)
@@ -86,9 +366,14 @@ func main() {
 // FS is the File System created to serve the calls at user space
 type FS struct {
 	root      *Dir
+	store     Storage
+	cache     *fileCache
+	journal   string // directory of the rename journals, renames are not journaled when empty
 	nodeID    uint64
 	nodeCount uint64
 	size      int64
+	readOnly  bool // read-only mount or view of the container, such as a snapshot directory
+	parent    *FS  // file system of the mount which allocates the inodes of a view
 }
 
 // Compile-time interface checks.
@@ -96,23 +381,40 @@ var _ fs.FS = (*FS)(nil)
 var _ fs.FSStatfser = (*FS)(nil)
 
 var _ fs.Node = (*Dir)(nil)
+var _ fs.NodeAccesser = (*Dir)(nil)
 var _ fs.NodeCreater = (*Dir)(nil)
 var _ fs.NodeMkdirer = (*Dir)(nil)
 var _ fs.NodeRemover = (*Dir)(nil)
 var _ fs.NodeRenamer = (*Dir)(nil)
 var _ fs.NodeStringLookuper = (*Dir)(nil)
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+var _ fs.NodeListxattrer = (*Dir)(nil)
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+var _ fs.Node = (*snapshotsDir)(nil)
+var _ fs.NodeStringLookuper = (*snapshotsDir)(nil)
+var _ fs.HandleReadDirAller = (*snapshotsDir)(nil)
 
-var _ fs.HandleReadAller = (*File)(nil)
+var _ fs.HandleReader = (*File)(nil)
 var _ fs.HandleWriter = (*File)(nil)
 var _ fs.Node = (*File)(nil)
 var _ fs.NodeOpener = (*File)(nil)
 var _ fs.NodeSetattrer = (*File)(nil)
 var _ fs.HandleFlusher = (*File)(nil)
+var _ fs.HandleReleaser = (*File)(nil)
+var _ fs.NodeAccesser = (*File)(nil)
+var _ fs.NodeGetxattrer = (*File)(nil)
+var _ fs.NodeListxattrer = (*File)(nil)
+var _ fs.NodeSetxattrer = (*File)(nil)
+var _ fs.NodeRemovexattrer = (*File)(nil)
 
 // NewFS Returns a file system object for making a connection with
-func NewFS() *FS {
+// the container served by store
+func NewFS(store Storage) *FS {
 // 	log.Printf("NewFS")
 	fs := &FS{
+		store:     store,
 		nodeCount: 1,
 	}
 	fs.root = fs.NewDir("", os.ModeDir|0777, 0, time.Now())
@@ -136,6 +438,8 @@ func (m *FS) NewDir(path string, mode os.FileMode, size uint64, mtime time.Time)
 			Crtime: n,
 			Mode:   os.ModeDir | mode,
 			Size:   size,
+			Uid:    uint32(UID),
+			Gid:    uint32(GID),
 		},
 		fs:    m,
 		nodes: make(map[string]fs.Node),
@@ -156,7 +460,10 @@ func (m *FS) NewFile(path string, mode os.FileMode, size uint64, mtime time.Time
 			Crtime: n,
 			Mode:   mode,
 			Size:   size,
+			Uid:    uint32(UID),
+			Gid:    uint32(GID),
 		},
+		fs:    m,
 		data:  make([]byte, 0),
 		isMod: false,
 	}
@@ -164,6 +471,9 @@ func (m *FS) NewFile(path string, mode os.FileMode, size uint64, mtime time.Time
 
 func (m *FS) nextID() uint64 {
 	// log.Printf("nextID")
+	if m.parent != nil {
+		return m.parent.nextID()
+	}
 	return atomic.AddUint64(&m.nodeID, 1)
 }
 
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrBlobNotFound is returned by MemStorage when the requested blob does not exist
+var ErrBlobNotFound = errors.New("blob not found")
+
+type memBlob struct {
+	data         []byte
+	metadata     map[string]string
+	lastModified time.Time
+	etag         uint64
+	contentMD5   []byte // set by Put like the service does
+}
+
+// MemStorage implements Storage in memory, it is used to run the file system without a storage account
+type MemStorage struct {
+	sync.RWMutex
+	blobs map[string]*memBlob
+	etag  uint64
+	// blocks holds the staged and committed blocks of each block blob by block id
+	blocks map[string]map[string][]byte
+}
+
+var _ Storage = (*MemStorage)(nil)
+
+// NewMemStorage returns an empty in-memory Storage
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		blobs:  make(map[string]*memBlob),
+		blocks: make(map[string]map[string][]byte),
+	}
+}
+
+func (m *MemStorage) attr(name string, b *memBlob) BlobAttr {
+	return BlobAttr{
+		Name:         name,
+		Size:         int64(len(b.data)),
+		LastModified: b.lastModified,
+		ETag:         fmt.Sprintf("\"0x%X\"", b.etag),
+		Metadata:     copyMetadata(b.metadata),
+	}
+}
+
+// store replaces the blob with name, the caller must hold the write lock
+func (m *MemStorage) store(name string, data []byte, metadata map[string]string) {
+	m.etag++
+	m.blobs[name] = &memBlob{
+		data:         data,
+		metadata:     copyMetadata(metadata),
+		lastModified: time.Now(),
+		etag:         m.etag,
+	}
+}
+
+// List returns the blobs and the prefixes directly under prefix sorted by name
+func (m *MemStorage) List(ctx context.Context, prefix string) ([]BlobAttr, []string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var blobItems []BlobAttr
+	var prefixes []string
+	seen := make(map[string]bool)
+	for name, b := range m.blobs {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], "/"); i >= 0 {
+			if p := name[:len(prefix)+i+1]; !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+			continue
+		}
+		blobItems = append(blobItems, m.attr(name, b))
+	}
+	sort.Slice(blobItems, func(i, j int) bool { return blobItems[i].Name < blobItems[j].Name })
+	sort.Strings(prefixes)
+	return blobItems, prefixes, nil
+}
+
+// ListRecursive returns every blob under prefix sorted by name
+func (m *MemStorage) ListRecursive(ctx context.Context, prefix string) ([]BlobAttr, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var blobItems []BlobAttr
+	for name, b := range m.blobs {
+		if strings.HasPrefix(name, prefix) {
+			blobItems = append(blobItems, m.attr(name, b))
+		}
+	}
+	sort.Slice(blobItems, func(i, j int) bool { return blobItems[i].Name < blobItems[j].Name })
+	return blobItems, nil
+}
+
+// GetRange fills b with the content of the blob starting at offset
+func (m *MemStorage) GetRange(ctx context.Context, name string, offset int64, b []byte) error {
+	m.RLock()
+	defer m.RUnlock()
+	blob, exists := m.blobs[name]
+	if !exists {
+		return ErrBlobNotFound
+	}
+	if offset > int64(len(blob.data)) {
+		return fmt.Errorf("offset %d is beyond the size of blob %s", offset, name)
+	}
+	copy(b, blob.data[offset:])
+	return nil
+}
+
+// Put stores a copy of data as the content of the blob
+func (m *MemStorage) Put(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.store(name, append([]byte(nil), data...), metadata)
+	sum := md5.Sum(data)
+	m.blobs[name].contentMD5 = sum[:]
+	delete(m.blocks, name)
+	return nil
+}
+
+// StageBlock keeps a copy of data as a block of the blob
+func (m *MemStorage) StageBlock(ctx context.Context, name string, blockID string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.blocks[name] == nil {
+		m.blocks[name] = make(map[string][]byte)
+	}
+	m.blocks[name][blockID] = append([]byte(nil), data...)
+	return nil
+}
+
+// CommitBlocks replaces the content of the blob with the listed blocks
+func (m *MemStorage) CommitBlocks(ctx context.Context, name string, blockIDs []string, metadata map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+	var data []byte
+	committed := make(map[string][]byte, len(blockIDs))
+	for _, id := range blockIDs {
+		block, exists := m.blocks[name][id]
+		if !exists {
+			return fmt.Errorf("block %s of blob %s is not staged", id, name)
+		}
+		data = append(data, block...)
+		committed[id] = block
+	}
+	m.store(name, data, metadata)
+	// Uncommitted blocks are discarded, like the Blob service does
+	m.blocks[name] = committed
+	return nil
+}
+
+// Delete removes the blob
+func (m *MemStorage) Delete(ctx context.Context, name string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, exists := m.blobs[name]; !exists {
+		return ErrBlobNotFound
+	}
+	delete(m.blobs, name)
+	delete(m.blocks, name)
+	return nil
+}
+
+// Copy creates dst with the content and metadata of src
+func (m *MemStorage) Copy(ctx context.Context, src string, dst string) error {
+	m.Lock()
+	defer m.Unlock()
+	blob, exists := m.blobs[src]
+	if !exists {
+		return ErrBlobNotFound
+	}
+	m.store(dst, append([]byte(nil), blob.data...), blob.metadata)
+	m.blobs[dst].contentMD5 = blob.contentMD5
+	return nil
+}
+
+// GetProperties returns the properties and metadata of the blob
+func (m *MemStorage) GetProperties(ctx context.Context, name string) (BlobAttr, error) {
+	m.RLock()
+	defer m.RUnlock()
+	blob, exists := m.blobs[name]
+	if !exists {
+		return BlobAttr{}, ErrBlobNotFound
+	}
+	attr := m.attr(name, blob)
+	attr.ContentMD5 = blob.contentMD5
+	return attr, nil
+}
+
+// SetMetadata replaces the metadata of the blob
+func (m *MemStorage) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+	blob, exists := m.blobs[name]
+	if !exists {
+		return ErrBlobNotFound
+	}
+	m.store(name, blob.data, metadata)
+	m.blobs[name].contentMD5 = blob.contentMD5
+	return nil
+}
+
+// copyMetadata returns a copy of metadata which can be modified by the caller
+func copyMetadata(metadata map[string]string) map[string]string {
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Metadata keys persisting the attributes set by chmod, chown and touch, the mode in octal
+// including the setuid, setgid and sticky bits and the mtime in RFC 3339 with nanoseconds
+const (
+	metadataMode  = "mode"
+	metadataUID   = "uid"
+	metadataGID   = "gid"
+	metadataMtime = "mtime"
+)
+
+// Prefixes of the metadata keys holding user xattrs whose names are not valid metadata keys, escaped
+// with _XX for each byte other than letters and digits, and of those holding values in base64
+const (
+	metadataXattrPrefix       = "xattr_"
+	metadataXattrBase64Prefix = "xattrb64_"
+)
+
+// Unix mode bits beyond the permissions
+const (
+	unixSetuid = 0o4000
+	unixSetgid = 0o2000
+	unixSticky = 0o1000
+)
+
+// metadataValue returns the value of the metadata key, whatever the case the service returned it in
+func metadataValue(metadata map[string]string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// setMetadataValue replaces the value of the metadata key, whatever the case it was stored in
+func setMetadataValue(metadata map[string]string, key string, value string) {
+	deleteMetadataValue(metadata, key)
+	metadata[key] = value
+}
+
+// deleteMetadataValue removes the metadata key, whatever the case it was stored in
+func deleteMetadataValue(metadata map[string]string, key string) {
+	for k := range metadata {
+		if strings.EqualFold(k, key) {
+			delete(metadata, k)
+		}
+	}
+}
+
+// metadataAttr applies the attributes persisted in the metadata of a blob to attr, the values which
+// are missing or invalid keep the defaults of attr
+func metadataAttr(attr *fuse.Attr, metadata map[string]string) {
+	if value, ok := metadataValue(metadata, metadataMode); ok {
+		if mode, err := strconv.ParseUint(value, 8, 32); err == nil && mode <= 0o7777 {
+			attr.Mode = attr.Mode&os.ModeType | unixToFileMode(uint32(mode))
+		}
+	}
+	if value, ok := metadataValue(metadata, metadataUID); ok {
+		if uid, err := strconv.ParseUint(value, 10, 32); err == nil {
+			attr.Uid = uint32(uid)
+		}
+	}
+	if value, ok := metadataValue(metadata, metadataGID); ok {
+		if gid, err := strconv.ParseUint(value, 10, 32); err == nil {
+			attr.Gid = uint32(gid)
+		}
+	}
+	if value, ok := metadataValue(metadata, metadataMtime); ok {
+		if mtime, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			attr.Mtime = mtime
+		}
+	}
+}
+
+// setMetadataAttr records the attributes of attr which req changes in metadata
+func setMetadataAttr(metadata map[string]string, attr fuse.Attr, req *fuse.SetattrRequest) {
+	if req.Valid.Mode() {
+		setMetadataValue(metadata, metadataMode, "0"+strconv.FormatUint(uint64(fileModeToUnix(attr.Mode)), 8))
+	}
+	if req.Valid.Uid() {
+		setMetadataValue(metadata, metadataUID, strconv.FormatUint(uint64(attr.Uid), 10))
+	}
+	if req.Valid.Gid() {
+		setMetadataValue(metadata, metadataGID, strconv.FormatUint(uint64(attr.Gid), 10))
+	}
+	if req.Valid.Mtime() || req.Valid.MtimeNow() {
+		setMetadataValue(metadata, metadataMtime, attr.Mtime.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// applySetattr applies the mode, owner and times changed by req to attr
+func applySetattr(attr *fuse.Attr, req *fuse.SetattrRequest) {
+	if req.Valid.Mode() {
+		attr.Mode = attr.Mode&os.ModeType | req.Mode&^os.ModeType
+	}
+	if req.Valid.Uid() {
+		attr.Uid = req.Uid
+	}
+	if req.Valid.Gid() {
+		attr.Gid = req.Gid
+	}
+	if req.Valid.Atime() {
+		attr.Atime = req.Atime
+	}
+	if req.Valid.AtimeNow() {
+		attr.Atime = time.Now()
+	}
+	if req.Valid.Mtime() {
+		attr.Mtime = req.Mtime
+	}
+	if req.Valid.MtimeNow() {
+		attr.Mtime = time.Now()
+	}
+}
+
+// persistsAttr tells whether req changes attributes kept in the metadata
+func persistsAttr(req *fuse.SetattrRequest) bool {
+	return req.Valid.Mode() || req.Valid.Uid() || req.Valid.Gid() || req.Valid.Mtime() || req.Valid.MtimeNow()
+}
+
+// unixToFileMode converts the permission and special bits of a Unix mode
+func unixToFileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0o777)
+	if mode&unixSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&unixSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&unixSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// fileModeToUnix converts the permission and special bits of a file mode
+func fileModeToUnix(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unixSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unixSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unixSticky
+	}
+	return m
+}
+
+// metadataXattrKey returns the metadata key holding the user xattr name, without its "user." prefix.
+// Names which are C# identifiers are used as they are unless they clash with the keys of the file
+// system, values which cannot be sent in an HTTP header are kept in base64.
+func metadataXattrKey(name string, value []byte) string {
+	if !isHeaderValue(value) {
+		return metadataXattrBase64Prefix + escapeXattrName(name)
+	}
+	if isIdentifier(name) && !isReservedMetadataKey(name) {
+		return name
+	}
+	return metadataXattrPrefix + escapeXattrName(name)
+}
+
+// decodeMetadataXattr returns the name and the value of the user xattr held by a metadata key, ok
+// is false for the keys of the file system
+func decodeMetadataXattr(key string, value string) (name string, xattr []byte, ok bool) {
+	switch lower := strings.ToLower(key); {
+	case strings.HasPrefix(lower, metadataXattrBase64Prefix):
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", nil, false
+		}
+		name, err := unescapeXattrName(key[len(metadataXattrBase64Prefix):])
+		return name, decoded, err == nil
+	case strings.HasPrefix(lower, metadataXattrPrefix):
+		name, err := unescapeXattrName(key[len(metadataXattrPrefix):])
+		return name, []byte(value), err == nil
+	case isReservedMetadataKey(key):
+		return "", nil, false
+	}
+	return key, []byte(value), true
+}
+
+// encodeMetadataXattr returns the metadata value holding the value of a user xattr
+func encodeMetadataXattr(value []byte) string {
+	if !isHeaderValue(value) {
+		return base64.StdEncoding.EncodeToString(value)
+	}
+	return string(value)
+}
+
+// userXattr returns the value of the user xattr name kept in metadata. Names are case insensitive
+// like metadata keys.
+func userXattr(metadata map[string]string, name string) ([]byte, bool) {
+	for k, v := range metadata {
+		if n, value, ok := decodeMetadataXattr(k, v); ok && strings.EqualFold(n, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// setUserXattr keeps the user xattr name in metadata, or removes it when value is nil. It tells
+// whether the xattr existed.
+func setUserXattr(metadata map[string]string, name string, value []byte) bool {
+	existed := false
+	for k, v := range metadata {
+		if n, _, ok := decodeMetadataXattr(k, v); ok && strings.EqualFold(n, name) {
+			delete(metadata, k)
+			existed = true
+		}
+	}
+	if value != nil {
+		metadata[metadataXattrKey(name, value)] = encodeMetadataXattr(value)
+	}
+	return existed
+}
+
+// userXattrNames returns the names of the user xattrs kept in metadata, without their "user." prefix
+func userXattrNames(metadata map[string]string) []string {
+	var names []string
+	for k, v := range metadata {
+		if n, _, ok := decodeMetadataXattr(k, v); ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isReservedMetadataKey tells whether the key is one of the metadata keys of the file system
+func isReservedMetadataKey(key string) bool {
+	lower := strings.ToLower(key)
+	switch lower {
+	case metadataMode, metadataUID, metadataGID, metadataMtime, "hdi_isfolder":
+		return true
+	}
+	return strings.HasPrefix(lower, metadataXattrPrefix) || strings.HasPrefix(lower, metadataXattrBase64Prefix)
+}
+
+// isIdentifier tells whether s is an ASCII C# identifier, which the service accepts as a metadata key
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && !isASCIILetter(c) && (i == 0 || !isASCIIDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isHeaderValue tells whether value is sent unchanged as the value of an HTTP header, which excludes
+// control characters, non-ASCII bytes and leading or trailing spaces
+func isHeaderValue(value []byte) bool {
+	for _, c := range value {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return len(value) == 0 || (value[0] != ' ' && value[len(value)-1] != ' ')
+}
+
+// escapeXattrName escapes the bytes of name which are not ASCII letters or digits as _XX
+func escapeXattrName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; isASCIILetter(c) || isASCIIDigit(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeXattrName reverses escapeXattrName
+func unescapeXattrName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '_' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated escape in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("empty name")
+	}
+	return b.String(), nil
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isASCIIDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+func TestAttributesSurviveRemount(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		filesys := NewFS(store)
+		n, _, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "build.log", Mode: 0o666, Umask: 0o022}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		f := n.(*File)
+		if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("ok")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		mtime := time.Date(2020, 2, 29, 12, 30, 0, 123456789, time.UTC)
+		err = f.Setattr(ctx, &fuse.SetattrRequest{
+			Valid: fuse.SetattrMode | fuse.SetattrUid | fuse.SetattrGid | fuse.SetattrMtime,
+			Mode:  os.ModeSetgid | 0o750, Uid: 1234, Gid: 5678, Mtime: mtime,
+		}, &fuse.SetattrResponse{})
+		if err != nil {
+			t.Fatalf("Setattr: %v", err)
+		}
+		releaseFile(t, f)
+
+		attr := lookupFile(t, NewFS(store), "build.log").attr
+		if attr.Mode != os.ModeSetgid|0o750 || attr.Uid != 1234 || attr.Gid != 5678 || !attr.Mtime.Equal(mtime) {
+			t.Errorf("after remount the file has mode %v, owner %d:%d and mtime %v", attr.Mode, attr.Uid, attr.Gid, attr.Mtime)
+		}
+
+		// Opening leaves the attributes loaded from the blob
+		f = lookupFile(t, NewFS(store), "build.log")
+		openFile(t, f)
+		if !f.attr.Mtime.Equal(mtime) {
+			t.Errorf("after open the file has mtime %v, want %v", f.attr.Mtime, mtime)
+		}
+		releaseFile(t, f)
+
+		// Writing replaces the mtime set by touch
+		f = lookupFile(t, NewFS(store), "build.log")
+		openFile(t, f)
+		if err := f.Write(ctx, &fuse.WriteRequest{Offset: 2, Data: []byte("!")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		releaseFile(t, f)
+		attr = lookupFile(t, NewFS(store), "build.log").attr
+		if attr.Mtime.Before(time.Now().Add(-time.Minute)) || attr.Mode != os.ModeSetgid|0o750 {
+			t.Errorf("after a write the file has mode %v and mtime %v", attr.Mode, attr.Mtime)
+		}
+	})
+}
+
+func TestCreatedFilesKeepTheirMode(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	filesys := NewFS(store)
+	if _, _, err := filesys.root.Create(ctx, &fuse.CreateRequest{Name: "run.sh", Mode: 0o777, Umask: 0o027}, &fuse.CreateResponse{}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := filesys.root.Mkdir(ctx, &fuse.MkdirRequest{Name: "bin", Mode: 0o777, Umask: 0o077}); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	store.Put(ctx, "plain", nil, nil)
+	store.Put(ctx, "odd", nil, map[string]string{"Mode": "rwx", "uid": "-1", "mtime": "yesterday"})
+
+	remounted := NewFS(store)
+	for name, want := range map[string]os.FileMode{"run.sh": 0o750, "plain": DefaultFileMode, "odd": DefaultFileMode} {
+		if f := lookupFile(t, remounted, name); f.attr.Mode != want || f.attr.Uid != uint32(UID) {
+			t.Errorf("%s has mode %v and uid %d, want %v and %d", name, f.attr.Mode, f.attr.Uid, want, UID)
+		}
+	}
+	n, _ := remounted.root.Lookup(ctx, "bin")
+	if mode := n.(*Dir).attr.Mode; mode != os.ModeDir|0o700 {
+		t.Errorf("bin has mode %v, want drwx------", mode)
+	}
+}
+
+func TestChmodOfVirtualDirectoryCreatesMarker(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	store.Put(ctx, "data/a.csv", []byte("a"), nil)
+	filesys := NewFS(store)
+	readDirNames(t, filesys.root)
+	n, _ := filesys.root.Lookup(ctx, "data")
+
+	if err := n.(*Dir).Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: os.ModeDir | 0o700}, &fuse.SetattrResponse{}); err != nil {
+		t.Fatalf("Setattr: %v", err)
+	}
+	blob, err := store.GetProperties(ctx, "data")
+	if err != nil || !isDirBlob(blob) || blob.Metadata[metadataMode] != "0700" {
+		t.Fatalf("marker of chmod directory is %+v, %v", blob, err)
+	}
+	remounted := NewFS(store)
+	readDirNames(t, remounted.root)
+	n, _ = remounted.root.Lookup(ctx, "data")
+	if mode := n.(*Dir).attr.Mode; mode != os.ModeDir|0o700 {
+		t.Errorf("after remount data has mode %v", mode)
+	}
+}
+
+func TestUnixModeConversion(t *testing.T) {
+	for unix, mode := range map[uint32]os.FileMode{
+		0o644:  0o644,
+		0o4755: os.ModeSetuid | 0o755,
+		0o2750: os.ModeSetgid | 0o750,
+		0o1777: os.ModeSticky | 0o777,
+	} {
+		if got := unixToFileMode(unix); got != mode {
+			t.Errorf("unixToFileMode(%o) = %v, want %v", unix, got, mode)
+		}
+		if got := fileModeToUnix(mode); got != unix {
+			t.Errorf("fileModeToUnix(%v) = %o, want %o", mode, got, unix)
+		}
+	}
+}
+
+func TestMetadataXattrKey(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		value string
+		key   string
+	}{
+		{"provenance", "job-42", "provenance"},
+		{"Build_ID", "7", "Build_ID"},
+		{"pipeline.run", "7", "xattr_pipeline_2erun"},
+		{"2nd", "x", "xattr_2nd"},
+		{"mode", "0644", "xattr_mode"},
+		{"xattr_a", "x", "xattr_xattr_5fa"},
+		{"digest", "\x00\xff", "xattrb64_digest"},
+		{"note", " padded ", "xattrb64_note"},
+	} {
+		key := metadataXattrKey(tc.name, []byte(tc.value))
+		if key != tc.key {
+			t.Errorf("metadataXattrKey(%q, %q) = %q, want %q", tc.name, tc.value, key, tc.key)
+		}
+		name, value, ok := decodeMetadataXattr(key, encodeMetadataXattr([]byte(tc.value)))
+		if !ok || name != tc.name || string(value) != tc.value {
+			t.Errorf("decodeMetadataXattr of %q returned %q, %q, %v", key, name, value, ok)
+		}
+	}
+	for _, key := range []string{"Mode", "hdi_isFolder", "xattr_a_2", "xattr_a_zz"} {
+		if name, _, ok := decodeMetadataXattr(key, "x"); ok {
+			t.Errorf("decodeMetadataXattr(%q) returned the xattr %q", key, name)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	// storageResource is the Azure AD resource of Azure Storage
+	storageResource = "https://storage.azure.com/"
+
+	// defaultAADEndpoint is the authority used to authenticate service principals
+	defaultAADEndpoint = "https://login.microsoftonline.com"
+
+	// defaultIMDSEndpoint is the token endpoint of the Azure Instance Metadata Service
+	defaultIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// tokenRefreshMargin is how long before expiry a token gets renewed
+	tokenRefreshMargin = 5 * time.Minute
+
+	// tokenRetryInterval is the delay before retrying a failed token refresh
+	tokenRetryInterval = 30 * time.Second
+
+	// tokenFilePollInterval is how often a token file without expiry claim is re-read
+	tokenFilePollInterval = 5 * time.Minute
+)
+
+// oauthToken is an access token along with the time it expires
+type oauthToken struct {
+	AccessToken string
+	ExpiresOn   time.Time
+}
+
+// tokenFetcher obtains a new access token for Azure Storage
+type tokenFetcher func() (oauthToken, error)
+
+// tokenHTTPClient is used for the requests to the token endpoints
+var tokenHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// newTokenCredential fetches the initial token and returns a credential which renews
+// it in the background before it expires
+func newTokenCredential(fetch tokenFetcher) (azblob.TokenCredential, error) {
+	token, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Access token acquired, expires in %s", expiresIn(token))
+	initial := true
+	return azblob.NewTokenCredential(token.AccessToken, func(credential azblob.TokenCredential) time.Duration {
+		if initial {
+			// azblob invokes the refresher right away, the initial token is still fresh
+			initial = false
+			return refreshAfter(token.ExpiresOn, time.Now())
+		}
+		token, err := fetch()
+		if err != nil {
+			log.Printf("Error in refreshing access token, retrying in %v: %v", tokenRetryInterval, err)
+			return tokenRetryInterval
+		}
+		credential.SetToken(token.AccessToken)
+		return refreshAfter(token.ExpiresOn, time.Now())
+	}), nil
+}
+
+// refreshAfter returns the delay after which a token expiring at expiresOn must be renewed
+func refreshAfter(expiresOn time.Time, now time.Time) time.Duration {
+	if expiresOn.IsZero() {
+		return tokenFilePollInterval
+	}
+	d := expiresOn.Sub(now) - tokenRefreshMargin
+	if d < tokenRetryInterval {
+		return tokenRetryInterval
+	}
+	return d
+}
+
+// tokenResponse is the JSON body returned by Azure AD and IMDS, IMDS encodes the numbers as strings
+type tokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+	ExpiresOn   json.Number `json:"expires_on"`
+	Error       string      `json:"error"`
+	Description string      `json:"error_description"`
+}
+
+// doTokenRequest sends req and parses the token from the response
+func doTokenRequest(req *http.Request) (oauthToken, error) {
+	resp, err := tokenHTTPClient.Do(req)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return oauthToken{}, fmt.Errorf("invalid response from %s (%s): %v", req.URL.Host, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		return oauthToken{}, fmt.Errorf("token request to %s failed (%s): %s %s", req.URL.Host, resp.Status, tr.Error, tr.Description)
+	}
+
+	token := oauthToken{AccessToken: tr.AccessToken}
+	if on, err := tr.ExpiresOn.Int64(); err == nil && on > 0 {
+		token.ExpiresOn = time.Unix(on, 0)
+	} else if in, err := tr.ExpiresIn.Int64(); err == nil && in > 0 {
+		token.ExpiresOn = time.Now().Add(time.Duration(in) * time.Second)
+	}
+	return token, nil
+}
+
+// servicePrincipalToken returns a fetcher authenticating a service principal with a client secret
+// or, when certPath is set, with a client assertion signed by the certificate
+func servicePrincipalToken(aadEndpoint string, tenantID string, clientID string, clientSecret string, certPath string) (tokenFetcher, error) {
+	if tenantID == "" || clientID == "" {
+		return nil, errors.New("service principal authentication requires --tenantId and --clientId")
+	}
+	if (clientSecret == "") == (certPath == "") {
+		return nil, errors.New("service principal authentication requires exactly one of a client secret and --clientCertPath")
+	}
+	if aadEndpoint == "" {
+		aadEndpoint = defaultAADEndpoint
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(aadEndpoint, "/"), url.PathEscape(tenantID))
+
+	var cert *x509.Certificate
+	var key *rsa.PrivateKey
+	if certPath != "" {
+		var err error
+		if cert, key, err = loadClientCertificate(certPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() (oauthToken, error) {
+		form := url.Values{
+			"grant_type": {"client_credentials"},
+			"client_id":  {clientID},
+			"scope":      {storageResource + ".default"},
+		}
+		if cert != nil {
+			assertion, err := clientAssertion(tokenURL, clientID, cert, key)
+			if err != nil {
+				return oauthToken{}, err
+			}
+			form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+			form.Set("client_assertion", assertion)
+		} else {
+			form.Set("client_secret", clientSecret)
+		}
+		req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return oauthToken{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return doTokenRequest(req)
+	}, nil
+}
+
+// managedIdentityToken returns a fetcher obtaining tokens from IMDS, clientID selects a user assigned identity
+func managedIdentityToken(imdsEndpoint string, clientID string) tokenFetcher {
+	if imdsEndpoint == "" {
+		imdsEndpoint = defaultIMDSEndpoint
+	}
+	return func() (oauthToken, error) {
+		req, err := http.NewRequest(http.MethodGet, imdsEndpoint, nil)
+		if err != nil {
+			return oauthToken{}, err
+		}
+		q := req.URL.Query()
+		q.Set("api-version", "2018-02-01")
+		q.Set("resource", storageResource)
+		if clientID != "" {
+			q.Set("client_id", clientID)
+		}
+		req.URL.RawQuery = q.Encode()
+		req.Header.Set("Metadata", "true")
+		return doTokenRequest(req)
+	}
+}
+
+// tokenFileToken returns a fetcher reading a bearer token which is kept up to date by another process
+func tokenFileToken(path string) tokenFetcher {
+	return func() (oauthToken, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return oauthToken{}, err
+		}
+		token := oauthToken{AccessToken: strings.TrimSpace(string(data))}
+		if token.AccessToken == "" {
+			return oauthToken{}, fmt.Errorf("token file %s is empty", path)
+		}
+		token.ExpiresOn = jwtExpiry(token.AccessToken)
+		return token, nil
+	}
+}
+
+// jwtExpiry returns the exp claim of a JWT, or the zero time if it cannot be read
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}
+	}
+	exp, err := claims.Exp.Int64()
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(exp, 0)
+}
+
+// loadClientCertificate reads a PEM file holding the certificate and RSA private key of a service principal
+func loadClientCertificate(path string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cert *x509.Certificate
+	var key *rsa.PrivateKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert == nil {
+				if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, nil, fmt.Errorf("invalid certificate in %s: %v", path, err)
+				}
+			}
+		case "RSA PRIVATE KEY":
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+			}
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+			}
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				return nil, nil, fmt.Errorf("private key in %s is not an RSA key", path)
+			}
+		}
+	}
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("%s must contain a PEM certificate and its RSA private key", path)
+	}
+	return cert, key, nil
+}
+
+// clientAssertion builds the signed JWT proving possession of the service principal certificate
+func clientAssertion(tokenURL string, clientID string, cert *x509.Certificate, key *rsa.PrivateKey) (string, error) {
+	thumbprint := sha1.Sum(cert.Raw)
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": tokenURL,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// expiresIn formats the remaining lifetime of a token for logging
+func expiresIn(token oauthToken) string {
+	if token.ExpiresOn.IsZero() {
+		return "unknown"
+	}
+	return strconv.Itoa(int(time.Until(token.ExpiresOn).Minutes())) + "m"
+}
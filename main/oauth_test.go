@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self signed certificate and its key as PEM and returns the path and key
+func writeTestCertificate(t *testing.T) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "blobfuse-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	path := filepath.Join(t.TempDir(), "spn.pem")
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func TestServicePrincipalSecret(t *testing.T) {
+	aad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" || r.Form.Get("client_id") != "app" ||
+			r.Form.Get("client_secret") != "secret" || r.Form.Get("scope") != "https://storage.azure.com/.default" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client","error_description":"bad credentials"}`)
+			return
+		}
+		fmt.Fprint(w, `{"token_type":"Bearer","expires_in":3599,"access_token":"spn-token"}`)
+	}))
+	defer aad.Close()
+
+	fetch, err := servicePrincipalToken(aad.URL, "tenant", "app", "secret", "")
+	if err != nil {
+		t.Fatalf("servicePrincipalToken: %v", err)
+	}
+	token, err := fetch()
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if token.AccessToken != "spn-token" || time.Until(token.ExpiresOn) < 59*time.Minute {
+		t.Errorf("token is %+v", token)
+	}
+
+	fetch, _ = servicePrincipalToken(aad.URL, "tenant", "app", "wrong", "")
+	if _, err := fetch(); err == nil || !strings.Contains(err.Error(), "bad credentials") {
+		t.Errorf("fetch with wrong secret returned %v", err)
+	}
+	if _, err := servicePrincipalToken(aad.URL, "tenant", "app", "", ""); err == nil {
+		t.Errorf("servicePrincipalToken accepted neither secret nor certificate")
+	}
+}
+
+func TestServicePrincipalCertificate(t *testing.T) {
+	certPath, key := writeTestCertificate(t)
+	aad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("client_assertion"), ".")
+		if len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"expires_in":3599,"access_token":"cert-token"}`)
+	}))
+	defer aad.Close()
+
+	fetch, err := servicePrincipalToken(aad.URL, "tenant", "app", "", certPath)
+	if err != nil {
+		t.Fatalf("servicePrincipalToken: %v", err)
+	}
+	if token, err := fetch(); err != nil || token.AccessToken != "cert-token" {
+		t.Errorf("fetch returned %+v, %v", token, err)
+	}
+}
+
+func TestManagedIdentity(t *testing.T) {
+	expiresOn := time.Now().Add(time.Hour).Unix()
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Header.Get("Metadata") != "true" || q.Get("resource") != storageResource || q.Get("client_id") != "identity" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request"}`)
+			return
+		}
+		// IMDS returns the numbers as strings
+		fmt.Fprintf(w, `{"access_token":"msi-token","expires_in":"3599","expires_on":"%d"}`, expiresOn)
+	}))
+	defer imds.Close()
+
+	token, err := managedIdentityToken(imds.URL+"/metadata/identity/oauth2/token", "identity")()
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if token.AccessToken != "msi-token" || token.ExpiresOn.Unix() != expiresOn {
+		t.Errorf("token is %+v", token)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	exp := time.Now().Add(2 * time.Hour).Unix()
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":"https://storage.azure.com/","exp":%d}`, exp)))
+	jwt := "eyJhbGciOiJub25lIn0." + claims + ".c2ln"
+	path := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(path, []byte(jwt+"\n"), 0o600)
+
+	token, err := tokenFileToken(path)()
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if token.AccessToken != jwt || token.ExpiresOn.Unix() != exp {
+		t.Errorf("token is %+v", token)
+	}
+
+	ioutil.WriteFile(path, []byte("opaque-token"), 0o600)
+	if token, err := tokenFileToken(path)(); err != nil || !token.ExpiresOn.IsZero() {
+		t.Errorf("opaque token returned %+v, %v", token, err)
+	}
+}
+
+func TestRefreshAfter(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		expiresOn time.Time
+		want      time.Duration
+	}{
+		{now.Add(time.Hour), 55 * time.Minute},
+		{now.Add(time.Minute), tokenRetryInterval},
+		{time.Time{}, tokenFilePollInterval},
+	} {
+		if got := refreshAfter(tc.expiresOn, now); got != tc.want {
+			t.Errorf("refreshAfter(%v) = %v, want %v", tc.expiresOn, got, tc.want)
+		}
+	}
+}
+
+func TestNewTokenCredential(t *testing.T) {
+	calls := 0
+	credential, err := newTokenCredential(func() (oauthToken, error) {
+		calls++
+		return oauthToken{AccessToken: fmt.Sprintf("token-%d", calls), ExpiresOn: time.Now().Add(time.Hour)}, nil
+	})
+	if err != nil {
+		t.Fatalf("newTokenCredential: %v", err)
+	}
+	if calls != 1 || credential.Token() != "token-1" {
+		t.Errorf("credential holds %q after %d fetches", credential.Token(), calls)
+	}
+
+	if _, err := newTokenCredential(func() (oauthToken, error) {
+		return oauthToken{}, fmt.Errorf("unreachable")
+	}); err == nil {
+		t.Errorf("newTokenCredential succeeded when the initial fetch failed")
+	}
+}
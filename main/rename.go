@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Values of RenameRecovery
+const (
+	renameRecoveryRollback = "rollback"
+	renameRecoveryResume   = "resume"
+)
+
+// renameProgressInterval is how often the progress of a directory rename is logged
+const renameProgressInterval = 5 * time.Second
+
+// Lines of a rename journal following the header
+const (
+	journalCopied  = "copied"
+	journalCommit  = "commit"
+	journalDeleted = "deleted"
+)
+
+// slashMarker is the relative name in a rename journal of the marker blob named like the directory with a trailing "/"
+const slashMarker = "/"
+
+// renameHeader is the first line of a rename journal. It lists the blobs to move, by their names
+// relative to Src, the empty name standing for the marker blob of the directory.
+type renameHeader struct {
+	Account          string
+	Container        string
+	Src              string // prefix of the source directory, ending with "/"
+	Dst              string // prefix of the destination directory, ending with "/"
+	Blobs            []string
+	DstMarkerExisted bool // the destination was an empty directory, its marker is kept on rollback
+}
+
+// names returns the source and destination blob names of a blob of the rename
+func (h *renameHeader) names(rel string) (string, string) {
+	if rel == slashMarker {
+		return h.Src, h.Dst
+	}
+	if rel == "" {
+		return strings.TrimSuffix(h.Src, "/"), strings.TrimSuffix(h.Dst, "/")
+	}
+	return h.Src + rel, h.Dst + rel
+}
+
+// renameJournal records the progress of a directory rename on local disk, so that a rename
+// interrupted by a crash is finished or undone on the next mount. After the header it holds
+// a "copied" line per copied blob, a "commit" line once every blob is copied and a "deleted"
+// line per deleted source. Only the header and the commit are synced, lost lines are redone.
+// A nil journal records nothing.
+type renameJournal struct {
+	sync.Mutex
+	file *os.File
+}
+
+// createJournal writes the header of a new journal in dir
+func createJournal(dir string, h *renameHeader) (*renameJournal, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	file, err := ioutil.TempFile(dir, "rename-*.journal")
+	if err != nil {
+		return nil, err
+	}
+	j := &renameJournal{file: file}
+	header, _ := json.Marshal(h)
+	if _, err := fmt.Fprintf(file, "%s\n", header); err != nil {
+		j.remove()
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		j.remove()
+		return nil, err
+	}
+	return j, nil
+}
+
+// record appends a line for the blob rel
+func (j *renameJournal) record(action string, rel string) {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	if _, err := fmt.Fprintf(j.file, "%s %s\n", action, strconv.Quote(rel)); err != nil {
+		log.Printf("Error in writing rename journal %s: %v", j.file.Name(), err)
+	}
+}
+
+// commit records that every blob was copied, from then on the rename is finished rather than undone
+func (j *renameJournal) commit() error {
+	if j == nil {
+		return nil
+	}
+	j.Lock()
+	defer j.Unlock()
+	if _, err := fmt.Fprintf(j.file, "%s\n", journalCommit); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// remove deletes the journal of a rename which is finished or undone
+func (j *renameJournal) remove() {
+	if j == nil {
+		return
+	}
+	j.file.Close()
+	if err := os.Remove(j.file.Name()); err != nil {
+		log.Printf("Error in removing rename journal: %v", err)
+	}
+}
+
+// readJournal parses the journal at path
+func readJournal(path string) (h renameHeader, copied map[string]bool, committed bool, deleted map[string]bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return h, nil, false, nil, err
+	}
+	defer file.Close()
+	copied, deleted = make(map[string]bool), make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<30)
+	if !scanner.Scan() {
+		return h, nil, false, nil, fmt.Errorf("%s has no header", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+		return h, nil, false, nil, fmt.Errorf("invalid header in %s: %v", path, err)
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == journalCommit {
+			committed = true
+			continue
+		}
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			// A line cut short by a crash
+			continue
+		}
+		rel, err := strconv.Unquote(line[i+1:])
+		if err != nil {
+			continue
+		}
+		switch line[:i] {
+		case journalCopied:
+			copied[rel] = true
+		case journalDeleted:
+			deleted[rel] = true
+		}
+	}
+	return h, copied, committed, deleted, scanner.Err()
+}
+
+// defaultJournalPath is the directory rename journals are kept in unless configured otherwise
+func defaultJournalPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "blobfuse-go-journal")
+	}
+	return filepath.Join(home, ".blobfuse-go", "journal")
+}
+
+// renameHierarchical renames the directory src to dst, both ending with "/", with a single request.
+// The service only moves onto a new path, an empty directory at dst is deleted and the rename tried
+// again like rename(2) replaces it. dst is created back when that second rename fails.
+func renameHierarchical(ctx context.Context, hs HierarchicalStorage, src string, dst string) error {
+	src, dst = strings.TrimSuffix(src, "/"), strings.TrimSuffix(dst, "/")
+	err := hs.Rename(ctx, src, dst)
+	if err != nil && toErrno(err) == fuse.EEXIST {
+		mode := DefaultDirMode
+		if ac, err := hs.GetAccessControl(ctx, dst); err == nil {
+			if perm, ok := parsePermissions(ac.Permissions); ok {
+				mode = perm
+			}
+		}
+		if err := hs.DeleteDirectory(ctx, dst); err != nil && !isNotFound(err) {
+			log.Printf("Error in replacing directory %s: %v", dst, err)
+			return toErrno(err)
+		}
+		if err = hs.Rename(ctx, src, dst); err != nil {
+			if err := hs.CreateDirectory(ctx, dst, mode); err != nil {
+				log.Printf("Error in creating back directory %s: %v", dst, err)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error in renaming %s to %s: %v", src, dst, err)
+		return toErrno(err)
+	}
+	return nil
+}
+
+// renameDir moves every blob below the directory src to dst, both ending with "/". The blobs are
+// copied in parallel and the sources deleted only once all copies succeeded, a failed copy undoes
+// the rename. The progress is journaled for recoverRenames. With a hierarchical namespace the
+// directory is renamed by the service at once instead.
+func (m *FS) renameDir(ctx context.Context, src string, dst string) error {
+	if hs, ok := m.store.(HierarchicalStorage); ok {
+		return renameHierarchical(ctx, hs, src, dst)
+	}
+	existing, err := m.store.ListRecursive(ctx, dst)
+	if err != nil {
+		log.Printf("Error in listing %s: %v", dst, err)
+		return toErrno(err)
+	}
+	h := &renameHeader{Account: AccountName, Container: ContainerName, Src: src, Dst: dst}
+	for _, b := range existing {
+		if !isSlashMarker(b, dst) {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		h.DstMarkerExisted = true
+	}
+	blobs, err := m.store.ListRecursive(ctx, src)
+	if err != nil {
+		log.Printf("Error in listing %s: %v", src, err)
+		return toErrno(err)
+	}
+	for _, b := range blobs {
+		rel := strings.TrimPrefix(b.Name, src)
+		if rel == "" {
+			rel = slashMarker
+		}
+		h.Blobs = append(h.Blobs, rel)
+	}
+	srcMarker, dstMarker := h.names("")
+	if _, err := m.store.GetProperties(ctx, srcMarker); err == nil {
+		h.Blobs = append(h.Blobs, "")
+	}
+	if _, err := m.store.GetProperties(ctx, dstMarker); err == nil {
+		h.DstMarkerExisted = true
+	}
+
+	j, err := createJournal(m.journal, h)
+	if err != nil {
+		log.Printf("Error in creating rename journal: %v", err)
+		return fuse.EIO
+	}
+	return m.runRename(ctx, h, j, nil, nil)
+}
+
+// runRename copies the blobs of the rename which are not in copied yet, then deletes the sources
+// which are not in deleted yet. Without a commit in the journal a failed copy rolls the rename back.
+func (m *FS) runRename(ctx context.Context, h *renameHeader, j *renameJournal, copied map[string]bool, deleted map[string]bool) error {
+	var pending []string
+	for _, rel := range h.Blobs {
+		if !copied[rel] {
+			pending = append(pending, rel)
+		}
+	}
+	var done int64
+	stop := logProgress(func() {
+		log.Printf("Renaming %s to %s: %d of %d blobs copied", h.Src, h.Dst, atomic.LoadInt64(&done), len(pending))
+	})
+	err := forEachParallel(ctx, pending, func(ctx context.Context, rel string) error {
+		src, dst := h.names(rel)
+		if err := m.store.Copy(ctx, src, dst); err != nil {
+			return fmt.Errorf("copy of %s to %s failed: %v", src, dst, err)
+		}
+		j.record(journalCopied, rel)
+		atomic.AddInt64(&done, 1)
+		return nil
+	})
+	stop()
+	if err == nil {
+		err = j.commit()
+	}
+	if err != nil {
+		log.Printf("Error in renaming %s to %s, rolling back: %v", h.Src, h.Dst, err)
+		// The caller may have given up, the rollback must finish anyway
+		if rollbackErr := m.rollbackRename(context.Background(), h); rollbackErr != nil {
+			log.Printf("Error in rolling back rename of %s to %s, it is retried on the next mount: %v", h.Src, h.Dst, rollbackErr)
+			return fuse.EIO
+		}
+		j.remove()
+		return toErrno(err)
+	}
+
+	pending = pending[:0]
+	for _, rel := range h.Blobs {
+		if !deleted[rel] {
+			pending = append(pending, rel)
+		}
+	}
+	atomic.StoreInt64(&done, 0)
+	stop = logProgress(func() {
+		log.Printf("Renaming %s to %s: %d of %d sources deleted", h.Src, h.Dst, atomic.LoadInt64(&done), len(pending))
+	})
+	err = forEachParallel(context.Background(), pending, func(ctx context.Context, rel string) error {
+		src, _ := h.names(rel)
+		if err := m.store.Delete(ctx, src); err != nil && !isNotFound(err) {
+			return fmt.Errorf("delete of %s failed: %v", src, err)
+		}
+		j.record(journalDeleted, rel)
+		atomic.AddInt64(&done, 1)
+		return nil
+	})
+	stop()
+	if err != nil {
+		log.Printf("Error in renaming %s to %s, it is finished on the next mount: %v", h.Src, h.Dst, err)
+		return fuse.EIO
+	}
+	j.remove()
+	log.Printf("Renamed %s to %s, %d blobs moved", h.Src, h.Dst, len(h.Blobs))
+	return nil
+}
+
+// rollbackRename deletes the copies made by a rename which was not committed
+func (m *FS) rollbackRename(ctx context.Context, h *renameHeader) error {
+	return forEachParallel(ctx, h.Blobs, func(ctx context.Context, rel string) error {
+		if (rel == "" || rel == slashMarker) && h.DstMarkerExisted {
+			return nil
+		}
+		_, dst := h.names(rel)
+		if err := m.store.Delete(ctx, dst); err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// recoverRenames finishes or undoes the directory renames of this container left in the journal
+// directory by an earlier mount. Committed renames are finished, the others are rolled back or,
+// with RenameRecovery set to resume, continued.
+func (m *FS) recoverRenames(ctx context.Context) {
+	paths, err := filepath.Glob(filepath.Join(m.journal, "rename-*.journal"))
+	if err != nil {
+		log.Printf("Error in reading rename journals: %v", err)
+		return
+	}
+	for _, path := range paths {
+		h, copied, committed, deleted, err := readJournal(path)
+		if err != nil {
+			log.Printf("Skipping rename journal %s: %v", path, err)
+			continue
+		}
+		if h.Account != AccountName || h.Container != ContainerName {
+			continue
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			log.Printf("Skipping rename journal %s: %v", path, err)
+			continue
+		}
+		j := &renameJournal{file: file}
+		switch {
+		case committed:
+			log.Printf("Finishing interrupted rename of %s to %s", h.Src, h.Dst)
+			m.runRename(ctx, &h, j, allBlobs(h.Blobs), deleted)
+		case strings.ToLower(RenameRecovery) == renameRecoveryResume:
+			log.Printf("Resuming interrupted rename of %s to %s, %d of %d blobs copied", h.Src, h.Dst, len(copied), len(h.Blobs))
+			m.runRename(ctx, &h, j, copied, nil)
+		default:
+			log.Printf("Rolling back interrupted rename of %s to %s", h.Src, h.Dst)
+			if err := m.rollbackRename(ctx, &h); err != nil {
+				log.Printf("Error in rolling back rename of %s to %s: %v", h.Src, h.Dst, err)
+				file.Close()
+				continue
+			}
+			j.remove()
+		}
+	}
+}
+
+// allBlobs returns the set of the given names
+func allBlobs(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// forEachParallel calls do for every name from up to RenameParallelism goroutines.
+// It stops at the first error and returns it.
+func forEachParallel(ctx context.Context, names []string, do func(ctx context.Context, name string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	work := make(chan string)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := uint(0); i < RenameParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				if err := do(ctx, name); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for _, name := range names {
+		select {
+		case work <- name:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// logProgress calls report every renameProgressInterval until the returned function is called
+func logProgress(report func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(renameProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// failingCopy is a Storage whose copies of the listed sources fail
+type failingCopy struct {
+	Storage
+	fail map[string]bool
+}
+
+func (f *failingCopy) Copy(ctx context.Context, src string, dst string) error {
+	if f.fail[src] {
+		return errors.New("copy failed")
+	}
+	return f.Storage.Copy(ctx, src, dst)
+}
+
+// blobNames returns the sorted names of every blob in store
+func blobNames(t *testing.T, store Storage) string {
+	t.Helper()
+	blobs, err := store.ListRecursive(context.Background(), "")
+	if err != nil {
+		t.Fatalf("ListRecursive: %v", err)
+	}
+	var names []string
+	for _, b := range blobs {
+		names = append(names, b.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// putDataset creates the directory data with two files and a subdirectory
+func putDataset(t *testing.T, store Storage) {
+	ctx := context.Background()
+	folder := map[string]string{"hdi_isFolder": "true"}
+	store.Put(ctx, "data", nil, folder)
+	store.Put(ctx, "data/a.csv", []byte("a"), nil)
+	store.Put(ctx, "data/sub", nil, folder)
+	store.Put(ctx, "data/sub/b.csv", []byte("b"), nil)
+	store.Put(ctx, "other.txt", []byte("o"), nil)
+}
+
+// useJournal makes filesys journal renames in a temporary directory and returns it
+func useJournal(t *testing.T, filesys *FS) string {
+	accountName, containerName := AccountName, ContainerName
+	t.Cleanup(func() { AccountName, ContainerName = accountName, containerName })
+	AccountName, ContainerName = "account", "container"
+	filesys.journal = t.TempDir()
+	return filesys.journal
+}
+
+// journals returns the rename journals left in dir
+func journals(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "rename-*.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestRenameDirMovesEveryBlob(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		putDataset(t, store)
+		filesys := NewFS(store)
+		journal := useJournal(t, filesys)
+		readDirNames(t, filesys.root)
+		n, _ := filesys.root.Lookup(ctx, "data")
+		data := n.(*Dir)
+		readDirNames(t, data)
+
+		if err := filesys.root.Rename(ctx, &fuse.RenameRequest{OldName: "data", NewName: "moved"}, filesys.root); err != nil {
+			t.Fatalf("Rename: %v", err)
+		}
+		if got, want := blobNames(t, store), "moved moved/a.csv moved/sub moved/sub/b.csv other.txt"; got != want {
+			t.Errorf("blobs after rename are %q, want %q", got, want)
+		}
+		if data.path != "moved/" {
+			t.Errorf("renamed directory has path %q", data.path)
+		}
+		if a, err := data.Lookup(ctx, "a.csv"); err != nil || a.(*File).path != "moved/a.csv" {
+			t.Errorf("file below renamed directory has path %v, %v", a, err)
+		}
+		if left := journals(t, journal); len(left) != 0 {
+			t.Errorf("journals left after rename: %v", left)
+		}
+	})
+}
+
+func TestRenameDirRollsBackFailedCopy(t *testing.T) {
+	store := NewMemStorage()
+	putDataset(t, store)
+	filesys := NewFS(&failingCopy{Storage: store, fail: map[string]bool{"data/sub/b.csv": true}})
+	journal := useJournal(t, filesys)
+	readDirNames(t, filesys.root)
+
+	err := filesys.root.Rename(context.Background(), &fuse.RenameRequest{OldName: "data", NewName: "moved"}, filesys.root)
+	if err == nil {
+		t.Fatalf("Rename succeeded although a copy failed")
+	}
+	if got, want := blobNames(t, store), "data data/a.csv data/sub data/sub/b.csv other.txt"; got != want {
+		t.Errorf("blobs after failed rename are %q, want %q", got, want)
+	}
+	if left := journals(t, journal); len(left) != 0 {
+		t.Errorf("journals left after rollback: %v", left)
+	}
+}
+
+func TestRenameDirErrors(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	putDataset(t, store)
+	store.Put(ctx, "full/x", []byte("x"), nil)
+	filesys := NewFS(store)
+	useJournal(t, filesys)
+	readDirNames(t, filesys.root)
+	data, _ := filesys.root.Lookup(ctx, "data")
+	readDirNames(t, data.(*Dir))
+
+	for _, tc := range []struct {
+		newDir  *Dir
+		newName string
+		want    syscall.Errno
+	}{
+		{data.(*Dir), "inside", syscall.EINVAL},
+		{filesys.root, "other.txt", syscall.ENOTDIR},
+	} {
+		err := filesys.root.Rename(ctx, &fuse.RenameRequest{OldName: "data", NewName: tc.newName}, tc.newDir)
+		if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != tc.want {
+			t.Errorf("Rename to %s%s returned %v, want %v", tc.newDir.path, tc.newName, err, tc.want)
+		}
+	}
+	if err := filesys.renameDir(ctx, "data/", "full/"); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Errorf("rename onto non-empty directory returned %v", err)
+	}
+	if got, want := blobNames(t, store), "data data/a.csv data/sub data/sub/b.csv full/x other.txt"; got != want {
+		t.Errorf("blobs after failed renames are %q, want %q", got, want)
+	}
+}
+
+// interruptedRename leaves the state of a rename of data to moved which copied a.csv and the marker
+// of data, with the journal committed or not
+func interruptedRename(t *testing.T, store Storage, filesys *FS, committed bool) {
+	ctx := context.Background()
+	h := &renameHeader{
+		Account:   AccountName,
+		Container: ContainerName,
+		Src:       "data/",
+		Dst:       "moved/",
+		Blobs:     []string{"a.csv", "sub", "sub/b.csv", ""},
+	}
+	j, err := createJournal(filesys.journal, h)
+	if err != nil {
+		t.Fatalf("createJournal: %v", err)
+	}
+	for _, rel := range h.Blobs {
+		if !committed && rel != "a.csv" && rel != "" {
+			continue
+		}
+		src, dst := h.names(rel)
+		store.Copy(ctx, src, dst)
+		j.record(journalCopied, rel)
+	}
+	if committed {
+		j.commit()
+		store.Delete(ctx, "data/a.csv")
+		j.record(journalDeleted, "a.csv")
+	}
+	j.file.Close()
+}
+
+func TestRecoverRenames(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		committed bool
+		recovery  string
+		want      string
+	}{
+		{"finish committed", true, renameRecoveryRollback, "moved moved/a.csv moved/sub moved/sub/b.csv other.txt"},
+		{"roll back", false, renameRecoveryRollback, "data data/a.csv data/sub data/sub/b.csv other.txt"},
+		{"resume", false, renameRecoveryResume, "moved moved/a.csv moved/sub moved/sub/b.csv other.txt"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			saved := RenameRecovery
+			defer func() { RenameRecovery = saved }()
+			RenameRecovery = tc.recovery
+
+			store := NewMemStorage()
+			putDataset(t, store)
+			filesys := NewFS(store)
+			journal := useJournal(t, filesys)
+			interruptedRename(t, store, filesys, tc.committed)
+
+			// A journal of another container is left alone
+			other := &renameHeader{Account: "account", Container: "elsewhere", Src: "x/", Dst: "y/"}
+			if _, err := createJournal(journal, other); err != nil {
+				t.Fatal(err)
+			}
+
+			filesys.recoverRenames(context.Background())
+			if got := blobNames(t, store); got != tc.want {
+				t.Errorf("blobs after recovery are %q, want %q", got, tc.want)
+			}
+			if left := journals(t, journal); len(left) != 1 {
+				t.Errorf("journals left after recovery: %v", left)
+			}
+		})
+	}
+}
+
+func TestRenameDirMovesSlashMarker(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	store.Put(ctx, "tool/", nil, nil)
+	store.Put(ctx, "tool/x", []byte("x"), nil)
+	filesys := NewFS(store)
+	useJournal(t, filesys)
+	readDirNames(t, filesys.root)
+
+	if err := filesys.root.Rename(ctx, &fuse.RenameRequest{OldName: "tool", NewName: "moved"}, filesys.root); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if got, want := blobNames(t, store), "moved/ moved/x"; got != want {
+		t.Errorf("blobs after rename are %q, want %q", got, want)
+	}
+}
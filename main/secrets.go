@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Environment variables consulted for the secret of the selected authentication type
+const (
+	envAccountKey   = "AZURE_STORAGE_ACCESS_KEY"
+	envSasToken     = "AZURE_STORAGE_SAS_TOKEN"
+	envClientSecret = "AZURE_CLIENT_SECRET"
+)
+
+// stdin is read when a secret file is given as "-", one line per secret
+var stdin = bufio.NewReader(os.Stdin)
+
+// loadSecrets fills AccountKey, SasToken and ClientSecret from their files,
+// the environment has already been consulted by configure
+func loadSecrets() (err error) {
+	if SasToken, err = loadSecret("sasToken", SasToken, SasTokenFile); err != nil {
+		return err
+	}
+	if AccountKey, err = loadSecret("accountKey", AccountKey, AccountKeyFile); err != nil {
+		return err
+	}
+	if ClientSecret, err = loadSecret("clientSecret", ClientSecret, ClientSecretFile); err != nil {
+		return err
+	}
+
+	for _, secret := range []string{AccountKey, SasToken, ClientSecret} {
+		registerSecret(secret)
+	}
+	return nil
+}
+
+// loadSecret returns the secret called name, given either directly as value or through the file at path
+func loadSecret(name string, value string, path string) (string, error) {
+	if path == "" {
+		if commandLine[name] {
+			log.Printf("Warning: --%s exposes the secret in the process list and shell history, use --%sFile or the environment instead", name, name)
+		}
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("--%s and --%sFile are mutually exclusive", name, name)
+	}
+	secret, err := readSecretFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error in reading --%sFile: %v", name, err)
+	}
+	return secret, nil
+}
+
+// readSecretFile returns the trimmed content of the file at path, or the next line of stdin when path is "-".
+// The file must not be accessible by group or others.
+func readSecretFile(path string) (string, error) {
+	var data []byte
+	if path == "-" {
+		line, err := stdin.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", fmt.Errorf("no secret on stdin: %v", err)
+		}
+		data = []byte(line)
+	} else {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if err := checkSecretFileMode(path, fi); err != nil {
+			return "", err
+		}
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return "", err
+		}
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// checkSecretFileMode rejects secret files readable by other users or owned by someone else
+func checkSecretFileMode(path string, fi os.FileInfo) error {
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if perm := fi.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("%s has permissions %#o, it must not be accessible by group or others (chmod 600)", path, perm)
+	}
+	if s, ok := fi.Sys().(*syscall.Stat_t); ok && int(s.Uid) != os.Getuid() && s.Uid != 0 {
+		return fmt.Errorf("%s is owned by uid %d, it must be owned by the mounting user or root", path, s.Uid)
+	}
+	return nil
+}
+
+var (
+	secretsLock sync.RWMutex
+	secrets     []string
+
+	// secretPattern matches secrets which can show up in URLs, headers and error messages
+	secretPattern = regexp.MustCompile(`(?i)((?:sig|client_secret|client_assertion|access_token|accountkey)=)[^&\s"']+|(Bearer |SharedKey [^:\s]+:)[^\s"']+`)
+)
+
+// registerSecret makes every later log line redact the given value
+func registerSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// redact replaces known secrets, SAS signatures and authorization headers in s
+func redact(s string) string {
+	secretsLock.RLock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, "REDACTED", -1)
+	}
+	secretsLock.RUnlock()
+	return secretPattern.ReplaceAllString(s, "${1}${2}REDACTED")
+}
+
+// redactingWriter redacts secrets from everything written through it, it is used as log output
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	private := filepath.Join(dir, "private")
+	ioutil.WriteFile(private, []byte("c2VjcmV0\n"), 0o600)
+	if secret, err := readSecretFile(private); err != nil || secret != "c2VjcmV0" {
+		t.Errorf("readSecretFile of private file returned %q, %v", secret, err)
+	}
+
+	public := filepath.Join(dir, "public")
+	ioutil.WriteFile(public, []byte("c2VjcmV0"), 0o600)
+	os.Chmod(public, 0o644)
+	if _, err := readSecretFile(public); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+		t.Errorf("readSecretFile of world readable file returned %v", err)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	ioutil.WriteFile(empty, nil, 0o600)
+	if _, err := readSecretFile(empty); err == nil {
+		t.Errorf("readSecretFile of empty file succeeded")
+	}
+}
+
+func TestReadSecretFromStdin(t *testing.T) {
+	saved := stdin
+	defer func() { stdin = saved }()
+	stdin = bufio.NewReader(strings.NewReader("first\nsecond"))
+	for _, want := range []string{"first", "second"} {
+		if secret, err := readSecretFile("-"); err != nil || secret != want {
+			t.Errorf("readSecretFile(-) returned %q, %v, want %q", secret, err, want)
+		}
+	}
+	if _, err := readSecretFile("-"); err == nil {
+		t.Errorf("readSecretFile(-) succeeded on exhausted stdin")
+	}
+}
+
+func TestLoadSecretsMutuallyExclusive(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	useFakeAccount(t, fake)
+	AccountKey, AccountKeyFile = "inline", "somefile"
+	if err := loadSecrets(); err == nil {
+		t.Errorf("loadSecrets accepted both --accountKey and --accountKeyFile")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	registerSecret("bXlhY2NvdW50a2V5")
+	for _, tc := range []struct{ in, want string }{
+		{"key is bXlhY2NvdW50a2V5", "key is REDACTED"},
+		{"GET https://a.blob.core.windows.net/c?sv=2019-12-12&sig=abc%2Bdef&sp=rl", "GET https://a.blob.core.windows.net/c?sv=2019-12-12&sig=REDACTED&sp=rl"},
+		{"Authorization: Bearer eyJ0eXAi.abc.def", "Authorization: Bearer REDACTED"},
+		{"Authorization: SharedKey account:c2lnbmF0dXJl", "Authorization: SharedKey account:REDACTED"},
+		{"client_secret=hunter2&scope=x", "client_secret=REDACTED&scope=x"},
+	} {
+		if got := redact(tc.in); got != tc.want {
+			t.Errorf("redact(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	logger := log.New(redactingWriter{w: &buf}, "", 0)
+	logger.Printf("listing failed: https://a/c?sig=secretsig")
+	if strings.Contains(buf.String(), "secretsig") {
+		t.Errorf("log line was not redacted: %q", buf.String())
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// xattrSnapshot is the time of the snapshot of a file in a snapshot directory, setting it on other
+// files takes a snapshot
+const xattrSnapshot = xattrAzure + "snapshot"
+
+// errReadOnly is returned by the storages of read-only views of the container
+var errReadOnly = fuse.Errno(syscall.EROFS)
+
+// snapshotsDir is the virtual directory SnapshotDir of a directory, holding a read-only directory
+// named after each time a snapshot was taken of files in the directory or below it. It is not listed.
+type snapshotsDir struct {
+	sync.Mutex
+	path  string // the directory, ending with "/" unless it is the root
+	attr  fuse.Attr
+	fs    *FS
+	store SnapshotStorage
+	views map[string]*Dir // directories of the snapshot times looked up
+}
+
+// lookupSnapshots returns the snapshot directory when name is SnapshotDir and the storage keeps
+// snapshots, read-only views of the container have none
+func (d *Dir) lookupSnapshots(name string) (fs.Node, bool) {
+	if SnapshotDir == "" || name != SnapshotDir || d.fs.readOnly {
+		return nil, false
+	}
+	store, ok := d.fs.store.(SnapshotStorage)
+	if !ok {
+		return nil, false
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.snapshots == nil {
+		n := d.fs.NewDir(d.path, DefaultDirMode&^0o222, 0, time.Now())
+		d.snapshots = &snapshotsDir{path: d.path, attr: n.attr, fs: d.fs, store: store, views: make(map[string]*Dir)}
+	}
+	return d.snapshots, true
+}
+
+// Attr implements Node interface for snapshot directories
+func (s *snapshotsDir) Attr(ctx context.Context, o *fuse.Attr) error {
+	*o = s.attr
+	o.Valid = AttrTimeout
+	return nil
+}
+
+// Lookup implements NodeStringLookuper, the names are the times of the snapshots
+func (s *snapshotsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	times, err := s.times(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if i := sort.SearchStrings(times, name); i == len(times) || times[i] != name {
+		return nil, fuse.ENOENT
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.view(name), nil
+}
+
+// ReadDirAll implements HandleReadDirAller, listing the times of the snapshots
+func (s *snapshotsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	times, err := s.times(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	dirs := make([]fuse.Dirent, 0, len(times))
+	for _, snapshot := range times {
+		dirs = append(dirs, fuse.Dirent{Name: snapshot, Inode: s.view(snapshot).attr.Inode, Type: fuse.DT_Dir})
+	}
+	return dirs, nil
+}
+
+// times returns the sorted times of the snapshots of the files in the directory and its subdirectories
+func (s *snapshotsDir) times(ctx context.Context) ([]string, error) {
+	snapshots, err := s.store.ListSnapshots(ctx, s.path)
+	if err != nil {
+		log.Printf("Error in listing snapshots of %s: %v", s.path, err)
+		return nil, toErrno(err)
+	}
+	seen := make(map[string]bool)
+	var times []string
+	for _, blob := range snapshots {
+		if !seen[blob.Snapshot] {
+			seen[blob.Snapshot] = true
+			times = append(times, blob.Snapshot)
+		}
+	}
+	sort.Strings(times)
+	return times, nil
+}
+
+// view returns the read-only directory of the files in the directory and below it as they were at
+// snapshot, the lock must be held
+func (s *snapshotsDir) view(snapshot string) *Dir {
+	if d, exists := s.views[snapshot]; exists {
+		return d
+	}
+	view := &FS{store: &snapshotStorage{store: s.store, snapshot: snapshot}, readOnly: true, parent: s.fs}
+	mtime, err := time.Parse(time.RFC3339Nano, snapshot)
+	if err != nil {
+		mtime = time.Now()
+	}
+	d := view.NewDir(s.path, DefaultDirMode&^0o222, 0, mtime)
+	s.views[snapshot] = d
+	return d
+}
+
+// createSnapshot takes a snapshot of the blob of the file, modified content is uploaded first
+func (f *File) createSnapshot(ctx context.Context) error {
+	store, ok := f.fs.store.(SnapshotStorage)
+	if !ok {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if err := f.flush(ctx); err != nil {
+		return err
+	}
+	snapshot, err := store.CreateSnapshot(ctx, f.path)
+	if err != nil {
+		log.Printf("Error in taking a snapshot of %s: %v", f.path, err)
+		return toErrno(err)
+	}
+	log.Printf("Took snapshot %s of %s", snapshot, f.path)
+	return nil
+}
+
+// snapshotStorage is the read-only Storage of the blobs of which a snapshot was taken at one time, in
+// the directories holding them
+type snapshotStorage struct {
+	store    SnapshotStorage
+	snapshot string
+}
+
+var _ Storage = (*snapshotStorage)(nil)
+
+// List returns the snapshots taken at the time of the view directly under prefix, and the prefixes
+// of the subdirectories holding others
+func (s *snapshotStorage) List(ctx context.Context, prefix string) ([]BlobAttr, []string, error) {
+	snapshots, err := s.ListRecursive(ctx, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	var blobItems []BlobAttr
+	var prefixes []string
+	for _, blob := range snapshots {
+		if i := strings.Index(blob.Name[len(prefix):], "/"); i >= 0 {
+			prefixes = append(prefixes, blob.Name[:len(prefix)+i+1])
+			continue
+		}
+		blobItems = append(blobItems, blob)
+	}
+	return blobItems, uniqueStrings(prefixes), nil
+}
+
+// ListRecursive returns every snapshot taken at the time of the view under prefix
+func (s *snapshotStorage) ListRecursive(ctx context.Context, prefix string) ([]BlobAttr, error) {
+	snapshots, err := s.store.ListSnapshots(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var blobItems []BlobAttr
+	for _, blob := range snapshots {
+		if blob.Snapshot == s.snapshot {
+			blobItems = append(blobItems, blob)
+		}
+	}
+	return blobItems, nil
+}
+
+// GetRange fills b with the content of the snapshot of the blob starting at offset
+func (s *snapshotStorage) GetRange(ctx context.Context, name string, offset int64, b []byte) error {
+	return s.store.GetSnapshotRange(ctx, name, s.snapshot, offset, b)
+}
+
+// GetProperties returns the properties and metadata of the snapshot of the blob
+func (s *snapshotStorage) GetProperties(ctx context.Context, name string) (BlobAttr, error) {
+	if strings.HasSuffix(name, "/") || name == "" {
+		return BlobAttr{}, ErrBlobNotFound
+	}
+	return s.store.GetSnapshotProperties(ctx, name, s.snapshot)
+}
+
+// Put fails, snapshots are read-only
+func (s *snapshotStorage) Put(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	return errReadOnly
+}
+
+// StageBlock fails, snapshots are read-only
+func (s *snapshotStorage) StageBlock(ctx context.Context, name string, blockID string, data []byte) error {
+	return errReadOnly
+}
+
+// CommitBlocks fails, snapshots are read-only
+func (s *snapshotStorage) CommitBlocks(ctx context.Context, name string, blockIDs []string, metadata map[string]string) error {
+	return errReadOnly
+}
+
+// Delete fails, snapshots are read-only
+func (s *snapshotStorage) Delete(ctx context.Context, name string) error {
+	return errReadOnly
+}
+
+// Copy fails, snapshots are read-only
+func (s *snapshotStorage) Copy(ctx context.Context, src string, dst string) error {
+	return errReadOnly
+}
+
+// SetMetadata fails, snapshots are read-only
+func (s *snapshotStorage) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	return errReadOnly
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestSnapshotDir(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.addBlob("dir/a.txt", []byte("v1"), nil)
+	fake.addBlob("dir/b.txt", []byte("b"), nil)
+	filesys := NewFS(NewBlobStorage(fake.ContainerURL()))
+	readDirNames(t, filesys.root)
+	n, err := filesys.root.Lookup(ctx, "dir")
+	if err != nil {
+		t.Fatalf("Lookup dir: %v", err)
+	}
+	dir := n.(*Dir)
+	readDirNames(t, dir)
+	n, err = dir.Lookup(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Lookup a.txt: %v", err)
+	}
+	if err := n.(*File).Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrSnapshot, Xattr: []byte("1")}); err != nil {
+		t.Fatalf("Setxattr to take a snapshot: %v", err)
+	}
+	fake.addBlob("dir/a.txt", []byte("v2"), nil)
+
+	if _, listed := readDirNames(t, dir)[SnapshotDir]; listed {
+		t.Errorf("%s is listed", SnapshotDir)
+	}
+	n, err = dir.Lookup(ctx, SnapshotDir)
+	if err != nil {
+		t.Fatalf("Lookup %s: %v", SnapshotDir, err)
+	}
+	snapshots := n.(*snapshotsDir)
+	dirents, err := snapshots.ReadDirAll(ctx)
+	if err != nil || len(dirents) != 1 {
+		t.Fatalf("snapshots are %v, %v", dirents, err)
+	}
+	if _, err := snapshots.Lookup(ctx, "2000-01-01T00:00:00.0000000Z"); err != fuse.ENOENT {
+		t.Errorf("Lookup of unknown snapshot returned %v", err)
+	}
+	n, err = snapshots.Lookup(ctx, dirents[0].Name)
+	if err != nil {
+		t.Fatalf("Lookup %s: %v", dirents[0].Name, err)
+	}
+	view := n.(*Dir)
+	names := readDirNames(t, view)
+	if _, exists := names["a.txt"]; len(names) != 1 || !exists {
+		t.Errorf("snapshot lists %v, want a.txt", names)
+	}
+	n, err = view.Lookup(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Lookup a.txt in snapshot: %v", err)
+	}
+	f := n.(*File)
+	if f.attr.Mode&0o222 != 0 {
+		t.Errorf("mode of snapshot file is %v", f.attr.Mode)
+	}
+	openFile(t, f)
+	if got := readFile(t, f, 0, 2); got != "v1" {
+		t.Errorf("snapshot reads %q, want v1", got)
+	}
+	releaseFile(t, f)
+	if got, err := getXattr(f, xattrSnapshot); err != nil || got != dirents[0].Name {
+		t.Errorf("%s is %q, %v", xattrSnapshot, got, err)
+	}
+
+	_, err = f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EROFS {
+		t.Errorf("Open for writing returned %v, want EROFS", err)
+	}
+	err = f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize}, &fuse.SetattrResponse{})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EROFS {
+		t.Errorf("Setattr returned %v, want EROFS", err)
+	}
+	err = view.Remove(ctx, &fuse.RemoveRequest{Name: "a.txt"})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EROFS {
+		t.Errorf("Remove returned %v, want EROFS", err)
+	}
+	if _, err := view.Lookup(ctx, SnapshotDir); err != fuse.ENOENT {
+		t.Errorf("Lookup of %s in snapshot returned %v", SnapshotDir, err)
+	}
+
+	// The view has the path of the directory, a move into it must not touch the live blob
+	err = dir.Rename(ctx, &fuse.RenameRequest{OldName: "b.txt", NewName: "b.txt"}, view)
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EXDEV {
+		t.Errorf("Rename into snapshot returned %v, want EXDEV", err)
+	}
+	if _, _, exists := fake.blob("dir/b.txt"); !exists {
+		t.Errorf("dir/b.txt was removed by a rename into the snapshot")
+	}
+	err = view.Rename(ctx, &fuse.RenameRequest{OldName: "a.txt", NewName: "c.txt"}, view)
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EROFS {
+		t.Errorf("Rename in snapshot returned %v, want EROFS", err)
+	}
+}
+
+func TestSnapshotDirWithoutSnapshots(t *testing.T) {
+	filesys := NewFS(NewMemStorage())
+	if _, err := filesys.root.Lookup(context.Background(), SnapshotDir); err != fuse.ENOENT {
+		t.Errorf("Lookup of %s in memory returned %v", SnapshotDir, err)
+	}
+}
+
+func TestSnapshotDirNesting(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.addBlob("dir/a.txt", []byte("a"), nil)
+	fake.addBlob("dir/sub/c.txt", []byte("c"), nil)
+	store := NewBlobStorage(fake.ContainerURL())
+	snapshot, err := store.CreateSnapshot(ctx, "dir/sub/c.txt")
+	if err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	filesys := NewFS(store)
+
+	n, err := filesys.root.Lookup(ctx, SnapshotDir)
+	if err != nil {
+		t.Fatalf("Lookup %s: %v", SnapshotDir, err)
+	}
+	snapshots := n.(*snapshotsDir)
+	dirents, err := snapshots.ReadDirAll(ctx)
+	if err != nil || len(dirents) != 1 || dirents[0].Name != snapshot {
+		t.Fatalf("snapshots of the root are %v, %v, want %s", dirents, err, snapshot)
+	}
+	n, err = snapshots.Lookup(ctx, snapshot)
+	if err != nil {
+		t.Fatalf("Lookup %s: %v", snapshot, err)
+	}
+	view := n.(*Dir)
+	if names := readDirNames(t, view); len(names) != 1 {
+		t.Errorf("snapshot of the root lists %v, want dir", names)
+	}
+	sub := lookupDir(t, lookupDir(t, view, "dir"), "sub")
+	n, err = sub.Lookup(ctx, "c.txt")
+	if err != nil {
+		t.Fatalf("Lookup c.txt in snapshot: %v", err)
+	}
+	f := n.(*File)
+	openFile(t, f)
+	if got := readFile(t, f, 0, 1); got != "c" {
+		t.Errorf("snapshot reads %q, want c", got)
+	}
+	releaseFile(t, f)
+
+	err = view.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0o777}, &fuse.SetattrResponse{})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EROFS {
+		t.Errorf("Setattr of snapshot directory returned %v, want EROFS", err)
+	}
+}
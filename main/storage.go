@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"golang.org/x/net/context"
+)
+
+// BlobAttr holds the properties of a blob as reported by a Storage backend
+type BlobAttr struct {
+	Name         string // full name of the blob inside the container
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	Metadata     map[string]string
+	ResourceType string    // directory or file on accounts with a hierarchical namespace, empty otherwise
+	Snapshot     string    // time of the snapshot, empty for the base blob
+	VersionID    string    // time of the version with blob versioning, only set when listing versions
+	DeletedTime  time.Time // when a deleted blob was removed, zero for live blobs
+
+	// Properties only returned by GetProperties
+	ContentType string
+	ContentMD5  []byte // computed by the service for blobs uploaded in a single request
+	AccessTier  string
+	// Rehydration of an archived blob, such as rehydrate-pending-to-hot, and its priority
+	ArchiveStatus     string
+	RehydratePriority string
+
+	// POSIX access control of accounts with a hierarchical namespace, empty otherwise
+	Owner       string
+	Group       string
+	Permissions string // symbolic, such as rwxr-x---+
+	ACL         string // only returned by GetProperties
+}
+
+// Storage is the interface through which Dir and File talk to the mounted container.
+// The azblob implementation (BlobStorage) is used for real mounts, the in-memory
+// implementation (MemStorage) allows the node logic to run without a storage account.
+type Storage interface {
+	// List returns the blobs directly under prefix, using "/" as delimiter, and the prefixes ending
+	// with "/" of the virtual directories below it
+	List(ctx context.Context, prefix string) ([]BlobAttr, []string, error)
+
+	// ListRecursive returns every blob whose name starts with prefix
+	ListRecursive(ctx context.Context, prefix string) ([]BlobAttr, error)
+
+	// GetRange fills b with the contents of the blob starting at offset
+	GetRange(ctx context.Context, name string, offset int64, b []byte) error
+
+	// Put uploads data as the whole content of the blob, replacing any existing one
+	Put(ctx context.Context, name string, data []byte, metadata map[string]string) error
+
+	// StageBlock uploads data as an uncommitted block of the block blob, blockID is base64 encoded
+	StageBlock(ctx context.Context, name string, blockID string, data []byte) error
+
+	// CommitBlocks replaces the content of the block blob with the concatenation of the
+	// staged or already committed blocks listed in blockIDs
+	CommitBlocks(ctx context.Context, name string, blockIDs []string, metadata map[string]string) error
+
+	// Delete removes the blob, its snapshots are handled according to DeleteSnapshots
+	Delete(ctx context.Context, name string) error
+
+	// Copy creates dst as a copy of src, including its metadata
+	Copy(ctx context.Context, src string, dst string) error
+
+	// GetProperties returns the properties and metadata of the blob
+	GetProperties(ctx context.Context, name string) (BlobAttr, error)
+
+	// SetMetadata replaces the metadata of the blob
+	SetMetadata(ctx context.Context, name string, metadata map[string]string) error
+}
+
+// HierarchicalStorage is implemented by storages of accounts with a hierarchical namespace, where
+// directories are created, renamed and deleted with one request each
+type HierarchicalStorage interface {
+	Storage
+
+	// CreateDirectory creates the directory name with the permissions of mode, it fails when the path exists
+	CreateDirectory(ctx context.Context, name string, mode os.FileMode) error
+
+	// Rename moves the file or directory src to dst atomically, replacing a file at dst
+	Rename(ctx context.Context, src string, dst string) error
+
+	// DeleteDirectory removes the empty directory name
+	DeleteDirectory(ctx context.Context, name string) error
+
+	// GetAccessControl returns the owner, group, permissions and ACL of the path name, the empty name
+	// being the root directory
+	GetAccessControl(ctx context.Context, name string) (BlobAttr, error)
+
+	// SetAccessControl replaces the access and default ACL of the path name
+	SetAccessControl(ctx context.Context, name string, acl string) error
+}
+
+// TieredStorage is implemented by storages whose blobs have an access tier
+type TieredStorage interface {
+	Storage
+
+	// SetTier moves the blob to tier, an archived blob is rehydrated with priority in the background
+	SetTier(ctx context.Context, name string, tier azblob.AccessTierType, priority azblob.RehydratePriorityType) error
+}
+
+// SnapshotStorage is implemented by storages keeping read-only snapshots of blobs, identified by the
+// time they were taken
+type SnapshotStorage interface {
+	Storage
+
+	// ListSnapshots returns the snapshots of every blob under prefix, in subdirectories too
+	ListSnapshots(ctx context.Context, prefix string) ([]BlobAttr, error)
+
+	// GetSnapshotRange fills b with the contents of the snapshot of the blob starting at offset
+	GetSnapshotRange(ctx context.Context, name string, snapshot string, offset int64, b []byte) error
+
+	// GetSnapshotProperties returns the properties and metadata of the snapshot of the blob
+	GetSnapshotProperties(ctx context.Context, name string, snapshot string) (BlobAttr, error)
+
+	// CreateSnapshot takes a snapshot of the blob and returns its time
+	CreateSnapshot(ctx context.Context, name string) (string, error)
+}
+
+// TrashStorage is implemented by storages keeping deleted blobs for a retention period, on accounts with
+// blob soft delete
+type TrashStorage interface {
+	Storage
+
+	// SoftDeleteEnabled tells whether the account keeps deleted blobs, the other methods fail otherwise
+	SoftDeleteEnabled() bool
+
+	// ListDeleted returns the deleted blobs under prefix. Unless recursive, only the blobs directly under
+	// prefix are returned with the prefixes of the virtual directories below it, which may also hold live
+	// blobs.
+	ListDeleted(ctx context.Context, prefix string, recursive bool) ([]BlobAttr, []string, error)
+
+	// Undelete restores the deleted blob with its snapshots
+	Undelete(ctx context.Context, name string) error
+}
+
+// VersionedStorage is implemented by storages keeping the previous versions of blobs, identified by the
+// time they were written, on accounts with blob versioning
+type VersionedStorage interface {
+	Storage
+
+	// ListVersions returns the versions of the blobs under prefix, including the current ones. Unless
+	// recursive, only the blobs directly under prefix are returned with the prefixes of the virtual
+	// directories below it.
+	ListVersions(ctx context.Context, prefix string, recursive bool) ([]BlobAttr, []string, error)
+
+	// GetVersionRange fills b with the contents of the version of the blob starting at offset
+	GetVersionRange(ctx context.Context, name string, versionID string, offset int64, b []byte) error
+
+	// GetVersionProperties returns the properties and metadata of the version of the blob
+	GetVersionProperties(ctx context.Context, name string, versionID string) (BlobAttr, error)
+}
+
+// isNotFound tells whether err, returned by a Storage, reports a missing blob
+func isNotFound(err error) bool {
+	if err == ErrBlobNotFound {
+		return true
+	}
+	serr, ok := err.(azblob.StorageError)
+	return ok && serr.Response() != nil && serr.Response().StatusCode == http.StatusNotFound
+}
+
+// toErrno translates an error returned by a Storage into the errno reported to the kernel. Errors
+// which already are an errno are passed through, errors without a response from the service are
+// reported as EIO.
+func toErrno(err error) fuse.Errno {
+	switch e := err.(type) {
+	case fuse.Errno:
+		return e
+	case syscall.Errno:
+		return fuse.Errno(e)
+	}
+	switch {
+	case err == ErrBlobNotFound:
+		return fuse.ENOENT
+	case errors.Is(err, context.Canceled):
+		// The FUSE request was interrupted
+		return fuse.EINTR
+	}
+	serr, ok := err.(azblob.StorageError)
+	if !ok || serr.Response() == nil {
+		return fuse.EIO
+	}
+	switch serr.ServiceCode() {
+	case azblob.ServiceCodeSnapshotsPresent, azblob.ServiceCodeLeaseIDMissing, azblob.ServiceCodeLeaseAlreadyPresent,
+		azblob.ServiceCodeLeaseIDMismatchWithBlobOperation, azblob.ServiceCodeBlobBeingRehydrated:
+		return fuse.Errno(syscall.EBUSY)
+	case azblob.ServiceCodeBlockCountExceedsLimit, azblob.ServiceCodeRequestBodyTooLarge:
+		return fuse.Errno(syscall.EFBIG)
+	case azblob.ServiceCodeMetadataTooLarge:
+		return fuse.Errno(syscall.E2BIG)
+	case azblob.ServiceCodeBlobArchived:
+		// The content is offline until the blob is rehydrated
+		return fuse.Errno(syscall.ENODATA)
+	case "DirectoryNotEmpty":
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+	switch status := serr.Response().StatusCode; {
+	case status == http.StatusNotFound:
+		return fuse.ENOENT
+	case status == http.StatusConflict:
+		return fuse.EEXIST
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return fuse.Errno(syscall.EACCES)
+	case status == http.StatusPreconditionFailed:
+		// The blob changed since it was read
+		return fuse.Errno(syscall.ESTALE)
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		// Still throttled after the retries of the pipeline
+		return fuse.Errno(syscall.EAGAIN)
+	case status == http.StatusBadRequest:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return fuse.EIO
+}
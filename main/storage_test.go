@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// forEachBackend runs test against the in-memory backend and against BlobStorage talking to the fake Blob service
+func forEachBackend(t *testing.T, test func(t *testing.T, store Storage)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemStorage())
+	})
+	t.Run("azblob", func(t *testing.T) {
+		fake := newFakeBlobService(t, "testcontainer")
+		test(t, NewBlobStorage(fake.ContainerURL()))
+	})
+}
+
+func TestStoragePutGetRange(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		if err := store.Put(ctx, "dir/file.txt", []byte("hello world"), map[string]string{"key": "value"}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		b := make([]byte, 5)
+		if err := store.GetRange(ctx, "dir/file.txt", 6, b); err != nil {
+			t.Fatalf("GetRange: %v", err)
+		}
+		if string(b) != "world" {
+			t.Errorf("GetRange returned %q, want %q", b, "world")
+		}
+		props, err := store.GetProperties(ctx, "dir/file.txt")
+		if err != nil {
+			t.Fatalf("GetProperties: %v", err)
+		}
+		if props.Size != 11 || props.Metadata["key"] != "value" || props.ETag == "" {
+			t.Errorf("GetProperties returned %+v", props)
+		}
+	})
+}
+
+func TestStorageListIsHierarchical(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		for _, name := range []string{"a.txt", "b.txt", "dir/c.txt", "dir/sub/d.txt"} {
+			if err := store.Put(ctx, name, []byte(name), nil); err != nil {
+				t.Fatalf("Put %s: %v", name, err)
+			}
+		}
+		for prefix, want := range map[string]string{
+			"":         "[a.txt b.txt] [dir/]",
+			"dir/":     "[dir/c.txt] [dir/sub/]",
+			"dir/sub/": "[dir/sub/d.txt] []",
+		} {
+			items, prefixes, err := store.List(ctx, prefix)
+			if err != nil {
+				t.Fatalf("List %q: %v", prefix, err)
+			}
+			var names []string
+			for _, item := range items {
+				names = append(names, item.Name)
+			}
+			if got := fmt.Sprint(names, prefixes); got != want {
+				t.Errorf("List %q returned %v, want %v", prefix, got, want)
+			}
+		}
+	})
+}
+
+func TestStorageCopyDeleteSetMetadata(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		if err := store.Put(ctx, "src", []byte("data"), map[string]string{"key": "value"}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := store.Copy(ctx, "src", "dst"); err != nil {
+			t.Fatalf("Copy: %v", err)
+		}
+		if err := store.SetMetadata(ctx, "dst", map[string]string{"other": "1"}); err != nil {
+			t.Fatalf("SetMetadata: %v", err)
+		}
+		props, err := store.GetProperties(ctx, "dst")
+		if err != nil {
+			t.Fatalf("GetProperties: %v", err)
+		}
+		if props.Size != 4 || len(props.Metadata) != 1 || props.Metadata["other"] != "1" {
+			t.Errorf("GetProperties of copy returned %+v", props)
+		}
+		if err := store.Delete(ctx, "src"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := store.GetProperties(ctx, "src"); err == nil {
+			t.Errorf("GetProperties of deleted blob succeeded")
+		}
+		if err := store.Delete(ctx, "src"); err == nil {
+			t.Errorf("Delete of missing blob succeeded")
+		}
+	})
+}
+
+func TestStorageStageCommitBlocks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		ids := []string{"YmxvY2stMA==", "YmxvY2stMQ==", "YmxvY2stMg=="}
+		for i, data := range []string{"one,", "two,", "three"} {
+			if err := store.StageBlock(ctx, "blocks", ids[i], []byte(data)); err != nil {
+				t.Fatalf("StageBlock: %v", err)
+			}
+		}
+		if _, err := store.GetProperties(ctx, "blocks"); err == nil {
+			t.Errorf("blob exists before its blocks are committed")
+		}
+		if err := store.CommitBlocks(ctx, "blocks", ids[:2], nil); err != nil {
+			t.Fatalf("CommitBlocks: %v", err)
+		}
+		// Committed blocks can be committed again along with new ones
+		if err := store.StageBlock(ctx, "blocks", ids[2], []byte("four")); err != nil {
+			t.Fatalf("StageBlock: %v", err)
+		}
+		if err := store.CommitBlocks(ctx, "blocks", ids, map[string]string{"key": "value"}); err != nil {
+			t.Fatalf("CommitBlocks: %v", err)
+		}
+		b := make([]byte, 12)
+		if err := store.GetRange(ctx, "blocks", 0, b); err != nil || string(b) != "one,two,four" {
+			t.Errorf("GetRange returned %q, %v", b, err)
+		}
+		if props, err := store.GetProperties(ctx, "blocks"); err != nil || props.Metadata["key"] != "value" {
+			t.Errorf("GetProperties returned %+v, %v", props, err)
+		}
+	})
+}
+
+func TestFakeListPaging(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	for i := 0; i < 7; i++ {
+		fake.addBlob(fmt.Sprintf("blob%d", i), nil, nil)
+	}
+	container := fake.ContainerURL()
+	var names []string
+	pages := 0
+	for marker := (azblob.Marker{}); marker.NotDone(); pages++ {
+		resp, err := container.ListBlobsHierarchySegment(context.Background(), marker, "/", azblob.ListBlobsSegmentOptions{MaxResults: 3})
+		if err != nil {
+			t.Fatalf("ListBlobsHierarchySegment: %v", err)
+		}
+		for _, item := range resp.Segment.BlobItems {
+			names = append(names, item.Name)
+		}
+		marker = resp.NextMarker
+	}
+	if len(names) != 7 || pages != 3 {
+		t.Errorf("listed %v in %d pages, want 7 blobs in 3 pages", names, pages)
+	}
+}
+
+func TestFakeBlockList(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	blob := fake.ContainerURL().NewBlockBlobURL("blocks")
+	ctx := context.Background()
+	var ids []string
+	for i, chunk := range []string{"abc", "def", "ghi"} {
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+		if _, err := blob.StageBlock(ctx, id, bytes.NewReader([]byte(chunk)), azblob.LeaseAccessConditions{}, nil, azblob.ClientProvidedKeyOptions{}); err != nil {
+			t.Fatalf("StageBlock: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if _, exists := fake.blobs["blocks"]; exists {
+		t.Fatalf("blob exists before the block list is committed")
+	}
+	if _, err := blob.CommitBlockList(ctx, ids, azblob.BlobHTTPHeaders{}, azblob.Metadata{"k": "v"}, azblob.BlobAccessConditions{},
+		azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}); err != nil {
+		t.Fatalf("CommitBlockList: %v", err)
+	}
+	data, metadata, _ := fake.blob("blocks")
+	if string(data) != "abcdefghi" || metadata["k"] != "v" {
+		t.Errorf("committed blob is %q with metadata %v", data, metadata)
+	}
+}
+
+func TestFakeLease(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.addBlob("leased", []byte("data"), nil)
+	blob := fake.ContainerURL().NewBlobURL("leased")
+	ctx := context.Background()
+	lease, err := blob.AcquireLease(ctx, "11111111-1111-1111-1111-111111111111", -1, azblob.ModifiedAccessConditions{})
+	if err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	_, err = blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if serr, ok := err.(azblob.StorageError); !ok || serr.ServiceCode() != azblob.ServiceCodeLeaseIDMissing {
+		t.Fatalf("Delete of leased blob without lease id returned %v", err)
+	}
+	ac := azblob.BlobAccessConditions{LeaseAccessConditions: azblob.LeaseAccessConditions{LeaseID: lease.LeaseID()}}
+	if _, err := blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone, ac); err != nil {
+		t.Fatalf("Delete with lease id: %v", err)
+	}
+}
+
+func TestBlobStorageCopyPollsPendingCopy(t *testing.T) {
+	saved := copyPollInterval
+	defer func() { copyPollInterval = saved }()
+	copyPollInterval = time.Millisecond
+
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.addBlob("src", []byte("data"), nil)
+	store := NewBlobStorage(fake.ContainerURL())
+	ctx := context.Background()
+
+	fake.copyPolls = 3
+	if err := store.Copy(ctx, "src", "dst"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if data, _, _ := fake.blob("dst"); string(data) != "data" {
+		t.Errorf("copied blob is %q", data)
+	}
+
+	// A failed copy leaves no destination behind
+	fake.copyFails = true
+	if err := store.Copy(ctx, "src", "failed"); err == nil {
+		t.Errorf("Copy succeeded although the copy failed")
+	}
+	if _, _, exists := fake.blob("failed"); exists {
+		t.Errorf("destination of failed copy was not removed")
+	}
+
+	// A copy still pending at the deadline is aborted and removed
+	fake.copyFails, fake.copyPolls = false, 1000
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := store.Copy(ctx, "src", "slow"); err == nil {
+		t.Errorf("Copy succeeded although it did not finish")
+	}
+	if _, _, exists := fake.blob("slow"); exists {
+		t.Errorf("destination of aborted copy was not removed")
+	}
+}
+
+func TestToErrno(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.failures = map[string]fakeFailure{
+		"denied":    {http.StatusForbidden, "AuthorizationPermissionMismatch", 0},
+		"snapshots": {http.StatusConflict, "SnapshotsPresent", 0},
+		"exists":    {http.StatusConflict, "BlobAlreadyExists", 0},
+		"changed":   {http.StatusPreconditionFailed, "ConditionNotMet", 0},
+		"throttled": {http.StatusServiceUnavailable, "ServerBusy", 0},
+		"too many":  {http.StatusTooManyRequests, "TooManyRequests", 0},
+		"broken":    {http.StatusInternalServerError, "InternalError", 0},
+	}
+	store := NewBlobStorage(fake.ContainerURL())
+	ctx := context.Background()
+	for name, want := range map[string]syscall.Errno{
+		"missing":   syscall.ENOENT,
+		"denied":    syscall.EACCES,
+		"snapshots": syscall.EBUSY,
+		"exists":    syscall.EEXIST,
+		"changed":   syscall.ESTALE,
+		"throttled": syscall.EAGAIN,
+		"too many":  syscall.EAGAIN,
+		"broken":    syscall.EIO,
+	} {
+		err := store.Delete(ctx, name)
+		if got := toErrno(err); got != fuse.Errno(want) {
+			t.Errorf("Delete of %s failing with %v is reported as %v, want %v", name, err, got, want)
+		}
+	}
+
+	if got := toErrno(ErrBlobNotFound); got != fuse.ENOENT {
+		t.Errorf("missing blob of MemStorage is reported as %v", got)
+	}
+	if got := toErrno(fuse.Errno(syscall.ENOTEMPTY)); got != fuse.Errno(syscall.ENOTEMPTY) {
+		t.Errorf("errno is reported as %v", got)
+	}
+	expired, cancel := context.WithTimeout(ctx, 0)
+	defer cancel()
+	if got := toErrno(store.Delete(expired, "missing")); got != fuse.EIO {
+		t.Errorf("expired deadline is reported as %v", got)
+	}
+	fake.server.Close()
+	if got := toErrno(store.Delete(ctx, "missing")); got != fuse.EIO {
+		t.Errorf("unreachable service is reported as %v", got)
+	}
+}
+
+func TestBlobStorageRetriesWithConfiguredPolicy(t *testing.T) {
+	maxTries, retryDelay, maxRetryDelay := MaxTries, RetryDelay, MaxRetryDelay
+	defer func() { MaxTries, RetryDelay, MaxRetryDelay = maxTries, retryDelay, maxRetryDelay }()
+	RetryDelay, MaxRetryDelay = time.Millisecond, time.Millisecond
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		maxTries uint
+		want     error
+	}{
+		{3, nil},
+		{2, fuse.Errno(syscall.EAGAIN)},
+	} {
+		MaxTries = tc.maxTries
+		fake := newFakeBlobService(t, "testcontainer")
+		fake.addBlob("busy", []byte("data"), nil)
+		fake.failures = map[string]fakeFailure{"busy": {http.StatusServiceUnavailable, "ServerBusy", 2}}
+		store := NewBlobStorage(fake.containerURL(azblob.PipelineOptions{Retry: retryOptions()}))
+
+		_, err := store.GetProperties(ctx, "busy")
+		if err != nil {
+			err = toErrno(err)
+		}
+		if err != tc.want {
+			t.Errorf("GetProperties with %d tries after 2 failures returned %v, want %v", tc.maxTries, err, tc.want)
+		}
+	}
+}
+
+func TestInterruptedRequestReturnsEINTR(t *testing.T) {
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.addBlob("file.txt", []byte("data"), nil)
+	filesys := NewFS(NewBlobStorage(fake.ContainerURL()))
+	f := lookupFile(t, filesys, "file.txt")
+
+	// The kernel cancels the context of a request when the calling process is interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp := &fuse.ReadResponse{}
+	if err := f.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 4}, resp); err != fuse.EINTR {
+		t.Errorf("interrupted Read returned %v, want EINTR", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// xattrTier is the access tier of a blob, setting it moves the blob to another tier
+const xattrTier = xattrAzure + "tier"
+
+// Access tiers of block blobs, as written to user.azure.tier and UploadTier
+var accessTiers = []azblob.AccessTierType{azblob.AccessTierHot, azblob.AccessTierCool, azblob.AccessTierArchive}
+
+// defaultRehydratePriority is the default of RehydratePriority
+const defaultRehydratePriority = string(azblob.RehydratePriorityStandard)
+
+// Priorities of the rehydration of archived blobs
+var rehydratePriorities = []azblob.RehydratePriorityType{azblob.RehydratePriorityStandard, azblob.RehydratePriorityHigh}
+
+// parseAccessTier returns the access tier called s in any case, the empty string being no tier
+func parseAccessTier(s string) (azblob.AccessTierType, bool) {
+	if s == "" {
+		return azblob.AccessTierNone, true
+	}
+	for _, tier := range accessTiers {
+		if strings.EqualFold(s, string(tier)) {
+			return tier, true
+		}
+	}
+	return azblob.AccessTierNone, false
+}
+
+// parseRehydratePriority returns the rehydrate priority called s in any case
+func parseRehydratePriority(s string) (azblob.RehydratePriorityType, bool) {
+	for _, priority := range rehydratePriorities {
+		if strings.EqualFold(s, string(priority)) {
+			return priority, true
+		}
+	}
+	return azblob.RehydratePriorityNone, false
+}
+
+// parseTierXattr parses a value of user.azure.tier, a tier optionally followed by the priority of the
+// rehydration of an archived blob, such as Hot or Hot:High. The priority defaults to RehydratePriority.
+func parseTierXattr(value string) (azblob.AccessTierType, azblob.RehydratePriorityType, error) {
+	value, priorityName := strings.TrimSpace(value), RehydratePriority
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		value, priorityName = value[:i], value[i+1:]
+	}
+	tier, ok := parseAccessTier(value)
+	if !ok || tier == azblob.AccessTierNone {
+		return azblob.AccessTierNone, azblob.RehydratePriorityNone, fmt.Errorf("invalid access tier %q", value)
+	}
+	priority, ok := parseRehydratePriority(priorityName)
+	if !ok {
+		return azblob.AccessTierNone, azblob.RehydratePriorityNone, fmt.Errorf("invalid rehydrate priority %q", priorityName)
+	}
+	return tier, priority, nil
+}
+
+// isArchived tells whether the content of the blob is offline in the Archive tier
+func isArchived(blob BlobAttr) bool {
+	return strings.EqualFold(blob.AccessTier, string(azblob.AccessTierArchive))
+}
+
+// uploadTier returns the tier of uploaded blobs, none for the default tier of the account
+func uploadTier() azblob.AccessTierType {
+	tier, _ := parseAccessTier(UploadTier)
+	return tier
+}
+
+// setTier moves the blob of the file to the tier in value, a value of user.azure.tier. Modified content
+// is uploaded first so that it lands in the tier. The priority only applies to archived blobs.
+func (f *File) setTier(ctx context.Context, value []byte) error {
+	ts, ok := f.fs.store.(TieredStorage)
+	if !ok {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	tier, priority, err := parseTierXattr(string(value))
+	if err != nil {
+		log.Printf("Error in setting tier of %s: %v", f.currentPath(), err)
+		return fuse.Errno(syscall.EINVAL)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if err := f.flush(ctx); err != nil {
+		return err
+	}
+	blob, err := f.fs.store.GetProperties(ctx, f.path)
+	if err != nil {
+		log.Printf("Error in reading properties of %s: %v", f.path, err)
+		return toErrno(err)
+	}
+	archived := isArchived(blob)
+	if !archived {
+		priority = azblob.RehydratePriorityNone
+	}
+	if err := ts.SetTier(ctx, f.path, tier, priority); err != nil {
+		log.Printf("Error in setting tier of %s to %s: %v", f.path, tier, err)
+		return toErrno(err)
+	}
+	if archived && tier != azblob.AccessTierArchive {
+		log.Printf("Rehydrating %s to %s with %s priority", f.path, tier, priority)
+	}
+	return nil
+}
+
+// SetTier moves the blob to tier, an archived blob being rehydrated with priority
+func (s *BlobStorage) SetTier(ctx context.Context, name string, tier azblob.AccessTierType, priority azblob.RehydratePriorityType) error {
+	ctx, cancel := withTimeout(ctx, OperationTimeout)
+	defer cancel()
+	if priority != azblob.RehydratePriorityNone {
+		// BlobURL.SetTier has no parameter for the priority
+		ctx = withRequestHeader(ctx, "x-ms-rehydrate-priority", string(priority))
+	}
+	blobURL := s.container.NewBlobURL(name)
+	_, err := blobURL.SetTier(ctx, tier, azblob.LeaseAccessConditions{})
+	return err
+}
+
+// requestHeaderKey is the key of the headers added to the requests sent with a context
+type requestHeaderKey struct{}
+
+// withRequestHeader returns a context adding the header to the requests sent with it through a
+// requestHeaderPipeline, for the options of the service which azblob does not expose
+func withRequestHeader(ctx context.Context, key string, value string) context.Context {
+	header := http.Header{}
+	if parent, ok := ctx.Value(requestHeaderKey{}).(http.Header); ok {
+		header = parent.Clone()
+	}
+	header.Set(key, value)
+	return context.WithValue(ctx, requestHeaderKey{}, header)
+}
+
+// requestHeaderPipeline adds the headers of the context of each request to it
+type requestHeaderPipeline struct {
+	pipeline.Pipeline
+}
+
+// Do implements pipeline.Pipeline
+func (p requestHeaderPipeline) Do(ctx context.Context, factory pipeline.Factory, req pipeline.Request) (pipeline.Response, error) {
+	if header, ok := ctx.Value(requestHeaderKey{}).(http.Header); ok {
+		for key, values := range header {
+			req.Header[key] = values
+		}
+	}
+	return p.Pipeline.Do(ctx, factory, req)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// getXattr returns the xattr name of f, or the error of Getxattr
+func getXattr(f *File, name string) (string, error) {
+	resp := &fuse.GetxattrResponse{}
+	err := f.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: name}, resp)
+	return string(resp.Xattr), err
+}
+
+func TestArchiveTierAndRehydration(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.addBlob("cold.csv", []byte("2019"), nil)
+	fake.blobs["cold.csv"].tier = "Archive"
+	f := lookupFile(t, NewFS(NewBlobStorage(fake.ContainerURL())), "cold.csv")
+	openFile(t, f)
+
+	err := f.Read(ctx, &fuse.ReadRequest{Size: 4}, &fuse.ReadResponse{})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.ENODATA {
+		t.Errorf("Read of archived blob returned %v, want ENODATA", err)
+	}
+	if tier, err := getXattr(f, xattrTier); err != nil || tier != "Archive" {
+		t.Errorf("tier is %q, %v", tier, err)
+	}
+
+	if err := f.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrTier, Xattr: []byte("hot:high")}); err != nil {
+		t.Fatalf("Setxattr to rehydrate: %v", err)
+	}
+	for name, want := range map[string]string{
+		xattrTier:                         "Archive",
+		xattrAzure + "archive_status":     "rehydrate-pending-to-hot",
+		xattrAzure + "rehydrate_priority": "High",
+	} {
+		if got, err := getXattr(f, name); err != nil || got != want {
+			t.Errorf("%s is %q, %v, want %q", name, got, err, want)
+		}
+	}
+	err = f.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrTier, Xattr: []byte("Archive")})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EBUSY {
+		t.Errorf("Setxattr to archive while rehydrating returned %v, want EBUSY", err)
+	}
+
+	fake.rehydrate("cold.csv")
+	if got := readFile(t, f, 0, 4); got != "2019" {
+		t.Errorf("rehydrated blob reads %q", got)
+	}
+	// The priority only goes with rehydrations, the fake rejects it otherwise
+	if err := f.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrTier, Xattr: []byte("Cool:High")}); err != nil {
+		t.Fatalf("Setxattr to cool: %v", err)
+	}
+	if _, err := getXattr(f, xattrAzure+"archive_status"); err != fuse.ErrNoXattr {
+		t.Errorf("archive status of rehydrated blob returned %v", err)
+	}
+	if tier, _ := getXattr(f, xattrTier); tier != "Cool" {
+		t.Errorf("tier is %q after moving to Cool", tier)
+	}
+	err = f.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrTier, Xattr: []byte("Lukewarm")})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EINVAL {
+		t.Errorf("Setxattr of unknown tier returned %v, want EINVAL", err)
+	}
+	releaseFile(t, f)
+}
+
+func TestUploadTier(t *testing.T) {
+	saved := UploadTier
+	defer func() { UploadTier = saved }()
+	UploadTier = "cool"
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	store := NewBlobStorage(fake.ContainerURL())
+
+	if err := store.Put(ctx, "a", []byte("a"), nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	store.StageBlock(ctx, "b", "AAAA", []byte("b"))
+	if err := store.CommitBlocks(ctx, "b", []string{"AAAA"}, nil); err != nil {
+		t.Fatalf("CommitBlocks: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if tier := fake.blobs[name].tier; tier != "Cool" {
+			t.Errorf("%s was uploaded to tier %q, want Cool", name, tier)
+		}
+	}
+}
+
+func TestParseTierXattr(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		tier     azblob.AccessTierType
+		priority azblob.RehydratePriorityType
+	}{
+		{"Hot", azblob.AccessTierHot, azblob.RehydratePriorityStandard},
+		{"cool\n", azblob.AccessTierCool, azblob.RehydratePriorityStandard},
+		{"HOT:high", azblob.AccessTierHot, azblob.RehydratePriorityHigh},
+	} {
+		tier, priority, err := parseTierXattr(tc.value)
+		if err != nil || tier != tc.tier || priority != tc.priority {
+			t.Errorf("parseTierXattr(%q) = %s, %s, %v", tc.value, tier, priority, err)
+		}
+	}
+	for _, value := range []string{"", "Premium", "Hot:Urgent", ":High"} {
+		if _, _, err := parseTierXattr(value); err == nil {
+			t.Errorf("parseTierXattr(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// trashPrefix holds the blobs of the files removed while TrashRetention is set, under their path. It is
+// hidden from the root directory.
+const trashPrefix = ".blobfuse-go-trash/"
+
+// trashPurgeInterval is the longest time between two purges of the expired files of the trash
+const trashPurgeInterval = time.Hour
+
+// errNotRestored is returned when reading a deleted blob, its content is only available once restored
+var errNotRestored = fuse.Errno(syscall.ENODATA)
+
+// lookupTrash returns the trash directory when name is TrashDir in the root directory and removed
+// files are kept, by the service with soft delete or by TrashRetention
+func (d *Dir) lookupTrash(name string) (fs.Node, bool) {
+	if TrashDir == "" || name != TrashDir || d != d.fs.root || d.fs.readOnly {
+		return nil, false
+	}
+	if _, softDelete := softDeleteStorage(d.fs.store); !softDelete && TrashRetention == 0 {
+		return nil, false
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.trash == nil {
+		view := &FS{store: &trashStorage{store: d.fs.store}, readOnly: true, parent: d.fs}
+		d.trash = view.NewDir("", DefaultDirMode&^0o222, 0, time.Now())
+	}
+	return d.trash, true
+}
+
+// softDeleteStorage returns store as a TrashStorage when the account keeps deleted blobs
+func softDeleteStorage(store Storage) (TrashStorage, bool) {
+	ts, ok := store.(TrashStorage)
+	return ts, ok && ts.SoftDeleteEnabled()
+}
+
+// discard deletes the blob, or moves it to the trash while TrashRetention is set
+func (m *FS) discard(ctx context.Context, name string) error {
+	if TrashRetention == 0 {
+		return m.store.Delete(ctx, name)
+	}
+	if err := m.store.Copy(ctx, name, trashPrefix+name); err != nil {
+		return err
+	}
+	return m.store.Delete(ctx, name)
+}
+
+// purgeTrash deletes the blobs of the trash which were removed more than TrashRetention ago
+func (m *FS) purgeTrash(ctx context.Context) error {
+	blobItems, err := m.store.ListRecursive(ctx, trashPrefix)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(-TrashRetention)
+	for _, blob := range blobItems {
+		if blob.LastModified.After(expiry) {
+			continue
+		}
+		if err := m.store.Delete(ctx, blob.Name); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepPurgingTrash purges the trash every trashPurgeInterval or TrashRetention if shorter, until the
+// process exits
+func (m *FS) keepPurgingTrash() {
+	interval := trashPurgeInterval
+	if TrashRetention < interval {
+		interval = TrashRetention
+	}
+	for {
+		if err := m.purgeTrash(context.Background()); err != nil {
+			log.Printf("Error in purging the trash: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// restore moves the file or directory n of the trash called req.OldName back to its path in nd of the
+// mount, restoring its blobs. Both directories are locked.
+func (d *Dir) restore(ctx context.Context, ts *trashStorage, n fs.Node, req *fuse.RenameRequest, nd *Dir) error {
+	if nd.fs != d.fs.parent {
+		return errReadOnly
+	}
+	if nd.path+req.NewName != d.path+req.OldName {
+		// Files are only restored where they were, they are copied elsewhere by mv
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if _, exists := nd.nodes[req.NewName]; exists {
+		return fuse.EEXIST
+	}
+	var names []string
+	switch n := n.(type) {
+	case *File:
+		if _, err := nd.fs.store.GetProperties(ctx, n.path); err == nil {
+			return fuse.EEXIST
+		} else if !isNotFound(err) {
+			log.Printf("Error in reading properties of %s: %v", n.path, err)
+			return toErrno(err)
+		}
+		names = append(names, n.path)
+	case *Dir:
+		blobItems, err := ts.ListRecursive(ctx, n.path)
+		if err != nil {
+			log.Printf("Error in listing %s in the trash: %v", n.path, err)
+			return toErrno(err)
+		}
+		for _, blob := range blobItems {
+			names = append(names, blob.Name)
+		}
+		// The metadata marker of the directory is next to it
+		marker := strings.TrimSuffix(n.path, "/")
+		if _, err := ts.GetProperties(ctx, marker); err == nil {
+			names = append(names, marker)
+		}
+	}
+	for _, name := range names {
+		if err := ts.restore(ctx, name); err != nil {
+			log.Printf("Error in restoring %s: %v", name, err)
+			return toErrno(err)
+		}
+	}
+	log.Printf("Restored %s from the trash", d.path+req.OldName)
+	leaveView(n, nd.fs)
+	nd.addNode(req.NewName, n)
+	delete(d.nodes, req.OldName)
+	return nil
+}
+
+// leaveView moves a node of a read-only view and everything below it to the file system m of the mount
+func leaveView(node fs.Node, m *FS) {
+	switch n := node.(type) {
+	case *Dir:
+		n.Lock()
+		defer n.Unlock()
+		n.fs = m
+		n.attr.Mode |= DefaultDirMode & 0o222
+		for _, child := range n.nodes {
+			leaveView(child, m)
+		}
+	case *File:
+		n.Lock()
+		defer n.Unlock()
+		n.fs = m
+		n.attr.Mode |= DefaultFileMode & 0o222
+	}
+}
+
+// trashStorage is the read-only Storage of the removed blobs, those soft deleted by the service and
+// those moved under trashPrefix. Deleted blobs cannot be read until they are restored.
+type trashStorage struct {
+	store Storage
+}
+
+var _ Storage = (*trashStorage)(nil)
+
+// list returns the removed blobs under prefix, directly under it with the prefixes below it unless recursive
+func (s *trashStorage) list(ctx context.Context, prefix string, recursive bool) ([]BlobAttr, []string, error) {
+	var blobItems []BlobAttr
+	var prefixes []string
+	if ts, ok := softDeleteStorage(s.store); ok {
+		deleted, deletedPrefixes, err := ts.ListDeleted(ctx, prefix, recursive)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, blob := range deleted {
+			if !strings.HasPrefix(blob.Name, trashPrefix) {
+				blobItems = append(blobItems, blob)
+			}
+		}
+		for _, p := range deletedPrefixes {
+			if p != trashPrefix {
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	var trashed []BlobAttr
+	var trashedPrefixes []string
+	var err error
+	if recursive {
+		trashed, err = s.store.ListRecursive(ctx, trashPrefix+prefix)
+	} else {
+		trashed, trashedPrefixes, err = s.store.List(ctx, trashPrefix+prefix)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, blob := range trashed {
+		blob.Name = strings.TrimPrefix(blob.Name, trashPrefix)
+		blob.DeletedTime = blob.LastModified
+		blobItems = append(blobItems, blob)
+	}
+	for _, p := range trashedPrefixes {
+		prefixes = append(prefixes, strings.TrimPrefix(p, trashPrefix))
+	}
+	return latestRemoved(blobItems), uniqueStrings(prefixes), nil
+}
+
+// latestRemoved returns the last removed blob of each name sorted by name
+func latestRemoved(blobItems []BlobAttr) []BlobAttr {
+	sort.SliceStable(blobItems, func(i, j int) bool {
+		if blobItems[i].Name != blobItems[j].Name {
+			return blobItems[i].Name < blobItems[j].Name
+		}
+		return blobItems[i].DeletedTime.After(blobItems[j].DeletedTime)
+	})
+	latest := blobItems[:0]
+	for _, blob := range blobItems {
+		if len(latest) == 0 || latest[len(latest)-1].Name != blob.Name {
+			latest = append(latest, blob)
+		}
+	}
+	return latest
+}
+
+// uniqueStrings returns the sorted distinct strings of s
+func uniqueStrings(s []string) []string {
+	sort.Strings(s)
+	unique := s[:0]
+	for _, v := range s {
+		if len(unique) == 0 || unique[len(unique)-1] != v {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// restore restores the removed blob to its path, from the trash or with the soft delete of the service
+func (s *trashStorage) restore(ctx context.Context, name string) error {
+	_, err := s.store.GetProperties(ctx, trashPrefix+name)
+	if err == nil {
+		if err := s.store.Copy(ctx, trashPrefix+name, name); err != nil {
+			return err
+		}
+		return s.store.Delete(ctx, trashPrefix+name)
+	}
+	ts, ok := softDeleteStorage(s.store)
+	if !isNotFound(err) || !ok {
+		return err
+	}
+	return ts.Undelete(ctx, name)
+}
+
+// List returns the removed blobs directly under prefix and the prefixes below it
+func (s *trashStorage) List(ctx context.Context, prefix string) ([]BlobAttr, []string, error) {
+	return s.list(ctx, prefix, false)
+}
+
+// ListRecursive returns every removed blob under prefix
+func (s *trashStorage) ListRecursive(ctx context.Context, prefix string) ([]BlobAttr, error) {
+	blobItems, _, err := s.list(ctx, prefix, true)
+	return blobItems, err
+}
+
+// GetRange fills b with the content of the blob in the trash starting at offset, soft deleted blobs
+// cannot be read
+func (s *trashStorage) GetRange(ctx context.Context, name string, offset int64, b []byte) error {
+	err := s.store.GetRange(ctx, trashPrefix+name, offset, b)
+	if isNotFound(err) {
+		return errNotRestored
+	}
+	return err
+}
+
+// GetProperties returns the properties and metadata of the last removed blob with name
+func (s *trashStorage) GetProperties(ctx context.Context, name string) (BlobAttr, error) {
+	if name == "" || strings.HasSuffix(name, "/") {
+		return BlobAttr{}, ErrBlobNotFound
+	}
+	blobItems, _, err := s.list(ctx, name, false)
+	if err != nil {
+		return BlobAttr{}, err
+	}
+	for _, blob := range blobItems {
+		if blob.Name == name {
+			return blob, nil
+		}
+	}
+	return BlobAttr{}, ErrBlobNotFound
+}
+
+// Put fails, the trash is read-only
+func (s *trashStorage) Put(ctx context.Context, name string, data []byte, metadata map[string]string) error {
+	return errReadOnly
+}
+
+// StageBlock fails, the trash is read-only
+func (s *trashStorage) StageBlock(ctx context.Context, name string, blockID string, data []byte) error {
+	return errReadOnly
+}
+
+// CommitBlocks fails, the trash is read-only
+func (s *trashStorage) CommitBlocks(ctx context.Context, name string, blockIDs []string, metadata map[string]string) error {
+	return errReadOnly
+}
+
+// Delete fails, files leave the trash by being restored or when they expire
+func (s *trashStorage) Delete(ctx context.Context, name string) error {
+	return errReadOnly
+}
+
+// Copy fails, the trash is read-only
+func (s *trashStorage) Copy(ctx context.Context, src string, dst string) error {
+	return errReadOnly
+}
+
+// SetMetadata fails, the trash is read-only
+func (s *trashStorage) SetMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	return errReadOnly
+}
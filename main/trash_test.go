@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// lookupDir returns the directory name of d
+func lookupDir(t *testing.T, d *Dir, name string) *Dir {
+	t.Helper()
+	readDirNames(t, d)
+	n, err := d.Lookup(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Lookup %s: %v", name, err)
+	}
+	return n.(*Dir)
+}
+
+func TestTrashWithSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	fake.softDelete = true
+	fake.addBlob("dir/a.txt", []byte("a"), nil)
+	fake.addBlob("dir/b.txt", []byte("b"), nil)
+	store := NewBlobStorage(fake.ContainerURL())
+	store.softDelete = detectSoftDelete(ctx, fake.ServiceURL())
+	filesys := NewFS(store)
+	dir := lookupDir(t, filesys.root, "dir")
+	readDirNames(t, dir)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := dir.Remove(ctx, &fuse.RemoveRequest{Name: name}); err != nil {
+			t.Fatalf("Remove %s: %v", name, err)
+		}
+	}
+
+	if _, listed := readDirNames(t, filesys.root)[TrashDir]; listed {
+		t.Errorf("%s is listed", TrashDir)
+	}
+	trashed := lookupDir(t, lookupDir(t, filesys.root, TrashDir), "dir")
+	if names := readDirNames(t, trashed); len(names) != 2 {
+		t.Errorf("trash lists %v, want a.txt and b.txt", names)
+	}
+	n, err := trashed.Lookup(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Lookup a.txt in trash: %v", err)
+	}
+	f := n.(*File)
+	openFile(t, f)
+	err = f.Read(ctx, &fuse.ReadRequest{Size: 1}, &fuse.ReadResponse{})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.ENODATA {
+		t.Errorf("Read of deleted blob returned %v, want ENODATA", err)
+	}
+	releaseFile(t, f)
+	if _, err := getXattr(f, xattrAzure+"deleted_time"); err != nil {
+		t.Errorf("deleted time: %v", err)
+	}
+
+	err = trashed.Rename(ctx, &fuse.RenameRequest{OldName: "b.txt", NewName: "c.txt"}, dir)
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EXDEV {
+		t.Errorf("Rename to another name returned %v, want EXDEV", err)
+	}
+	if err := trashed.Rename(ctx, &fuse.RenameRequest{OldName: "a.txt", NewName: "a.txt"}, dir); err != nil {
+		t.Fatalf("Rename out of the trash: %v", err)
+	}
+	if data, _, exists := fake.blob("dir/a.txt"); !exists || string(data) != "a" {
+		t.Errorf("restored blob is %q, %v", data, exists)
+	}
+	if f.fs != filesys || f.attr.Mode&0o200 == 0 {
+		t.Errorf("restored file is still read-only")
+	}
+	if names := readDirNames(t, trashed); len(names) != 1 {
+		t.Errorf("trash lists %v after the restore, want b.txt", names)
+	}
+}
+
+func TestTrashWithoutSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeBlobService(t, "testcontainer")
+	store := NewBlobStorage(fake.ContainerURL())
+	if store.softDelete = detectSoftDelete(ctx, fake.ServiceURL()); store.softDelete {
+		t.Errorf("soft delete detected on an account without a delete retention policy")
+	}
+	if _, err := NewFS(store).root.Lookup(ctx, TrashDir); err != fuse.ENOENT {
+		t.Errorf("Lookup of %s without soft delete returned %v", TrashDir, err)
+	}
+}
+
+func TestLocalTrash(t *testing.T) {
+	saved := TrashRetention
+	defer func() { TrashRetention = saved }()
+	TrashRetention = time.Hour
+	ctx := context.Background()
+	store := NewMemStorage()
+	store.Put(ctx, "dir/x.txt", []byte("x"), nil)
+	filesys := NewFS(store)
+	dir := lookupDir(t, filesys.root, "dir")
+	readDirNames(t, dir)
+	if err := dir.Remove(ctx, &fuse.RemoveRequest{Name: "x.txt"}); err != nil {
+		t.Fatalf("Remove x.txt: %v", err)
+	}
+	if err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "dir", Dir: true}); err != nil {
+		t.Fatalf("Remove dir: %v", err)
+	}
+	if _, err := store.GetProperties(ctx, trashPrefix+"dir/x.txt"); err != nil {
+		t.Fatalf("removed file is not in the trash: %v", err)
+	}
+	names := readDirNames(t, filesys.root)
+	if len(names) != 0 {
+		t.Errorf("root lists %v", names)
+	}
+
+	trash := lookupDir(t, filesys.root, TrashDir)
+	trashed := lookupDir(t, trash, "dir")
+	n, err := trashed.Lookup(ctx, "x.txt")
+	if err != nil {
+		t.Fatalf("Lookup x.txt in trash: %v", err)
+	}
+	f := n.(*File)
+	openFile(t, f)
+	if got := readFile(t, f, 0, 1); got != "x" {
+		t.Errorf("trashed file reads %q", got)
+	}
+	releaseFile(t, f)
+
+	if err := trash.Rename(ctx, &fuse.RenameRequest{OldName: "dir", NewName: "dir"}, filesys.root); err != nil {
+		t.Fatalf("Rename out of the trash: %v", err)
+	}
+	if _, err := store.GetProperties(ctx, "dir/x.txt"); err != nil {
+		t.Errorf("restored blob: %v", err)
+	}
+	if blobItems, _ := store.ListRecursive(ctx, trashPrefix); len(blobItems) != 0 {
+		t.Errorf("trash holds %v after the restore", blobItems)
+	}
+	dir = lookupDir(t, filesys.root, "dir")
+	readDirNames(t, dir)
+	err = dir.Rename(ctx, &fuse.RenameRequest{OldName: "x.txt", NewName: "x.txt"}, trash)
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EXDEV {
+		t.Errorf("Rename into the trash returned %v, want EXDEV", err)
+	}
+	if _, err := store.GetProperties(ctx, "dir/x.txt"); err != nil {
+		t.Errorf("file renamed into the trash: %v", err)
+	}
+	if _, err := store.GetProperties(ctx, "x.txt"); err != ErrBlobNotFound {
+		t.Errorf("file renamed into the trash was moved to the root: %v", err)
+	}
+
+	if _, err := filesys.root.Mkdir(ctx, &fuse.MkdirRequest{Name: "empty", Mode: os.ModeDir | 0o750}); err != nil {
+		t.Fatalf("Mkdir empty: %v", err)
+	}
+	if err := filesys.root.Remove(ctx, &fuse.RemoveRequest{Name: "empty", Dir: true}); err != nil {
+		t.Fatalf("Remove empty: %v", err)
+	}
+	if _, err := store.GetProperties(ctx, trashPrefix+"empty"); err != nil {
+		t.Errorf("marker of the removed directory is not in the trash: %v", err)
+	}
+	store.Put(ctx, trashPrefix+"old.txt", []byte("old"), nil)
+	TrashRetention = time.Nanosecond
+	if err := filesys.purgeTrash(ctx); err != nil {
+		t.Fatalf("purgeTrash: %v", err)
+	}
+	if _, err := store.GetProperties(ctx, trashPrefix+"old.txt"); err != ErrBlobNotFound {
+		t.Errorf("expired file is still in the trash: %v", err)
+	}
+}
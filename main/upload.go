@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// maxBlocks is the largest number of blocks a block blob can be committed with
+const maxBlocks = 50000
+
+// blockUpload streams a file written sequentially from offset 0 to the storage as blocks of BlockSize,
+// so that memory stays bounded to one block whatever the size of the file
+type blockUpload struct {
+	prefix    string   // random prefix making the block ids of this upload unique
+	ids       []string // ids of the staged blocks in order
+	size      int64    // length of the content of the staged blocks
+	committed int64    // length of the content of the blocks committed, which the storage can read
+	buf       []byte   // content written after the last staged block
+}
+
+func newBlockUpload() *blockUpload {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &blockUpload{prefix: hex.EncodeToString(b)}
+}
+
+// nextID returns the id of the next block, all ids of an upload have the same length
+func (u *blockUpload) nextID() string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s%08d", u.prefix, len(u.ids))))
+}
+
+// stage uploads data as the next block
+func (u *blockUpload) stage(ctx context.Context, store Storage, name string, data []byte) error {
+	if len(u.ids) >= maxBlocks {
+		log.Printf("File %s exceeds %d blocks of %d bytes", name, maxBlocks, BlockSize)
+		return fuse.Errno(syscall.EFBIG)
+	}
+	id := u.nextID()
+	if err := store.StageBlock(ctx, name, id, data); err != nil {
+		log.Printf("Error in staging block %d of %s: %v", len(u.ids), name, err)
+		return toErrno(err)
+	}
+	u.ids = append(u.ids, id)
+	u.size += int64(len(data))
+	return nil
+}
+
+// uncommitted tells whether the length bytes at offset are partly in blocks staged but not committed
+// yet, which cannot be read back
+func (u *blockUpload) uncommitted(offset int64, length int64) bool {
+	end := offset + length
+	if end > u.size {
+		end = u.size
+	}
+	return offset < end && end > u.committed
+}
+
+// readUpload fills b with the content written starting at offset, from the committed blocks and the
+// buffer. The lock must be held.
+func (f *File) readUpload(ctx context.Context, offset int64, b []byte) error {
+	u := f.upload
+	n := int64(0)
+	if offset < u.size {
+		if n = u.size - offset; n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		// The cached copy, if any, is older than the upload
+		if err := f.fs.store.GetRange(ctx, f.path, offset, b[:n]); err != nil {
+			log.Printf("Error in reading %s at %d: %v", f.path, offset, err)
+			return toErrno(err)
+		}
+	}
+	copy(b[n:], u.buf[offset+n-u.size:])
+	return nil
+}
+
+// appendData adds data at the end of the upload and stages every block which is full, the lock must be held
+func (f *File) appendData(ctx context.Context, data []byte) error {
+	u := f.upload
+	staged, size := len(u.ids), u.size
+	// u.buf is left as it was until every full block is staged, a failed write adds nothing
+	buf := append(u.buf, data...)
+	var offset uint64
+	for uint64(len(buf))-offset >= BlockSize {
+		if err := u.stage(ctx, f.fs.store, f.path, buf[offset:offset+BlockSize]); err != nil {
+			u.ids, u.size = u.ids[:staged], size
+			return err
+		}
+		offset += BlockSize
+	}
+	u.buf = buf[:copy(buf, buf[offset:])]
+	f.attr.Size += uint64(len(data))
+	atomic.AddInt64(&f.fs.size, int64(len(data)))
+	f.isMod = true
+	return nil
+}
+
+// commitUpload makes the content written so far the content of the blob, the lock must be held.
+// The upload stays open so that later appends extend the committed blocks.
+func (f *File) commitUpload(ctx context.Context) error {
+	u := f.upload
+	if len(u.ids) == 0 {
+		// Smaller than a block, a single request suffices. The content stays buffered
+		// until a block is full, so that it can become the first block.
+		if err := f.fs.store.Put(ctx, f.path, u.buf, f.metadata); err != nil {
+			log.Printf("Error in uploading %s: %v", f.path, err)
+			return toErrno(err)
+		}
+		f.isMod = false
+		return nil
+	}
+	if len(u.buf) > 0 {
+		if err := u.stage(ctx, f.fs.store, f.path, u.buf); err != nil {
+			return err
+		}
+		u.buf = u.buf[:0]
+	}
+	if err := f.fs.store.CommitBlocks(ctx, f.path, u.ids, f.metadata); err != nil {
+		log.Printf("Error in committing %d blocks of %s: %v", len(u.ids), f.path, err)
+		return toErrno(err)
+	}
+	u.committed = u.size
+	f.isMod = false
+	return nil
+}
+
+// endUpload commits the upload and switches the file back to reading from the storage, the lock must be held.
+// Content smaller than a block is kept in memory instead.
+func (f *File) endUpload(ctx context.Context) error {
+	u := f.upload
+	if len(u.ids) == 0 {
+		f.data, f.loaded = u.buf, true
+		f.upload = nil
+		return nil
+	}
+	if f.isMod {
+		if err := f.commitUpload(ctx); err != nil {
+			return err
+		}
+	}
+	f.upload = nil
+	f.data, f.loaded = make([]byte, 0), false
+	return nil
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Extended attributes kept in the metadata of blobs, those under user.azure. are properties of
+// the blob, read-only except for the tier
+const (
+	xattrUser  = "user."
+	xattrAzure = "user.azure."
+)
+
+// Flags of setxattr, as on Linux
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+// Getxattr implements NodeGetxattrer for directories, user xattrs are kept in the directory marker
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if !strings.HasPrefix(req.Name, xattrUser) {
+		return d.fs.getxattr(ctx, strings.TrimSuffix(d.path, "/"), req, resp)
+	}
+	d.RLock()
+	blob, exists, err := d.marker(ctx)
+	d.RUnlock()
+	if err != nil {
+		return err
+	}
+	value, ok := blobXattr(blob, blob.Metadata, req.Name)
+	if !exists || !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = value
+	return nil
+}
+
+// Listxattr implements NodeListxattrer for directories
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if err := d.fs.listxattr(ctx, strings.TrimSuffix(d.path, "/"), true, resp); err != nil {
+		return err
+	}
+	d.RLock()
+	blob, exists, err := d.marker(ctx)
+	d.RUnlock()
+	if err != nil || !exists {
+		return err
+	}
+	appendBlobXattrs(resp, blob, blob.Metadata)
+	return nil
+}
+
+// Setxattr implements NodeSetxattrer for directories
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if strings.HasPrefix(req.Name, xattrUser) {
+		return d.setUserXattr(ctx, req.Name, req.Xattr, req.Flags)
+	}
+	acl, err := d.fs.setxattr(ctx, strings.TrimSuffix(d.path, "/"), true, req.Name, req.Xattr)
+	if err == nil {
+		d.Lock()
+		applyACLMode(&d.attr, acl)
+		d.Unlock()
+	}
+	return err
+}
+
+// Removexattr implements NodeRemovexattrer for directories
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if strings.HasPrefix(req.Name, xattrUser) {
+		return d.setUserXattr(ctx, req.Name, nil, 0)
+	}
+	acl, err := d.fs.setxattr(ctx, strings.TrimSuffix(d.path, "/"), true, req.Name, nil)
+	if err == nil {
+		d.Lock()
+		applyACLMode(&d.attr, acl)
+		d.Unlock()
+	}
+	return err
+}
+
+// marker returns the marker blob of the directory, exists is false for the root and virtual directories.
+// The lock must be held.
+func (d *Dir) marker(ctx context.Context) (blob BlobAttr, exists bool, err error) {
+	if d.path == "" {
+		return BlobAttr{}, false, nil
+	}
+	name := strings.TrimSuffix(d.path, "/")
+	blob, err = d.fs.store.GetProperties(ctx, name)
+	if isNotFound(err) {
+		return BlobAttr{}, false, nil
+	}
+	if err != nil {
+		log.Printf("Error in reading properties of %s: %v", name, err)
+		return BlobAttr{}, false, toErrno(err)
+	}
+	return blob, isDirBlob(blob), nil
+}
+
+// setUserXattr sets the user xattr name of the directory, or removes it when value is nil, creating
+// the marker of virtual directories
+func (d *Dir) setUserXattr(ctx context.Context, name string, value []byte, flags uint32) error {
+	if strings.HasPrefix(name, xattrAzure) {
+		return fuse.Errno(syscall.EPERM)
+	}
+	if d.path == "" {
+		// The root has no blob to keep them
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.updateMetadata(ctx, func(metadata map[string]string) error {
+		return updateUserXattr(metadata, name, value, flags)
+	})
+}
+
+// Access implements NodeAccesser for directories
+func (d *Dir) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	d.RLock()
+	attr := d.attr
+	d.RUnlock()
+	return d.fs.access(ctx, strings.TrimSuffix(d.path, "/"), attr, req)
+}
+
+// Getxattr implements NodeGetxattrer for files, user xattrs are kept in the metadata of the blob
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if !strings.HasPrefix(req.Name, xattrUser) {
+		return f.fs.getxattr(ctx, f.currentPath(), req, resp)
+	}
+	var value []byte
+	var ok bool
+	if strings.HasPrefix(req.Name, xattrAzure) {
+		blob, _, err := f.fs.properties(ctx, f.currentPath())
+		if err != nil {
+			return err
+		}
+		value, ok = azureXattrs(blob)[req.Name]
+	} else {
+		f.Lock()
+		err := f.loadMetadata(ctx)
+		value, ok = userXattr(f.metadata, strings.TrimPrefix(req.Name, xattrUser))
+		f.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = value
+	return nil
+}
+
+// Listxattr implements NodeListxattrer for files
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	path := f.currentPath()
+	if err := f.fs.listxattr(ctx, path, false, resp); err != nil {
+		return err
+	}
+	blob, _, err := f.fs.properties(ctx, path)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	err = f.loadMetadata(ctx)
+	metadata := copyMetadata(f.metadata)
+	f.Unlock()
+	if err != nil {
+		return err
+	}
+	appendBlobXattrs(resp, blob, metadata)
+	return nil
+}
+
+// Setxattr implements NodeSetxattrer for files
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if strings.HasPrefix(req.Name, xattrUser) {
+		return f.setUserXattr(ctx, req.Name, req.Xattr, req.Flags)
+	}
+	acl, err := f.fs.setxattr(ctx, f.currentPath(), false, req.Name, req.Xattr)
+	if err == nil {
+		f.Lock()
+		applyACLMode(&f.attr, acl)
+		f.Unlock()
+	}
+	return err
+}
+
+// Removexattr implements NodeRemovexattrer for files
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if strings.HasPrefix(req.Name, xattrUser) {
+		return f.setUserXattr(ctx, req.Name, nil, 0)
+	}
+	acl, err := f.fs.setxattr(ctx, f.currentPath(), false, req.Name, nil)
+	if err == nil {
+		f.Lock()
+		applyACLMode(&f.attr, acl)
+		f.Unlock()
+	}
+	return err
+}
+
+// setUserXattr sets the user xattr name of the file, or removes it when value is nil. Modified content
+// carries the metadata when it is uploaded.
+func (f *File) setUserXattr(ctx context.Context, name string, value []byte, flags uint32) error {
+	if f.fs.readOnly {
+		return errReadOnly
+	}
+	if name == xattrTier && value != nil {
+		return f.setTier(ctx, value)
+	}
+	if name == xattrSnapshot && value != nil {
+		return f.createSnapshot(ctx)
+	}
+	if strings.HasPrefix(name, xattrAzure) {
+		return fuse.Errno(syscall.EPERM)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if err := f.loadMetadata(ctx); err != nil {
+		return err
+	}
+	metadata := copyMetadata(f.metadata)
+	if err := updateUserXattr(metadata, name, value, flags); err != nil {
+		return err
+	}
+	if !f.isMod && !f.removed {
+		if err := f.fs.store.SetMetadata(ctx, f.path, metadata); err != nil {
+			log.Printf("Error in setting metadata of %s: %v", f.path, err)
+			return toErrno(err)
+		}
+	}
+	f.metadata = metadata
+	return nil
+}
+
+// Access implements NodeAccesser for files
+func (f *File) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	f.RLock()
+	attr, path := f.attr, f.path
+	f.RUnlock()
+	return f.fs.access(ctx, path, attr, req)
+}
+
+// currentPath returns the path of the file, which changes when it is renamed
+func (f *File) currentPath() string {
+	f.RLock()
+	defer f.RUnlock()
+	return f.path
+}
+
+// properties returns the properties of the blob at path, exists is false when there is none
+func (m *FS) properties(ctx context.Context, path string) (blob BlobAttr, exists bool, err error) {
+	blob, err = m.store.GetProperties(ctx, path)
+	if isNotFound(err) {
+		return BlobAttr{}, false, nil
+	}
+	if err != nil {
+		log.Printf("Error in reading properties of %s: %v", path, err)
+		return BlobAttr{}, false, toErrno(err)
+	}
+	return blob, true, nil
+}
+
+// updateUserXattr sets the user xattr name in metadata, or removes it when value is nil, honoring
+// the XATTR_CREATE and XATTR_REPLACE flags
+func updateUserXattr(metadata map[string]string, name string, value []byte, flags uint32) error {
+	name = strings.TrimPrefix(name, xattrUser)
+	_, exists := userXattr(metadata, name)
+	switch {
+	case exists && flags&xattrCreate != 0:
+		return fuse.EEXIST
+	case !exists && (value == nil || flags&xattrReplace != 0):
+		return fuse.ErrNoXattr
+	}
+	setUserXattr(metadata, name, value)
+	return nil
+}
+
+// blobXattr returns the user xattr name of a blob with the metadata
+func blobXattr(blob BlobAttr, metadata map[string]string, name string) ([]byte, bool) {
+	if strings.HasPrefix(name, xattrAzure) {
+		value, ok := azureXattrs(blob)[name]
+		return value, ok
+	}
+	return userXattr(metadata, strings.TrimPrefix(name, xattrUser))
+}
+
+// appendBlobXattrs lists the user xattrs of a blob with the metadata, followed by its properties
+func appendBlobXattrs(resp *fuse.ListxattrResponse, blob BlobAttr, metadata map[string]string) {
+	for _, name := range userXattrNames(metadata) {
+		if !strings.HasPrefix(xattrUser+name, xattrAzure) {
+			resp.Append(xattrUser + name)
+		}
+	}
+	properties := azureXattrs(blob)
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Append(names...)
+}
+
+// azureXattrs returns the properties of a blob shown as read-only xattrs, those the service did not
+// return are left out
+func azureXattrs(blob BlobAttr) map[string][]byte {
+	xattrs := make(map[string][]byte)
+	if blob.ETag != "" {
+		xattrs[xattrAzure+"etag"] = []byte(blob.ETag)
+	}
+	if !blob.LastModified.IsZero() {
+		xattrs[xattrAzure+"last_modified"] = []byte(blob.LastModified.UTC().Format(time.RFC3339))
+	}
+	if len(blob.ContentMD5) > 0 {
+		xattrs[xattrAzure+"content_md5"] = []byte(hex.EncodeToString(blob.ContentMD5))
+	}
+	if blob.ContentType != "" {
+		xattrs[xattrAzure+"content_type"] = []byte(blob.ContentType)
+	}
+	if blob.AccessTier != "" {
+		xattrs[xattrTier] = []byte(blob.AccessTier)
+	}
+	if blob.ArchiveStatus != "" {
+		xattrs[xattrAzure+"archive_status"] = []byte(blob.ArchiveStatus)
+	}
+	if blob.RehydratePriority != "" {
+		xattrs[xattrAzure+"rehydrate_priority"] = []byte(blob.RehydratePriority)
+	}
+	if blob.Snapshot != "" {
+		xattrs[xattrSnapshot] = []byte(blob.Snapshot)
+	}
+	if blob.VersionID != "" {
+		xattrs[xattrVersionID] = []byte(blob.VersionID)
+	}
+	if !blob.DeletedTime.IsZero() {
+		xattrs[xattrAzure+"deleted_time"] = []byte(blob.DeletedTime.UTC().Format(time.RFC3339))
+	}
+	return xattrs
+}
+
+// accessControl returns the access control of path when the account has a hierarchical namespace
+func (m *FS) accessControl(ctx context.Context, path string) (HierarchicalStorage, []aclEntry, error) {
+	hs, ok := m.store.(HierarchicalStorage)
+	if !ok {
+		return nil, nil, fuse.Errno(syscall.ENOTSUP)
+	}
+	ac, err := hs.GetAccessControl(ctx, path)
+	if err != nil {
+		log.Printf("Error in reading access control of %s: %v", path, err)
+		return nil, nil, toErrno(err)
+	}
+	entries, err := parseACL(ac.ACL)
+	if err != nil {
+		log.Printf("Error in reading access control of %s: %v", path, err)
+		return nil, nil, fuse.EIO
+	}
+	return hs, entries, nil
+}
+
+// getxattr returns the extended attribute of path, the ACLs of accounts with a hierarchical namespace
+func (m *FS) getxattr(ctx context.Context, path string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	switch req.Name {
+	case xattrACLAccess, xattrACLDefault:
+		_, entries, err := m.accessControl(ctx, path)
+		if err != nil {
+			return err
+		}
+		entries = aclScope(entries, req.Name == xattrACLDefault)
+		if len(entries) == 0 {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = encodeACLXattr(entries)
+		return nil
+	}
+	return fuse.ErrNoXattr
+}
+
+// listxattr lists the extended attributes of path
+func (m *FS) listxattr(ctx context.Context, path string, dir bool, resp *fuse.ListxattrResponse) error {
+	if _, ok := m.store.(HierarchicalStorage); !ok {
+		return nil
+	}
+	resp.Append(xattrACLAccess)
+	if dir {
+		_, entries, err := m.accessControl(ctx, path)
+		if err != nil {
+			return err
+		}
+		if len(aclScope(entries, true)) > 0 {
+			resp.Append(xattrACLDefault)
+		}
+	}
+	return nil
+}
+
+// setxattr sets the extended attribute of path to value, or removes it when value is nil like an empty
+// ACL does on Linux. It returns the new ACL of the path.
+func (m *FS) setxattr(ctx context.Context, path string, dir bool, name string, value []byte) (string, error) {
+	if name != xattrACLAccess && name != xattrACLDefault {
+		if value == nil {
+			return "", fuse.ErrNoXattr
+		}
+		return "", fuse.Errno(syscall.ENOTSUP)
+	}
+	defaults := name == xattrACLDefault
+	if defaults && !dir {
+		// Only directories have a default ACL
+		return "", fuse.Errno(syscall.EACCES)
+	}
+	hs, entries, err := m.accessControl(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	var replacement []aclEntry
+	switch {
+	case value != nil:
+		if replacement, err = decodeACLXattr(value, defaults); err != nil {
+			log.Printf("Error in setting %s of %s: %v", name, path, err)
+			return "", fuse.Errno(syscall.EINVAL)
+		}
+	case !defaults:
+		// Removing the access ACL leaves the permission bits
+		for _, e := range aclScope(entries, false) {
+			if e.qualifier == "" && e.tag != "mask" {
+				replacement = append(replacement, e)
+			}
+		}
+	}
+	acl := formatACL(replaceACL(entries, defaults, replacement))
+	if err := hs.SetAccessControl(ctx, path, acl); err != nil {
+		log.Printf("Error in setting access control of %s: %v", path, err)
+		return "", toErrno(err)
+	}
+	return acl, nil
+}
+
+// setModeACL makes the entries of the owner, the owning group or the mask and others in the access
+// ACL of path match mode, as chmod does with POSIX ACLs. It does nothing without a hierarchical namespace.
+func (m *FS) setModeACL(ctx context.Context, path string, mode os.FileMode) error {
+	if _, ok := m.store.(HierarchicalStorage); !ok {
+		return nil
+	}
+	hs, entries, err := m.accessControl(ctx, path)
+	if err != nil {
+		return err
+	}
+	groupTag := "group"
+	for _, e := range aclScope(entries, false) {
+		if e.tag == "mask" {
+			groupTag = "mask"
+		}
+	}
+	perm := uint16(mode.Perm())
+	for i, e := range entries {
+		if e.defaults || e.qualifier != "" {
+			continue
+		}
+		switch e.tag {
+		case "user":
+			entries[i].perm = perm >> 6 & 7
+		case groupTag:
+			entries[i].perm = perm >> 3 & 7
+		case "other":
+			entries[i].perm = perm & 7
+		}
+	}
+	if err := hs.SetAccessControl(ctx, path, formatACL(entries)); err != nil {
+		log.Printf("Error in setting access control of %s: %v", path, err)
+		return toErrno(err)
+	}
+	return nil
+}
+
+// applyACLMode updates the permission bits of attr to those of the access ACL in acl, the lock of
+// the node must be held
+func applyACLMode(attr *fuse.Attr, acl string) {
+	entries, err := parseACL(acl)
+	if err != nil {
+		return
+	}
+	if mode, ok := aclMode(entries); ok {
+		attr.Mode = attr.Mode&^0o777 | mode
+	}
+}
+
+// access checks req against the access ACL of path, which has the attributes attr. Without a
+// hierarchical namespace the storage is the only one to decide.
+func (m *FS) access(ctx context.Context, path string, attr fuse.Attr, req *fuse.AccessRequest) error {
+	hs, ok := m.store.(HierarchicalStorage)
+	if !ok {
+		return nil
+	}
+	ac, err := hs.GetAccessControl(ctx, path)
+	if err != nil {
+		log.Printf("Error in reading access control of %s: %v", path, err)
+		return toErrno(err)
+	}
+	posixAttr(&attr, ac)
+	entries, err := parseACL(ac.ACL)
+	if err != nil {
+		log.Printf("Error in reading access control of %s: %v", path, err)
+		return fuse.EIO
+	}
+	if !checkAccess(attr, entries, req) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
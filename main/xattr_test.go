@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// getACL returns the ACL xattr name of node decoded in the Data Lake format
+func getACL(t *testing.T, node interface {
+	Getxattr(context.Context, *fuse.GetxattrRequest, *fuse.GetxattrResponse) error
+}, name string) string {
+	t.Helper()
+	resp := &fuse.GetxattrResponse{}
+	if err := node.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: name}, resp); err != nil {
+		t.Fatalf("Getxattr %s: %v", name, err)
+	}
+	entries, err := decodeACLXattr(resp.Xattr, name == xattrACLDefault)
+	if err != nil {
+		t.Fatalf("Getxattr %s returned %v: %v", name, resp.Xattr, err)
+	}
+	return formatACL(entries)
+}
+
+// aclXattr encodes acl in the xattr format
+func aclXattr(t *testing.T, acl string) []byte {
+	entries, err := parseACL(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodeACLXattr(entries)
+}
+
+func TestPosixACLXattrs(t *testing.T) {
+	ctx := context.Background()
+	fake, store := newDataLakeStorage(t)
+	fake.addBlob("data/a.csv", []byte("a"), nil)
+	filesys := NewFS(store)
+	readDirNames(t, filesys.root)
+	n, _ := filesys.root.Lookup(ctx, "data")
+	data := n.(*Dir)
+	readDirNames(t, data)
+	n, _ = data.Lookup(ctx, "a.csv")
+	a := n.(*File)
+
+	if got, want := getACL(t, a, xattrACLAccess), "user::rw-,group::r--,other::---"; got != want {
+		t.Errorf("access ACL of file is %q, want %q", got, want)
+	}
+	if got, want := getACL(t, filesys.root, xattrACLAccess), "user::rwx,group::r-x,other::---"; got != want {
+		t.Errorf("access ACL of root is %q, want %q", got, want)
+	}
+
+	// setfacl -m u:1001:rw- a.csv
+	err := a.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrACLAccess, Xattr: aclXattr(t, "user::rw-,user:1001:rw-,group::r--,mask::rw-,other::---")})
+	if err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	if b := fake.blobs["data/a.csv"]; b.acl != "user::rw-,user:1001:rw-,group::r--,mask::rw-,other::---" || b.permissions != "rw-rw----+" {
+		t.Errorf("service has ACL %q and permissions %q", b.acl, b.permissions)
+	}
+	if a.attr.Mode.Perm() != 0o660 {
+		t.Errorf("file has mode %v after setfacl", a.attr.Mode)
+	}
+	for _, tc := range []struct {
+		uid  uint32
+		want error
+	}{
+		{1001, nil},
+		{1002, fuse.Errno(syscall.EACCES)},
+	} {
+		req := &fuse.AccessRequest{Header: fuse.Header{Uid: tc.uid, Gid: 3000}, Mask: 2}
+		if err := a.Access(ctx, req); err != tc.want {
+			t.Errorf("Access for writing by %d returned %v, want %v", tc.uid, err, tc.want)
+		}
+	}
+
+	// setfacl -d -m u::rwx,g::r-x,o::--- data
+	err = data.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrACLDefault, Xattr: aclXattr(t, "user::rwx,group::r-x,other::---")})
+	if err != nil {
+		t.Fatalf("Setxattr of default ACL: %v", err)
+	}
+	if got, want := getACL(t, data, xattrACLDefault), "default:user::rwx,default:group::r-x,default:other::---"; got != want {
+		t.Errorf("default ACL is %q, want %q", got, want)
+	}
+	list := &fuse.ListxattrResponse{}
+	if err := data.Listxattr(ctx, &fuse.ListxattrRequest{}, list); err != nil || !strings.HasPrefix(string(list.Xattr), xattrACLAccess+"\x00"+xattrACLDefault+"\x00"+xattrUser) {
+		t.Errorf("Listxattr returned %q, %v", list.Xattr, err)
+	}
+	if err := data.Removexattr(ctx, &fuse.RemovexattrRequest{Name: xattrACLDefault}); err != nil {
+		t.Fatalf("Removexattr: %v", err)
+	}
+	if err := data.Getxattr(ctx, &fuse.GetxattrRequest{Name: xattrACLDefault}, &fuse.GetxattrResponse{}); err != fuse.ErrNoXattr {
+		t.Errorf("Getxattr of removed default ACL returned %v", err)
+	}
+	err = a.Setxattr(ctx, &fuse.SetxattrRequest{Name: xattrACLDefault, Xattr: aclXattr(t, "user::rwx,group::r-x,other::---")})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.EACCES {
+		t.Errorf("Setxattr of default ACL of a file returned %v, want EACCES", err)
+	}
+}
+
+func TestPosixACLXattrsNeedHierarchicalNamespace(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	store.Put(ctx, "a.csv", []byte("a"), nil)
+	a := lookupFile(t, NewFS(store), "a.csv")
+
+	err := a.Getxattr(ctx, &fuse.GetxattrRequest{Name: xattrACLAccess}, &fuse.GetxattrResponse{})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.ENOTSUP {
+		t.Errorf("Getxattr returned %v, want ENOTSUP", err)
+	}
+	if err := a.Access(ctx, &fuse.AccessRequest{Header: fuse.Header{Uid: 1002}, Mask: 7}); err != nil {
+		t.Errorf("Access returned %v", err)
+	}
+}
+
+func TestUserXattrs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Storage) {
+		ctx := context.Background()
+		store.Put(ctx, "out.parquet", []byte("x"), map[string]string{metadataMode: "0640"})
+		f := lookupFile(t, NewFS(store), "out.parquet")
+
+		for name, value := range map[string]string{"user.provenance": "job-42", "user.source.path": "\x00raw"} {
+			if err := f.Setxattr(ctx, &fuse.SetxattrRequest{Name: name, Xattr: []byte(value)}); err != nil {
+				t.Fatalf("Setxattr %s: %v", name, err)
+			}
+		}
+		for _, tc := range []struct {
+			name  string
+			flags uint32
+			want  error
+		}{
+			{"user.provenance", xattrCreate, fuse.EEXIST},
+			{"user.missing", xattrReplace, fuse.ErrNoXattr},
+			{"user.azure.etag", 0, fuse.Errno(syscall.EPERM)},
+		} {
+			if err := f.Setxattr(ctx, &fuse.SetxattrRequest{Name: tc.name, Flags: tc.flags, Xattr: []byte("v")}); err != tc.want {
+				t.Errorf("Setxattr %s with flags %d returned %v, want %v", tc.name, tc.flags, err, tc.want)
+			}
+		}
+		blob, _ := store.GetProperties(ctx, "out.parquet")
+		if blob.Metadata["provenance"] != "job-42" || blob.Metadata["xattrb64_source_2epath"] != "AHJhdw==" || blob.Metadata[metadataMode] != "0640" {
+			t.Errorf("blob has metadata %v", blob.Metadata)
+		}
+
+		f = lookupFile(t, NewFS(store), "out.parquet")
+		for name, want := range map[string]string{
+			"user.source.path":       "\x00raw",
+			"user.PROVENANCE":        "job-42",
+			"user.azure.etag":        blob.ETag,
+			"user.azure.content_md5": "9dd4e461268c8034f5c8564e155c67a6",
+		} {
+			resp := &fuse.GetxattrResponse{}
+			if err := f.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, resp); err != nil || string(resp.Xattr) != want {
+				t.Errorf("Getxattr %s returned %q, %v, want %q", name, resp.Xattr, err, want)
+			}
+		}
+		list := &fuse.ListxattrResponse{}
+		if err := f.Listxattr(ctx, &fuse.ListxattrRequest{}, list); err != nil || !strings.HasPrefix(string(list.Xattr), "user.provenance\x00user.source.path\x00user.azure.") {
+			t.Errorf("Listxattr returned %q, %v", list.Xattr, err)
+		}
+
+		if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.source.path"}); err != nil {
+			t.Fatalf("Removexattr: %v", err)
+		}
+		if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.source.path"}); err != fuse.ErrNoXattr {
+			t.Errorf("second Removexattr returned %v", err)
+		}
+		if blob, _ := store.GetProperties(ctx, "out.parquet"); len(blob.Metadata) != 2 {
+			t.Errorf("blob has metadata %v after Removexattr", blob.Metadata)
+		}
+	})
+}
+
+func TestUserXattrsOfDirectories(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStorage()
+	store.Put(ctx, "data/a.csv", []byte("a"), nil)
+	filesys := NewFS(store)
+	readDirNames(t, filesys.root)
+	n, _ := filesys.root.Lookup(ctx, "data")
+
+	if err := n.(*Dir).Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.owner", Xattr: []byte("etl")}); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	blob, err := store.GetProperties(ctx, "data")
+	if err != nil || !isDirBlob(blob) || blob.Metadata["owner"] != "etl" {
+		t.Fatalf("marker of directory is %+v, %v", blob, err)
+	}
+	resp := &fuse.GetxattrResponse{}
+	if err := n.(*Dir).Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.owner"}, resp); err != nil || string(resp.Xattr) != "etl" {
+		t.Errorf("Getxattr returned %q, %v", resp.Xattr, err)
+	}
+	err = filesys.root.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.owner", Xattr: []byte("etl")})
+	if errno, ok := err.(fuse.Errno); !ok || syscall.Errno(errno) != syscall.ENOTSUP {
+		t.Errorf("Setxattr of root returned %v, want ENOTSUP", err)
+	}
+}